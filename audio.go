@@ -1,36 +1,35 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"mime/multipart"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/Vernacular-ai/godub"
+	"github.com/gin-gonic/gin"
 	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func splitAudio(file multipart.File) ([]string, error) {
-	tmpFilePath, err := saveTempFile(file)
-	if err != nil {
-		return nil, err
-	}
+// splitAudio splits the recording into chunks Whisper accepts. The chunks are written to dir, which the
+// caller removes together with the recording. The media info of the recording plans the chunks.
+func splitAudio(ctx context.Context, filePath string, dir string, media MediaInfo) (chunks []string, err error) {
+	ctx, span := startSpan(ctx, "split_audio")
+	defer func() {
+		span.SetAttributes(attribute.Int("audio.chunks", len(chunks)))
+		endSpan(span, err)
+	}()
 
-	if !needsSplitting(tmpFilePath) {
-		return []string{tmpFilePath}, nil
+	if !needsSplitting(filePath) {
+		return []string{filePath}, nil
 	}
 
-	return splitAudioBySilence(tmpFilePath)
-}
-
-func saveTempFile(file multipart.File) (string, error) {
-	filename := generateRandomFileName()
-	tmpFilePath := filepath.Join(os.TempDir(), filename)
-	err := saveFile(file, tmpFilePath)
-	return tmpFilePath, err
+	return splitAudioBySilence(ctx, filePath, dir, media)
 }
 
 func needsSplitting(filePath string) bool {
@@ -39,24 +38,67 @@ func needsSplitting(filePath string) bool {
 		return false
 	}
 	size := fi.Size()
-	return size >= int64(24*1024*1024)
+	return size >= maxChunkBytes
 }
 
-func splitAudioBySilence(tmpFilePath string) ([]string, error) {
-	totalDuration, err := getAdjustedDuration(tmpFilePath)
-	if err != nil {
-		return nil, err
+const (
+	// maxChunkBytes keeps chunks below the 25 MB limit of Whisper.
+	maxChunkBytes = 24 * 1024 * 1024
+	// maxChunkTime is the length of chunks of recordings with a low bit rate.
+	maxChunkTime = 10 * time.Minute
+	// encodedChunkBitRate is the bit rate of chunks that are encoded to MP3 because their codec cannot be
+	// copied into a format Whisper accepts.
+	encodedChunkBitRate = 128000
+)
+
+// chunkFormat returns the file extension of chunks of the audio codec and whether the audio can be copied
+// into them. Other codecs are encoded to MP3.
+func chunkFormat(codec string) (string, bool) {
+	switch {
+	case codec == "mp3":
+		return "mp3", true
+	case codec == "aac":
+		return "m4a", true
+	case codec == "opus", codec == "vorbis":
+		return "ogg", true
+	case codec == "flac":
+		return "flac", true
+	case strings.HasPrefix(codec, "pcm_"):
+		return "wav", true
+	}
+	return "mp3", false
+}
+
+// chunkTargetTime returns the length to aim for when splitting the recording. Chunks end at a silence
+// up to a fifth of the target time after it, so the target leaves room for that below maxChunkBytes.
+func chunkTargetTime(media MediaInfo) time.Duration {
+	bitRate := media.AudioBitRate()
+	if _, copied := chunkFormat(media.Codec); !copied {
+		bitRate = encodedChunkBitRate
+	}
+	if bitRate <= 0 {
+		return maxChunkTime
 	}
+	maxTime := time.Duration(float64(maxChunkBytes*8) / float64(bitRate) * float64(time.Second))
+	return min(maxChunkTime, maxTime*5/6)
+}
+
+func splitAudioBySilence(ctx context.Context, tmpFilePath string, dir string, media MediaInfo) ([]string, error) {
+	if media.Duration <= 0 {
+		return nil, errors.New("unknown duration of the recording")
+	}
+	totalDuration := media.Duration - 1*time.Second // Remove 1 second to avoid the last chunk being empty
 
-	silenceTimestamps, err := getSilenceTimestamps(tmpFilePath)
+	silenceTimestamps, err := getSilenceTimestamps(ctx, tmpFilePath)
 	if err != nil {
 		return nil, err
 	}
 
 	chunkPaths := []string{}
 	startTime := 0 * time.Second
-	targetTime := 10 * time.Minute
-	searchRange := 2 * time.Minute
+	targetTime := chunkTargetTime(media)
+	searchRange := targetTime / 5
+	extension, copied := chunkFormat(media.Codec)
 
 	for startTime < totalDuration {
 		splitTime, err := findSplitTime(startTime, targetTime, searchRange, totalDuration, silenceTimestamps)
@@ -64,10 +106,14 @@ func splitAudioBySilence(tmpFilePath string) ([]string, error) {
 			return nil, err
 		}
 
-		chunkPath, err := createChunk(tmpFilePath, startTime, splitTime)
+		chunkPath, err := createChunk(ctx, tmpFilePath, dir, startTime, splitTime, extension, copied)
 		if err != nil {
 			return nil, err
 		}
+		logEvent(ctx, slog.LevelDebug, "chunk_created", gin.H{
+			"start": startTime.String(),
+			"end":   splitTime.String(),
+		})
 
 		chunkPaths = append(chunkPaths, chunkPath)
 		startTime = splitTime
@@ -76,26 +122,17 @@ func splitAudioBySilence(tmpFilePath string) ([]string, error) {
 	return chunkPaths, nil
 }
 
-func getAdjustedDuration(filePath string) (time.Duration, error) {
-	duration, err := getAudioDuration(filePath)
-	if err != nil {
-		return 0, err
-	}
-	return duration - 1*time.Second, nil // Remove 1 second to avoid the last chunk being empty
-}
-
-func createChunk(tmpFilePath string, startTime, splitTime time.Duration) (string, error) {
-	chunkPath := filepath.Join(os.TempDir(), fmt.Sprintf("chunk-%d-%d-%d.mp3", time.Now().UnixNano(), startTime, splitTime))
-	err := splitMp3At(tmpFilePath, chunkPath, startTime, splitTime)
+func createChunk(ctx context.Context, tmpFilePath string, dir string, startTime, splitTime time.Duration, extension string, copied bool) (string, error) {
+	_, span := startSpan(ctx, "create_chunk",
+		attribute.String("audio.chunk.start", startTime.String()),
+		attribute.String("audio.chunk.end", splitTime.String()),
+	)
+	chunkPath := filepath.Join(dir, fmt.Sprintf("chunk-%d-%d.%s", startTime, splitTime, extension))
+	err := splitAudioAt(ctx, tmpFilePath, chunkPath, startTime, splitTime, copied)
+	endSpan(span, err)
 	return chunkPath, err
 }
 
-// Generate a random file name for the uploaded audio
-func generateRandomFileName() string {
-	timestamp := time.Now().UnixNano()
-	return fmt.Sprintf("uploaded_audio_%d.mp3", timestamp)
-}
-
 // Find the split time based on silence timestamps or target time
 func findSplitTime(startTime time.Duration, targetTime time.Duration, searchRange time.Duration, totalDuration time.Duration, silenceTimestamps []time.Duration) (time.Duration, error) {
 	var splitTime time.Duration
@@ -105,7 +142,6 @@ func findSplitTime(startTime time.Duration, targetTime time.Duration, searchRang
 	for _, silenceTime := range silenceTimestamps {
 		if silenceTime >= startTime+targetTime-searchRange && silenceTime <= startTime+targetTime+searchRange {
 			splitTime = silenceTime
-			fmt.Println("Found silence at", splitTime)
 			foundSplit = true
 			break
 		}
@@ -122,16 +158,19 @@ func findSplitTime(startTime time.Duration, targetTime time.Duration, searchRang
 	return splitTime, nil
 }
 
-func getAudioDuration(inputFilePath string) (time.Duration, error) {
-	audioSegment, err := godub.NewLoader().Load(inputFilePath)
+// getAudioDuration returns the duration of the recording as reported by ffprobe.
+func getAudioDuration(ctx context.Context, inputFilePath string) (time.Duration, error) {
+	media, err := probeMedia(ctx, inputFilePath)
 	if err != nil {
 		return 0, err
 	}
-
-	return audioSegment.Duration(), nil
+	return media.Duration, nil
 }
 
-func splitMp3At(inputFilePath string, outputFilePath string, startTime time.Duration, endTime time.Duration) error {
+// splitAudioAt writes the first audio stream of the recording from startTime to endTime to the output
+// file. The audio is copied if copied is set, and encoded to MP3 otherwise. ffmpeg is killed when the
+// context is done.
+func splitAudioAt(ctx context.Context, inputFilePath string, outputFilePath string, startTime time.Duration, endTime time.Duration, copied bool) error {
 	// like "00:09:59"
 	startTimeString := fmt.Sprintf("%02d:%02d:%02d", int(startTime.Hours()), int(startTime.Minutes())%60, int(startTime.Seconds())%60)
 	endTimeString := fmt.Sprintf("%02d:%02d:%02d", int(endTime.Hours()), int(endTime.Minutes())%60, int(endTime.Seconds())%60)
@@ -145,9 +184,17 @@ func splitMp3At(inputFilePath string, outputFilePath string, startTime time.Dura
 		args["to"] = endTimeString
 	}
 
-	args["acodec"] = "copy"
+	args["map"] = "0:a:0" // leave out video and other streams
+	if copied {
+		args["acodec"] = "copy"
+	} else {
+		args["acodec"] = "libmp3lame"
+		args["b:a"] = strconv.Itoa(encodedChunkBitRate)
+	}
 	args["y"] = "" // overwrite output file if it exists
-	err := ffmpeg.Input(inputFilePath).Output(outputFilePath, args).Run()
+	start := time.Now()
+	err := ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{ffmpeg.Input(inputFilePath)}, outputFilePath, args).Run()
+	observeFFmpeg("split", start, err)
 	if err != nil {
 		return err
 	}
@@ -155,17 +202,24 @@ func splitMp3At(inputFilePath string, outputFilePath string, startTime time.Dura
 	return nil
 }
 
-func getSilenceTimestamps(inputFilePath string) ([]time.Duration, error) {
+func getSilenceTimestamps(ctx context.Context, inputFilePath string) ([]time.Duration, error) {
 	silenceArgs := ffmpeg.KwArgs{
 		"af": "silencedetect=d=0.4",
 		"f":  "null",
 	}
 	// io.Writer to capture the output
 	stdErrWriter := &strings.Builder{}
-	err := ffmpeg.Input(inputFilePath).Output("-", silenceArgs).WithErrorOutput(stdErrWriter).Run()
+	_, span := startSpan(ctx, "detect_silence")
+	start := time.Now()
+	err := ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{ffmpeg.Input(inputFilePath)}, "-", silenceArgs).WithErrorOutput(stdErrWriter).Run()
+	observeFFmpeg("silence_detection", start, err)
+	endSpan(span, err)
 
 	if err != nil {
-		fmt.Println(stdErrWriter.String())
+		logEvent(ctx, slog.LevelError, "silence_detection_failed", gin.H{
+			"error":  err.Error(),
+			"output": stdErrWriter.String(),
+		})
 		return nil, err
 	}
 
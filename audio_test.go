@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -9,7 +10,7 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-// test for func splitAudio(file multipart.File) ([]string, error)
+// test for func splitAudio(ctx context.Context, filePath string, dir string, media MediaInfo) ([]string, error)
 // setup: use the file from the testdata folder: test/fixtures/15mins.mp3
 // test: check that the function returns 2 chunks
 // test: check that the chunks are not empty
@@ -17,11 +18,9 @@ import (
 // test: check that the chunks are not the same as the original file
 
 func TestSplitAudio(t *testing.T) {
-	file, err := os.Open("test/fixtures/15mins.mp3")
+	media, err := probeMedia(context.Background(), "test/fixtures/15mins.mp3")
 	require.NoError(t, err)
-	defer file.Close()
-
-	chunks, err := splitAudio(file)
+	chunks, err := splitAudio(context.Background(), "test/fixtures/15mins.mp3", t.TempDir(), media)
 	require.NoError(t, err)
 	require.Len(t, chunks, 2)
 
@@ -31,12 +30,12 @@ func TestSplitAudio(t *testing.T) {
 	}
 
 	// check that the first chunk is longer than 8 minutes
-	duration1, err := getAudioDuration(chunks[0])
+	duration1, err := getAudioDuration(context.Background(), chunks[0])
 	require.NoError(t, err)
 	assert.Greater(t, duration1, 8*time.Minute)
 
 	// check that the second chunk is longer than 3 minutes
-	duration2, err := getAudioDuration(chunks[1])
+	duration2, err := getAudioDuration(context.Background(), chunks[1])
 	require.NoError(t, err)
 	assert.Greater(t, duration2, 3*time.Minute)
 
@@ -51,11 +50,9 @@ func TestSplitAudio(t *testing.T) {
 }
 
 func TestSplitAudio_Short(t *testing.T) {
-	file, err := os.Open("test/fixtures/short.mp3")
+	media, err := probeMedia(context.Background(), "test/fixtures/short.mp3")
 	require.NoError(t, err)
-	defer file.Close()
-
-	chunks, err := splitAudio(file)
+	chunks, err := splitAudio(context.Background(), "test/fixtures/short.mp3", t.TempDir(), media)
 	require.NoError(t, err)
 	require.Len(t, chunks, 1)
 
@@ -64,7 +61,7 @@ func TestSplitAudio_Short(t *testing.T) {
 		assert.NotEqual(t, "testdata/short.mp3", chunk)
 	}
 
-	duration1, err := getAudioDuration(chunks[0])
+	duration1, err := getAudioDuration(context.Background(), chunks[0])
 	require.NoError(t, err)
 	assert.Greater(t, duration1, 2*time.Second)
 }
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	headerAPIKey = "X-API-Key"
+
+	// jwksRefreshInterval is how long fetched signing keys are used before they are fetched again.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits how often unknown key IDs trigger fetching the keys again.
+	jwksMinRefreshInterval = time.Minute
+	// oidcRequestTimeout limits requests to the OpenID Connect provider, so a slow provider cannot hold
+	// up authentication.
+	oidcRequestTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator if the request does not carry credentials it handles.
+	ErrNoCredentials = errors.New("no credentials")
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrUnknownKey    = errors.New("unknown signing key")
+)
+
+// Authenticator identifies the user making a request.
+type Authenticator interface {
+	// Authenticate returns the ID of the user, ErrNoCredentials if the request carries no credentials the
+	// authenticator handles, or another error if the credentials are invalid.
+	Authenticate(r *http.Request) (string, error)
+}
+
+// AuthConfig configures authentication and CORS. It is read from the environment in main.
+type AuthConfig struct {
+	// APIKeys are static keys in the form "user:key". Keys without a user are identified by a hash of the key.
+	APIKeys []string
+	// OIDCIssuer is the expected "iss" claim of JWTs. Its discovery document is used to find the JWKS if
+	// OIDCJWKSURL is empty.
+	OIDCIssuer string
+	// OIDCAudience is the expected "aud" claim of JWTs.
+	OIDCAudience string
+	OIDCJWKSURL  string
+	// OIDCUserClaim is the claim holding the user ID, "sub" by default.
+	OIDCUserClaim string
+	// CORSAllowedOrigins are the origins browsers may call the API from. All origins are allowed if empty.
+	CORSAllowedOrigins []string
+}
+
+// loadAuthConfig reads the configuration from the environment.
+func loadAuthConfig(getenv func(string) string) AuthConfig {
+	return AuthConfig{
+		APIKeys:            splitList(getenv("API_KEYS")),
+		OIDCIssuer:         getenv("OIDC_ISSUER"),
+		OIDCAudience:       getenv("OIDC_AUDIENCE"),
+		OIDCJWKSURL:        getenv("OIDC_JWKS_URL"),
+		OIDCUserClaim:      getenv("OIDC_USER_CLAIM"),
+		CORSAllowedOrigins: splitList(getenv("CORS_ALLOWED_ORIGINS")),
+	}
+}
+
+// splitList splits a comma-separated list and drops empty entries.
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// authenticators returns the authenticators enabled by the configuration.
+func (config AuthConfig) authenticators() ([]Authenticator, error) {
+	var authenticators []Authenticator
+	if len(config.APIKeys) > 0 {
+		authenticators = append(authenticators, newAPIKeyAuthenticator(config.APIKeys))
+	}
+	if config.OIDCIssuer != "" || config.OIDCJWKSURL != "" {
+		jwtAuthenticator, err := newJWTAuthenticator(config, &http.Client{Timeout: oidcRequestTimeout})
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwtAuthenticator)
+	}
+	return authenticators, nil
+}
+
+// corsMiddleware allows the configured origins, or all origins if none are configured, to call the API
+// with credentials in the Authorization or X-API-Key header.
+func (config AuthConfig) corsMiddleware() gin.HandlerFunc {
+	corsConfig := cors.DefaultConfig()
+	if len(config.CORSAllowedOrigins) > 0 {
+		corsConfig.AllowOrigins = config.CORSAllowedOrigins
+	} else {
+		corsConfig.AllowAllOrigins = true
+	}
+	corsConfig.AddAllowHeaders("Authorization", headerAPIKey, headerOpenAIKey, headerUploadOffset, headerWebhookURL, headerRequestID, "traceparent", "tracestate", "Cache-Control")
+	corsConfig.AddExposeHeaders(headerUploadOffset, headerUploadLength, "Location", headerRequestID)
+	return cors.New(corsConfig)
+}
+
+// authMiddleware requires every request to be authenticated by one of the authenticators and stores the
+// ID of the user in the context. Without authenticators, authentication is disabled. Resumed jobs carry
+// no credentials and run as the user that was authenticated when the job was accepted.
+func authMiddleware(authenticators []Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if job, ok := resumedJob(c.Request.Context()); ok {
+			if job.AuthenticatedUser != "" {
+				c.Set(contextKeyUser, job.AuthenticatedUser)
+			}
+			c.Next()
+			return
+		}
+		if len(authenticators) == 0 {
+			c.Next()
+			return
+		}
+
+		for _, authenticator := range authenticators {
+			user, err := authenticator.Authenticate(c.Request)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			if err != nil {
+				logEvent(c, slog.LevelWarn, "authentication_failed", gin.H{
+					"path":  c.Request.URL.Path,
+					"error": err.Error(),
+				})
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+				return
+			}
+
+			logEvent(c, slog.LevelInfo, "request_authenticated", gin.H{
+				"user": user,
+				"path": c.Request.URL.Path,
+			})
+			c.Set(contextKeyUser, user)
+			c.Next()
+			return
+		}
+
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+	}
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// looksLikeJWT reports whether the token consists of three dot-separated parts.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// apiKeyAuthenticator accepts static API keys in the X-API-Key header or as bearer tokens.
+type apiKeyAuthenticator struct {
+	// users maps the SHA-256 hash of every key to its user, so keys are not compared byte by byte.
+	users map[[sha256.Size]byte]string
+}
+
+func newAPIKeyAuthenticator(keys []string) *apiKeyAuthenticator {
+	authenticator := &apiKeyAuthenticator{users: map[[sha256.Size]byte]string{}}
+	for _, entry := range keys {
+		user, key, ok := strings.Cut(entry, ":")
+		if !ok {
+			user, key = "", entry
+		}
+		hash := sha256.Sum256([]byte(key))
+		if user == "" {
+			user = fmt.Sprintf("key-%x", hash[:4])
+		}
+		authenticator.users[hash] = user
+	}
+	return authenticator
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get(headerAPIKey)
+	if key == "" {
+		key = bearerToken(r)
+		if key == "" || looksLikeJWT(key) {
+			return "", ErrNoCredentials
+		}
+	}
+
+	user, ok := a.users[sha256.Sum256([]byte(key))]
+	if !ok {
+		return "", ErrInvalidAPIKey
+	}
+	return user, nil
+}
+
+// jwtAuthenticator accepts JWT bearer tokens signed with a key of a JWKS, e.g. ID or access tokens of an
+// OpenID Connect provider.
+type jwtAuthenticator struct {
+	issuer    string
+	audience  string
+	userClaim string
+	jwks      *jwksCache
+}
+
+func newJWTAuthenticator(config AuthConfig, client *http.Client) (*jwtAuthenticator, error) {
+	jwksURL := config.OIDCJWKSURL
+	if jwksURL == "" {
+		discovered, err := discoverJWKSURL(context.Background(), client, config.OIDCIssuer)
+		if err != nil {
+			return nil, err
+		}
+		jwksURL = discovered
+	}
+
+	userClaim := config.OIDCUserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	return &jwtAuthenticator{
+		issuer:    config.OIDCIssuer,
+		audience:  config.OIDCAudience,
+		userClaim: userClaim,
+		jwks:      &jwksCache{url: jwksURL, client: client},
+	}, nil
+}
+
+// discoverJWKSURL reads the jwks_uri from the OpenID Connect discovery document of the issuer.
+func discoverJWKSURL(ctx context.Context, client *http.Client, issuer string) (string, error) {
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, client, url, &discovery); err != nil {
+		return "", fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if discovery.JWKSURI == "" {
+		return "", fmt.Errorf("OIDC discovery: %s has no jwks_uri", url)
+	}
+	return discovery.JWKSURI, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" || !looksLikeJWT(token) {
+		return "", ErrNoCredentials
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	}
+	if a.issuer != "" {
+		options = append(options, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		options = append(options, jwt.WithAudience(a.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return a.jwks.key(r.Context(), kid)
+	}, options...)
+	if err != nil {
+		return "", err
+	}
+
+	user, _ := claims[a.userClaim].(string)
+	if user == "" {
+		return "", fmt.Errorf("token has no %q claim", a.userClaim)
+	}
+	return user, nil
+}
+
+// jwksCache fetches the keys of a JSON Web Key Set and keeps them for jwksRefreshInterval. Unknown key IDs
+// trigger fetching the keys again, at most once per jwksMinRefreshInterval, so rotated keys are picked up.
+// The keys are fetched by one request at a time without holding the lock, concurrent requests wait for
+// that fetch instead of fetching the keys again.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]any
+	fetchedAt time.Time
+	// fetchErr is the error of the last fetch.
+	fetchErr error
+	// fetching is closed when the running fetch completes. It is nil if no fetch is running.
+	fetching chan struct{}
+}
+
+func (j *jwksCache) key(ctx context.Context, kid string) (any, error) {
+	j.mu.Lock()
+	for j.fetching != nil {
+		fetching := j.fetching
+		j.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		j.mu.Lock()
+	}
+
+	key, ok := j.keys[kid]
+	expired := time.Since(j.fetchedAt) > jwksRefreshInterval
+	if ok && !expired {
+		j.mu.Unlock()
+		return key, nil
+	}
+	if !expired && time.Since(j.fetchedAt) < jwksMinRefreshInterval {
+		err := j.fetchErr
+		j.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	fetching := make(chan struct{})
+	j.fetching = fetching
+	j.mu.Unlock()
+
+	keys, err := fetchJWKS(ctx, j.client, j.url)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fetching = nil
+	close(fetching)
+	// A fetch cancelled with its request does not count, the next request fetches the keys again.
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	j.fetchedAt = time.Now()
+	j.fetchErr = err
+	if err != nil {
+		return nil, err
+	}
+	j.keys = keys
+
+	key, ok = j.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	return key, nil
+}
+
+// jsonWebKey is a public RSA or EC key of a JWKS.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS fetches a JSON Web Key Set and returns its signing keys by key ID. Keys of unsupported types
+// are skipped.
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]any, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, client, url, &set); err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+
+	keys := map[string]any{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logEvent(ctx, slog.LevelWarn, "jwks_key_skipped", gin.H{
+				"kid":   jwk.Kid,
+				"error": err.Error(),
+			})
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (any, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
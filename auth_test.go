@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIdentityProvider is a local stand-in for an OpenID Connect provider serving a discovery document
+// and a JWKS with an RSA and an EC key.
+type testIdentityProvider struct {
+	server     *httptest.Server
+	rsaKey     *rsa.PrivateKey
+	ecKey      *ecdsa.PrivateKey
+	jwksserved int
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	provider := &testIdentityProvider{rsaKey: rsaKey, ecKey: ecKey}
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(gin.H{"issuer": provider.server.URL, "jwks_uri": provider.server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		provider.jwksserved++
+		json.NewEncoder(w).Encode(gin.H{"keys": []gin.H{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes())},
+			{"kty": "oct", "kid": "symmetric", "k": "c2VjcmV0"},
+		}})
+	})
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (p *testIdentityProvider) token(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	var key any = p.rsaKey
+	if method == jwt.SigningMethodES256 {
+		key = p.ecKey
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func (p *testIdentityProvider) claims(subject string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": p.server.URL,
+		"aud": "talk-tailor",
+		"sub": subject,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func requestWithHeader(name, value string) *http.Request {
+	req, _ := http.NewRequest("GET", "/api/usage", nil)
+	if name != "" {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	authenticator := newAPIKeyAuthenticator([]string{"alice:secret-1", "secret-2"})
+
+	user, err := authenticator.Authenticate(requestWithHeader(headerAPIKey, "secret-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	user, err = authenticator.Authenticate(requestWithHeader("Authorization", "Bearer secret-2"))
+	require.NoError(t, err)
+	assert.Regexp(t, `^key-[0-9a-f]{8}$`, user)
+
+	_, err = authenticator.Authenticate(requestWithHeader(headerAPIKey, "wrong"))
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, err = authenticator.Authenticate(requestWithHeader("", ""))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	_, err = authenticator.Authenticate(requestWithHeader("Authorization", "Bearer a.b.c"))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	provider := newTestIdentityProvider(t)
+	authenticator, err := newJWTAuthenticator(AuthConfig{OIDCIssuer: provider.server.URL, OIDCAudience: "talk-tailor"}, provider.server.Client())
+	require.NoError(t, err)
+	authenticate := func(token string) (string, error) {
+		return authenticator.Authenticate(requestWithHeader("Authorization", "Bearer "+token))
+	}
+
+	user, err := authenticate(provider.token(t, jwt.SigningMethodRS256, "rsa", provider.claims("alice")))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	user, err = authenticate(provider.token(t, jwt.SigningMethodES256, "ec", provider.claims("bob")))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", user)
+	assert.Equal(t, 1, provider.jwksserved, "keys are cached")
+
+	expired := provider.claims("alice")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = authenticate(provider.token(t, jwt.SigningMethodRS256, "rsa", expired))
+	assert.ErrorIs(t, err, jwt.ErrTokenExpired)
+
+	wrongAudience := provider.claims("alice")
+	wrongAudience["aud"] = "other"
+	_, err = authenticate(provider.token(t, jwt.SigningMethodRS256, "rsa", wrongAudience))
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidAudience)
+
+	withoutExpiry := provider.claims("alice")
+	delete(withoutExpiry, "exp")
+	_, err = authenticate(provider.token(t, jwt.SigningMethodRS256, "rsa", withoutExpiry))
+	assert.Error(t, err)
+
+	// tokens signed with the key of another kid do not verify
+	_, err = authenticate(provider.token(t, jwt.SigningMethodRS256, "ec", provider.claims("alice")))
+	assert.Error(t, err)
+
+	// unknown keys are looked up again at most once per jwksMinRefreshInterval
+	_, err = authenticate(provider.token(t, jwt.SigningMethodRS256, "rotated", provider.claims("alice")))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	assert.Equal(t, 1, provider.jwksserved)
+
+	_, err = authenticator.Authenticate(requestWithHeader(headerAPIKey, "secret"))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestJWKSCache(t *testing.T) {
+	provider := newTestIdentityProvider(t)
+	cache := &jwksCache{url: provider.server.URL + "/jwks", client: provider.server.Client()}
+
+	// concurrent lookups share a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.key(context.Background(), "rsa")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, provider.jwksserved)
+
+	// a fetch ends with its request and does not count as a fetch
+	cache = &jwksCache{url: provider.server.URL + "/jwks", client: provider.server.Client()}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := cache.key(ctx, "rsa")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = cache.key(context.Background(), "rsa")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, provider.jwksserved)
+}
+
+func TestJWTAuthenticator_UserClaim(t *testing.T) {
+	provider := newTestIdentityProvider(t)
+	authenticator, err := newJWTAuthenticator(AuthConfig{OIDCJWKSURL: provider.server.URL + "/jwks", OIDCUserClaim: "email"}, provider.server.Client())
+	require.NoError(t, err)
+
+	claims := provider.claims("alice")
+	claims["email"] = "alice@example.com"
+	user, err := authenticator.Authenticate(requestWithHeader("Authorization", "Bearer "+provider.token(t, jwt.SigningMethodRS256, "rsa", claims)))
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", user)
+
+	_, err = authenticator.Authenticate(requestWithHeader("Authorization", "Bearer "+provider.token(t, jwt.SigningMethodRS256, "rsa", provider.claims("alice"))))
+	assert.Error(t, err)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newRouter := func(authenticators []Authenticator) *gin.Engine {
+		r := gin.New()
+		r.GET("/api/usage", authMiddleware(authenticators), func(c *gin.Context) {
+			c.String(http.StatusOK, userID(c))
+		})
+		return r
+	}
+	serve := func(r *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req.RemoteAddr = "192.0.2.1:1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// without authenticators, users are identified by their IP address
+	w := serve(newRouter(nil), requestWithHeader("", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ip:192.0.2.1", w.Body.String())
+
+	r := newRouter([]Authenticator{newAPIKeyAuthenticator([]string{"alice:secret"})})
+	w = serve(r, requestWithHeader(headerAPIKey, "secret"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+
+	w = serve(r, requestWithHeader("", ""))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	w = serve(r, requestWithHeader(headerAPIKey, "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCORSAllowList(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(AuthConfig{CORSAllowedOrigins: []string{"https://app.example.com"}}.corsMiddleware())
+	r.GET("/api/usage", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("OPTIONS", "/api/usage", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "Authorization")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight("https://app.example.com")
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	w = preflight("https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestLoadAuthConfig(t *testing.T) {
+	env := map[string]string{
+		"API_KEYS":             "alice:one, bob:two,",
+		"OIDC_ISSUER":          "https://idp.example.com",
+		"CORS_ALLOWED_ORIGINS": "https://a.example.com,https://b.example.com",
+	}
+	config := loadAuthConfig(func(name string) string { return env[name] })
+	assert.Equal(t, []string{"alice:one", "bob:two"}, config.APIKeys)
+	assert.Equal(t, "https://idp.example.com", config.OIDCIssuer)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, config.CORSAllowedOrigins)
+}
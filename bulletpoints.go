@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const promptBulletpointsMerge = "bulletpoints_merge"
+
+// BulletpointsRequest is the JSON body of POST /api/bulletpoints and POST /api/bulletpoints/stream.
+type BulletpointsRequest struct {
+	Text          string `json:"text"`
+	PromptVersion string `json:"prompt_version"`
+	Language      string `json:"language"`
+	// Consolidate merges and de-duplicates the bulletpoints of all parts of a long text. Defaults to true.
+	Consolidate *bool `json:"consolidate"`
+}
+
+// BulletNode is a heading or a bulletpoint in a bulletpoint tree.
+type BulletNode struct {
+	Text     string        `json:"text"`
+	Heading  bool          `json:"heading,omitempty"`
+	Children []*BulletNode `json:"children,omitempty"`
+}
+
+func bulletpointsHandler(client OpenAIClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := requestClient(c, client)
+		defer client.save(c)
+		if abortOnQuotaError(c, client.checkQuota()) {
+			return
+		}
+
+		request, prompt, language, ok := bindBulletpointsRequest(c, client)
+		if !ok {
+			return
+		}
+
+		consolidate := request.Consolidate == nil || *request.Consolidate
+
+		bulletpoints, err := createBulletpoints(c.Request.Context(), client, request.Text, tokensForCompletion, prompt, consolidate)
+
+		if abortOnQuotaError(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating response"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"response": bulletpoints.Markdown(), "bulletpoints": bulletpoints.Tree(), "language": language, "usage": client.Usage()})
+	}
+}
+
+// bulletpointsStreamHandler streams the bulletpoints of every part of the text as Markdown via server-sent
+// events. The lists of the parts are not consolidated.
+func bulletpointsStreamHandler(client OpenAIClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := requestClient(c, client)
+		defer client.save(c)
+		if abortOnQuotaError(c, client.checkQuota()) {
+			return
+		}
+
+		request, prompt, language, ok := bindBulletpointsRequest(c, client)
+		if !ok {
+			return
+		}
+
+		parts := splitLongString(request.Text, tokensForCompletion)
+		streamMarkdown(c, client, promptBulletpoints, parts, "\n", 16384-tokensForCompletion, func(ctx context.Context, part string) (string, error) {
+			return promptStore.Render(promptBulletpoints, prompt, prompt.data(part))
+		}, func(response string) gin.H {
+			return gin.H{"response": response, "bulletpoints": parseBulletTree(response), "language": language, "usage": client.Usage()}
+		})
+	}
+}
+
+// bindBulletpointsRequest parses and validates the bulletpoints request and resolves its language. If the
+// request is invalid, an error response is written and ok is false.
+func bindBulletpointsRequest(c *gin.Context, client OpenAIClient) (request BulletpointsRequest, prompt PromptSelection, language DetectedLanguage, ok bool) {
+	if err := c.ShouldBindJSON(&request); err != nil {
+		logEvent(c, slog.LevelInfo, "invalid_json", gin.H{
+			"error": err.Error(),
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	if request.Text == "" {
+		logEvent(c, slog.LevelInfo, "no_text_provided", gin.H{
+			"error": "No text provided",
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No text provided"})
+		return
+	}
+
+	prompt = PromptSelection{
+		Version:  request.PromptVersion,
+		Language: request.Language,
+	}
+	if !promptStore.HasVersion(prompt.Version) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt version"})
+		return
+	}
+
+	language, err := resolveLanguage(c.Request.Context(), client, request.Text, &prompt, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid language"})
+		return
+	}
+
+	return request, prompt, language, true
+}
+
+// createBulletpoints turns every part of the text into bulletpoints. If consolidate is set and the text
+// consists of more than one part, the lists of all parts are merged into a single de-duplicated list
+// that is grouped under headings. Otherwise the lists are simply concatenated.
+func createBulletpoints(ctx context.Context, client OpenAIClient, text string, maxTokens int, selection PromptSelection, consolidate bool) (*StructuredBulletpoints, error) {
+	lists, err := processPartsInParallel(ctx, splitLongString(text, maxTokens), func(ctx context.Context, part string) (*StructuredBulletpoints, error) {
+		logEvent(ctx, slog.LevelDebug, "creating_bulletpoints", gin.H{
+			"part": redact(part),
+		})
+		prompt, err := promptStore.Render(promptBulletpoints, selection, selection.data(part))
+		if err != nil {
+			return nil, err
+		}
+		return completeBulletpoints(ctx, client, prompt, maxTokens)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !consolidate || len(lists) <= 1 {
+		return concatBulletpoints(lists), nil
+	}
+
+	merge := func(ctx context.Context, group string) (*StructuredBulletpoints, error) {
+		logEvent(ctx, slog.LevelDebug, "consolidating_bulletpoints", gin.H{
+			"lists": redact(group),
+		})
+		prompt, err := promptStore.Render(promptBulletpointsMerge, selection, selection.data(group))
+		if err != nil {
+			return nil, err
+		}
+		return completeBulletpoints(ctx, client, prompt, maxTokens)
+	}
+
+	// As long as the lists are longer than maxTokens, they are merged in groups in parallel, so the final
+	// merge always fits into the token budget.
+	joined := joinBulletpoints(lists)
+	for numTokens := getNumTokens(joined); numTokens > maxTokens; {
+		lists, err = processPartsInParallel(ctx, splitLongString(joined, maxTokens), merge)
+		if err != nil {
+			return nil, err
+		}
+		joined = joinBulletpoints(lists)
+		reducedTokens := getNumTokens(joined)
+		if reducedTokens >= numTokens {
+			return nil, ErrNoReduceProgress
+		}
+		numTokens = reducedTokens
+	}
+
+	return merge(ctx, joined)
+}
+
+func completeBulletpoints(ctx context.Context, client OpenAIClient, prompt string, maxTokens int) (*StructuredBulletpoints, error) {
+	return completeStructured[StructuredBulletpoints](ctx, client, structuredOutputModel, "bulletpoints", prompt, 16384-maxTokens)
+}
+
+// joinBulletpoints renders the lists as Markdown for the merge prompt.
+func joinBulletpoints(lists []*StructuredBulletpoints) string {
+	markdown := make([]string, len(lists))
+	for i, list := range lists {
+		markdown[i] = list.Markdown()
+	}
+	return strings.Join(markdown, ParagraphSeparator)
+}
+
+// concatBulletpoints concatenates the sections of the lists. Consecutive sections with the same heading,
+// e.g. the sections without a heading of unconsolidated lists, are combined.
+func concatBulletpoints(lists []*StructuredBulletpoints) *StructuredBulletpoints {
+	result := &StructuredBulletpoints{}
+	for _, list := range lists {
+		for _, section := range list.Sections {
+			if last := len(result.Sections) - 1; last >= 0 && result.Sections[last].Heading == section.Heading {
+				result.Sections[last].Bulletpoints = append(result.Sections[last].Bulletpoints, section.Bulletpoints...)
+				continue
+			}
+			section.Bulletpoints = append([]Bulletpoint(nil), section.Bulletpoints...)
+			result.Sections = append(result.Sections, section)
+		}
+	}
+	return result
+}
+
+// Tree returns the bulletpoints as a tree: sections with a heading contain their bulletpoints, which
+// contain their details. Bulletpoints of sections without a heading are roots.
+func (b *StructuredBulletpoints) Tree() []*BulletNode {
+	var roots []*BulletNode
+	for _, section := range b.Sections {
+		var nodes []*BulletNode
+		for _, bulletpoint := range section.Bulletpoints {
+			node := &BulletNode{Text: bulletpoint.Text}
+			for _, detail := range bulletpoint.Details {
+				node.Children = append(node.Children, &BulletNode{Text: detail})
+			}
+			nodes = append(nodes, node)
+		}
+		if section.Heading == "" {
+			roots = append(roots, nodes...)
+		} else {
+			roots = append(roots, &BulletNode{Text: section.Heading, Heading: true, Children: nodes})
+		}
+	}
+	return roots
+}
+
+// parseBulletTree parses Markdown headings and (nested) list items into a tree, for the Markdown streamed
+// by /api/bulletpoints/stream and sent to /api/translate. Headings contain all
+// following items up to the next heading of the same or a higher level, list items are nested by their
+// indentation. Lines that are neither are appended to the text of the preceding node.
+func parseBulletTree(markdown string) []*BulletNode {
+	type entry struct {
+		node  *BulletNode
+		depth int
+	}
+
+	var roots []*BulletNode
+	var stack []entry
+
+	for _, line := range strings.Split(markdown, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		var node *BulletNode
+		var depth int
+		if level := headingLevel(trimmed); level > 0 {
+			// Headings are always above list items, which have a depth of zero or more.
+			node = &BulletNode{Text: strings.TrimSpace(trimmed[level:]), Heading: true}
+			depth = level - 7
+		} else if text, ok := listItemText(trimmed); ok {
+			node = &BulletNode{Text: text}
+			depth = indentation(line)
+		} else if len(stack) > 0 {
+			last := stack[len(stack)-1].node
+			last.Text += " " + trimmed
+			continue
+		} else {
+			node = &BulletNode{Text: trimmed}
+			depth = indentation(line)
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].depth >= depth {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			roots = append(roots, node)
+		} else {
+			parent := stack[len(stack)-1].node
+			parent.Children = append(parent.Children, node)
+		}
+		stack = append(stack, entry{node: node, depth: depth})
+	}
+
+	return roots
+}
+
+// headingLevel returns the level of a Markdown ATX heading or zero if the line is not a heading.
+func headingLevel(line string) int {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return 0
+	}
+	return level
+}
+
+// listItemText returns the text of a bulleted ("-", "*", "+") or numbered ("1." or "1)") list item.
+func listItemText(line string) (string, bool) {
+	for _, marker := range []string{"- ", "* ", "+ ", "• "} {
+		if strings.HasPrefix(line, marker) {
+			return strings.TrimSpace(line[len(marker):]), true
+		}
+	}
+
+	digits := 0
+	for digits < len(line) && line[digits] >= '0' && line[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && digits+1 < len(line) && (line[digits] == '.' || line[digits] == ')') && line[digits+1] == ' ' {
+		return strings.TrimSpace(line[digits+2:]), true
+	}
+	return "", false
+}
+
+// indentation returns the width of the leading whitespace of a line, counting tabs as four spaces.
+func indentation(line string) int {
+	width := 0
+	for _, r := range line {
+		switch r {
+		case ' ':
+			width++
+		case '\t':
+			width += 4
+		default:
+			return width
+		}
+	}
+	return width
+}
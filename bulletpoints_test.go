@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBulletTree(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected []*BulletNode
+	}{
+		{
+			name:  "flat list",
+			input: "- one\n* two\n1. three",
+			expected: []*BulletNode{
+				{Text: "one"},
+				{Text: "two"},
+				{Text: "three"},
+			},
+		},
+		{
+			name:  "nested list with continuation line",
+			input: "- one\n  - one.a\n    continued\n  - one.b\n- two",
+			expected: []*BulletNode{
+				{Text: "one", Children: []*BulletNode{
+					{Text: "one.a continued"},
+					{Text: "one.b"},
+				}},
+				{Text: "two"},
+			},
+		},
+		{
+			name:  "headings",
+			input: "# Talk\n## Intro\n- hello\n\n## Main\n- point\n\t- detail\n### Sub\n- sub point",
+			expected: []*BulletNode{
+				{Text: "Talk", Heading: true, Children: []*BulletNode{
+					{Text: "Intro", Heading: true, Children: []*BulletNode{
+						{Text: "hello"},
+					}},
+					{Text: "Main", Heading: true, Children: []*BulletNode{
+						{Text: "point", Children: []*BulletNode{
+							{Text: "detail"},
+						}},
+						{Text: "Sub", Heading: true, Children: []*BulletNode{
+							{Text: "sub point"},
+						}},
+					}},
+				}},
+			},
+		},
+		{
+			name:  "text before the list",
+			input: "Bulletpoints\n- one\n#hashtag",
+			expected: []*BulletNode{
+				{Text: "Bulletpoints"},
+				{Text: "one #hashtag"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, parseBulletTree(tc.input))
+		})
+	}
+}
+
+func testBulletpointsJSON(heading string) string {
+	return `{"sections": [{"heading": "` + heading + `", "bulletpoints": [{"text": "point", "details": []}]}]}`
+}
+
+func TestCreateBulletpoints(t *testing.T) {
+	isMerge := func(prompt string) bool {
+		return strings.HasPrefix(prompt, "The following bulletpoint lists")
+	}
+	client := &chatFuncClient{complete: func(prompt string) string {
+		if isMerge(prompt) {
+			return testBulletpointsJSON("Topic")
+		}
+		return testBulletpointsJSON("")
+	}}
+	text := "First part.\n\nSecond part."
+
+	result, err := createBulletpoints(context.Background(), client, text, 5, PromptSelection{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "- point\n- point", result.Markdown())
+	assert.Len(t, client.prompts, 2)
+
+	client.prompts = nil
+	result, err = createBulletpoints(context.Background(), client, text, 5, PromptSelection{}, true)
+	require.NoError(t, err)
+	assert.Equal(t, "## Topic\n- point", result.Markdown())
+	require.Len(t, client.prompts, 3)
+	assert.True(t, isMerge(client.prompts[2]))
+	assert.Contains(t, client.prompts[2], "- point\n\n- point")
+}
+
+func TestStructuredBulletpoints_Tree(t *testing.T) {
+	bulletpoints := &StructuredBulletpoints{
+		Sections: []BulletpointSection{
+			{Heading: "", Bulletpoints: []Bulletpoint{{Text: "- a point that looks like a list item"}}},
+			{Heading: "# Topic", Bulletpoints: []Bulletpoint{
+				{Text: "Point\nwith a line break", Details: []string{"Detail\n- not a bulletpoint"}},
+			}},
+		},
+	}
+
+	assert.Equal(t, []*BulletNode{
+		{Text: "- a point that looks like a list item"},
+		{Text: "# Topic", Heading: true, Children: []*BulletNode{
+			{Text: "Point\nwith a line break", Children: []*BulletNode{{Text: "Detail\n- not a bulletpoint"}}},
+		}},
+	}, bulletpoints.Tree())
+}
+
+func TestBulletpointsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	client := &chatFuncClient{complete: func(prompt string) string { return testBulletpointsJSON("Topic") }}
+	r := gin.New()
+	r.POST("/api/bulletpoints", bulletpointsHandler(client))
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/bulletpoints", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(`{"text": "Hello.", "consolidate": false}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Response     string        `json:"response"`
+		Bulletpoints []*BulletNode `json:"bulletpoints"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "## Topic\n- point", response.Response)
+	assert.Equal(t, []*BulletNode{
+		{Text: "Topic", Heading: true, Children: []*BulletNode{{Text: "point"}}},
+	}, response.Bulletpoints)
+
+	assert.Equal(t, http.StatusBadRequest, serve(`{"text": ""}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(`not json`).Code)
+}
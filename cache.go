@@ -0,0 +1,445 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	cacheDir = "cache"
+
+	defaultCacheTTL            = 7 * 24 * time.Hour
+	defaultCacheMaxEntries     = 1000
+	defaultMemoryCacheMaxBytes = 256 << 20
+	defaultDiskCacheMaxBytes   = 2 << 30
+	// cacheSweepInterval is how often the disk cache removes expired results while results are stored.
+	cacheSweepInterval = time.Hour
+
+	// Kinds of cached results.
+	cacheKindWhisper = "whisper"
+	cacheKindChat    = "chat"
+)
+
+// resultCache caches the results of Whisper and chat completions. It is set in main from CACHE; without
+// it nothing is cached.
+var resultCache *ResultCache
+
+// CacheStore stores cached results by key and drops them once they expire. Implementations must be safe
+// for concurrent use.
+type CacheStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+// ResultCache caches the results of OpenAI requests by a hash of everything that determines them: the
+// audio and the settings of a transcription, or the model, the messages and the settings of a chat
+// completion. Sending the same recording again or regenerating a result for the same text is answered
+// from the cache without calling and paying OpenAI.
+type ResultCache struct {
+	store CacheStore
+}
+
+type cacheModeKey struct{}
+
+// cacheMode controls how a request uses the cache.
+type cacheMode int
+
+const (
+	cacheModeDefault cacheMode = iota
+	// cacheModeRefresh ignores cached results, but caches the new results.
+	cacheModeRefresh
+	// cacheModeBypass neither reads nor writes the cache.
+	cacheModeBypass
+)
+
+// loadResultCache creates the cache configured by CACHE (memory, disk or off, default memory), CACHE_TTL
+// (a duration, default 168h), CACHE_MAX_ENTRIES (the number of results in the memory cache, default 1000)
+// and CACHE_MAX_MB (the size of the cache, default 256 in memory and 2048 on disk). The disk cache is
+// stored in the cache directory in the data directory.
+func loadResultCache(getenv func(string) string, dataDir string) (*ResultCache, error) {
+	ttl := defaultCacheTTL
+	if value := getenv("CACHE_TTL"); value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("CACHE_TTL must be a positive duration such as 24h: %q", value)
+		}
+	}
+	var maxBytes int64
+	if value := getenv("CACHE_MAX_MB"); value != "" {
+		megabytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || megabytes <= 0 {
+			return nil, fmt.Errorf("CACHE_MAX_MB must be a positive integer: %q", value)
+		}
+		maxBytes = megabytes << 20
+	}
+
+	switch kind := strings.ToLower(getenv("CACHE")); kind {
+	case "", "memory":
+		maxEntries := defaultCacheMaxEntries
+		if value := getenv("CACHE_MAX_ENTRIES"); value != "" {
+			var err error
+			maxEntries, err = strconv.Atoi(value)
+			if err != nil || maxEntries <= 0 {
+				return nil, fmt.Errorf("CACHE_MAX_ENTRIES must be a positive integer: %q", value)
+			}
+		}
+		if maxBytes == 0 {
+			maxBytes = defaultMemoryCacheMaxBytes
+		}
+		return &ResultCache{store: newMemoryCacheStore(maxEntries, maxBytes, ttl, time.Now)}, nil
+	case "disk":
+		if maxBytes == 0 {
+			maxBytes = defaultDiskCacheMaxBytes
+		}
+		store, err := openDiskCacheStore(filepath.Join(dataDir, cacheDir), maxBytes, ttl, time.Now)
+		if err != nil {
+			return nil, err
+		}
+		return &ResultCache{store: store}, nil
+	case "off":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("CACHE must be memory, disk or off: %q", kind)
+	}
+}
+
+// cacheControlMiddleware lets requests bypass the cache with a Cache-Control header: no-cache computes new
+// results and caches them, no-store neither reads nor writes the cache.
+func cacheControlMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mode := cacheModeDefault
+		for _, directive := range strings.Split(c.GetHeader("Cache-Control"), ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-cache":
+				mode = max(mode, cacheModeRefresh)
+			case "no-store":
+				mode = cacheModeBypass
+			}
+		}
+		if mode != cacheModeDefault {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), cacheModeKey{}, mode))
+		}
+		c.Next()
+	}
+}
+
+// cached returns the result cached under the key of the kind or, if there is none, computes the result and
+// caches it. Failed computations are not cached. If the key cannot be computed, the result is not cached.
+func cached[T any](ctx context.Context, kind string, key func() (string, error), compute func() (T, error)) (T, error) {
+	mode, _ := ctx.Value(cacheModeKey{}).(cacheMode)
+	if resultCache == nil || mode == cacheModeBypass {
+		return compute()
+	}
+	cacheKey, err := key()
+	if err != nil {
+		logEvent(ctx, slog.LevelWarn, "cache_key_failed", gin.H{
+			"kind":  kind,
+			"error": err.Error(),
+		})
+		return compute()
+	}
+	cacheKey = kind + "-" + cacheKey
+
+	if mode != cacheModeRefresh {
+		if content, ok := resultCache.store.Get(cacheKey); ok {
+			var result T
+			if json.Unmarshal(content, &result) == nil {
+				cacheRequests.WithLabelValues(kind, "hit").Inc()
+				logEvent(ctx, slog.LevelDebug, "cache_hit", gin.H{"kind": kind})
+				return result, nil
+			}
+		}
+	}
+	cacheRequests.WithLabelValues(kind, "miss").Inc()
+
+	result, err := compute()
+	if err != nil {
+		return result, err
+	}
+	if content, err := json.Marshal(result); err == nil {
+		resultCache.store.Set(cacheKey, content)
+	}
+	return result, nil
+}
+
+// chatCacheKey hashes the chat completion request, which includes the model, the messages, the token
+// limit and the response format.
+func chatCacheKey(request openai.ChatCompletionRequest) func() (string, error) {
+	return func() (string, error) {
+		content, err := json.Marshal(request)
+		if err != nil {
+			return "", err
+		}
+		hash := sha256.Sum256(content)
+		return hex.EncodeToString(hash[:]), nil
+	}
+}
+
+// whisperCacheKey hashes the audio of the transcription request and its settings, e.g. the model and the
+// language.
+func whisperCacheKey(request openai.AudioRequest) func() (string, error) {
+	return func() (string, error) {
+		file, err := os.Open(request.FilePath)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+
+		request.FilePath = ""
+		settings, err := json.Marshal(request)
+		if err != nil {
+			return "", err
+		}
+		hash := sha256.New()
+		hash.Write(settings)
+		if _, err := io.Copy(hash, file); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+}
+
+// memoryCacheStore keeps the most recently used results in memory, at most maxEntries results of at most
+// maxBytes together.
+type memoryCacheStore struct {
+	maxEntries int
+	maxBytes   int64
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent orders the entries from the most to the least recently used.
+	recent *list.List
+	size   int64
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (e *memoryCacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+func newMemoryCacheStore(maxEntries int, maxBytes int64, ttl time.Duration, now func() time.Time) *memoryCacheStore {
+	return &memoryCacheStore{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		now:        now,
+		entries:    map[string]*list.Element{},
+		recent:     list.New(),
+	}
+}
+
+func (s *memoryCacheStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if !s.now().Before(entry.expires) {
+		s.remove(element)
+		return nil, false
+	}
+	s.recent.MoveToFront(element)
+	return entry.value, true
+}
+
+func (s *memoryCacheStore) Set(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[key]; ok {
+		s.remove(element)
+	}
+	entry := &memoryCacheEntry{key: key, value: value, expires: s.now().Add(s.ttl)}
+	s.entries[key] = s.recent.PushFront(entry)
+	s.size += entry.size()
+	for s.recent.Len() > s.maxEntries || s.size > s.maxBytes {
+		s.remove(s.recent.Back())
+	}
+}
+
+// remove drops the entry. The caller must hold s.mu.
+func (s *memoryCacheStore) remove(element *list.Element) {
+	entry := s.recent.Remove(element).(*memoryCacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= entry.size()
+}
+
+// diskCacheStore keeps results in files in a directory, so they survive restarts. Results expire ttl after
+// they were stored. The files take at most maxBytes; the least recently used results are removed first.
+// The store keeps an index of the files, so it does not read the directory on every request.
+type diskCacheStore struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent orders the entries from the most to the least recently used.
+	recent  *list.List
+	size    int64
+	sweptAt time.Time
+}
+
+type diskCacheEntry struct {
+	key    string
+	size   int64
+	stored time.Time
+}
+
+// openDiskCacheStore creates the directory, removes expired results and left over temp files and indexes
+// the remaining results. Results are ordered by the time they were stored, as the time they were last
+// used is not kept.
+func openDiskCacheStore(dir string, maxBytes int64, ttl time.Duration, now func() time.Time) (*diskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	store := &diskCacheStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		now:      now,
+		entries:  map[string]*list.Element{},
+		recent:   list.New(),
+		sweptAt:  now(),
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*diskCacheEntry
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasSuffix(file.Name(), ".tmp") || !store.fresh(info.ModTime()) {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		entries = append(entries, &diskCacheEntry{key: file.Name(), size: info.Size(), stored: info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].stored.After(entries[j].stored) })
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, entry := range entries {
+		store.entries[entry.key] = store.recent.PushBack(entry)
+		store.size += entry.size
+	}
+	store.evict()
+	return store, nil
+}
+
+func (s *diskCacheStore) fresh(stored time.Time) bool {
+	return s.now().Sub(stored) < s.ttl
+}
+
+func (s *diskCacheStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	element, ok := s.entries[key]
+	if ok && !s.fresh(element.Value.(*diskCacheEntry).stored) {
+		s.remove(element)
+		ok = false
+	}
+	if ok {
+		s.recent.MoveToFront(element)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	value, err := os.ReadFile(filepath.Join(s.dir, key))
+	return value, err == nil
+}
+
+func (s *diskCacheStore) Set(key string, value []byte) {
+	path := filepath.Join(s.dir, key)
+	// Writes of the same key by concurrent requests use temp files of their own.
+	file, err := os.CreateTemp(s.dir, key+".*.tmp")
+	if err != nil {
+		logEvent(context.Background(), slog.LevelWarn, "cache_write_failed", gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	_, err = file.Write(value)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		logEvent(context.Background(), slog.LevelWarn, "cache_write_failed", gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		logEvent(context.Background(), slog.LevelWarn, "cache_write_failed", gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if element, ok := s.entries[key]; ok {
+		s.size -= element.Value.(*diskCacheEntry).size
+		s.recent.Remove(element)
+	}
+	entry := &diskCacheEntry{key: key, size: int64(len(value)), stored: s.now()}
+	s.entries[key] = s.recent.PushFront(entry)
+	s.size += entry.size
+	s.evict()
+}
+
+// evict removes expired results, at most once per cacheSweepInterval, and the least recently used results
+// while the cache is larger than maxBytes. The caller must hold s.mu.
+func (s *diskCacheStore) evict() {
+	if now := s.now(); now.Sub(s.sweptAt) >= cacheSweepInterval {
+		s.sweptAt = now
+		for element := s.recent.Front(); element != nil; {
+			next := element.Next()
+			if !s.fresh(element.Value.(*diskCacheEntry).stored) {
+				s.remove(element)
+			}
+			element = next
+		}
+	}
+	for s.size > s.maxBytes {
+		s.remove(s.recent.Back())
+	}
+}
+
+// remove deletes the result. The caller must hold s.mu.
+func (s *diskCacheStore) remove(element *list.Element) {
+	entry := s.recent.Remove(element).(*diskCacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= entry.size
+	os.Remove(filepath.Join(s.dir, entry.key))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useResultCache replaces the result cache with a memory cache for the duration of the test.
+func useResultCache(t *testing.T) {
+	previous := resultCache
+	resultCache = &ResultCache{store: newMemoryCacheStore(defaultCacheMaxEntries, defaultMemoryCacheMaxBytes, defaultCacheTTL, time.Now)}
+	t.Cleanup(func() { resultCache = previous })
+}
+
+// countingTranscriber counts transcriptions.
+type countingTranscriber struct {
+	mockOpenAIClient
+	transcriptions int
+}
+
+func (m *countingTranscriber) CreateTranscription(ctx context.Context, request openai.AudioRequest) (openai.AudioResponse, error) {
+	m.transcriptions++
+	return openai.AudioResponse{Text: "transcription of " + filepath.Base(request.FilePath)}, nil
+}
+
+func TestLoadResultCache(t *testing.T) {
+	env := func(values map[string]string) func(string) string {
+		return func(key string) string { return values[key] }
+	}
+	dataDir := t.TempDir()
+
+	cache, err := loadResultCache(env(nil), dataDir)
+	require.NoError(t, err)
+	assert.IsType(t, &memoryCacheStore{}, cache.store)
+
+	cache, err = loadResultCache(env(map[string]string{"CACHE": "disk", "CACHE_TTL": "1h", "CACHE_MAX_MB": "10"}), dataDir)
+	require.NoError(t, err)
+	require.IsType(t, &diskCacheStore{}, cache.store)
+	assert.Equal(t, int64(10<<20), cache.store.(*diskCacheStore).maxBytes)
+	assert.DirExists(t, filepath.Join(dataDir, cacheDir))
+
+	cache, err = loadResultCache(env(map[string]string{"CACHE": "off"}), dataDir)
+	require.NoError(t, err)
+	assert.Nil(t, cache)
+
+	for _, values := range []map[string]string{
+		{"CACHE": "redis"},
+		{"CACHE_TTL": "24"},
+		{"CACHE_TTL": "-1h"},
+		{"CACHE_MAX_ENTRIES": "0"},
+		{"CACHE_MAX_MB": "0"},
+		{"CACHE": "disk", "CACHE_MAX_MB": "1.5"},
+	} {
+		_, err := loadResultCache(env(values), dataDir)
+		assert.Error(t, err, values)
+	}
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryCacheStore(2, 100, time.Hour, func() time.Time { return now })
+
+	store.Set("a", []byte("1"))
+	store.Set("b", []byte("2"))
+	_, ok := store.Get("a")
+	require.True(t, ok)
+	// b is the least recently used entry.
+	store.Set("c", []byte("3"))
+	_, ok = store.Get("b")
+	assert.False(t, ok)
+	value, ok := store.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, "1", string(value))
+
+	now = now.Add(time.Hour)
+	_, ok = store.Get("c")
+	assert.False(t, ok, "entries expire after the TTL")
+
+	// large results push out the least recently used ones to stay within the size limit
+	store.Set("d", make([]byte, 60))
+	store.Set("e", make([]byte, 30))
+	store.Set("f", make([]byte, 30))
+	_, ok = store.Get("d")
+	assert.False(t, ok)
+	_, ok = store.Get("f")
+	assert.True(t, ok)
+	assert.LessOrEqual(t, store.size, int64(100))
+}
+
+func TestDiskCacheStore(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	clock := func() time.Time { return now }
+	store, err := openDiskCacheStore(dir, 100, time.Hour, clock)
+	require.NoError(t, err)
+
+	store.Set("a", []byte("1"))
+	value, ok := store.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, "1", string(value))
+	_, ok = store.Get("b")
+	assert.False(t, ok)
+
+	// Expired results are removed when the cache is opened again, e.g. after a restart.
+	now = now.Add(2 * time.Hour)
+	store, err = openDiskCacheStore(dir, 100, time.Hour, clock)
+	require.NoError(t, err)
+	_, ok = store.Get("a")
+	assert.False(t, ok)
+	assert.NoFileExists(t, filepath.Join(dir, "a"))
+
+	// The least recently used results are removed to stay within the size limit.
+	store.Set("b", make([]byte, 40))
+	store.Set("c", make([]byte, 40))
+	_, ok = store.Get("b")
+	require.True(t, ok)
+	store.Set("d", make([]byte, 40))
+	assert.NoFileExists(t, filepath.Join(dir, "c"))
+	assert.FileExists(t, filepath.Join(dir, "b"))
+	assert.Equal(t, int64(80), store.size)
+
+	// Expired results are swept while the server runs, even if they are never read again.
+	now = now.Add(cacheSweepInterval + time.Hour)
+	store.Set("e", []byte("1"))
+	assert.NoFileExists(t, filepath.Join(dir, "b"))
+	assert.NoFileExists(t, filepath.Join(dir, "d"))
+	assert.Equal(t, int64(1), store.size)
+
+	// The size limit also applies to the results found when the cache is opened.
+	store, err = openDiskCacheStore(dir, 0, 24*time.Hour, clock)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "e"))
+}
+
+func TestCached(t *testing.T) {
+	useResultCache(t)
+	calls := 0
+	compute := func() (string, error) {
+		calls++
+		return "result", nil
+	}
+	key := func() (string, error) { return "key", nil }
+
+	hitsBefore := testutil.ToFloat64(cacheRequests.WithLabelValues("test", "hit"))
+	for i := 0; i < 2; i++ {
+		result, err := cached(context.Background(), "test", key, compute)
+		require.NoError(t, err)
+		assert.Equal(t, "result", result)
+	}
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, hitsBefore+1, testutil.ToFloat64(cacheRequests.WithLabelValues("test", "hit")))
+
+	// Failed computations and keys are not cached.
+	_, err := cached(context.Background(), "test", func() (string, error) { return "failing", nil }, func() (string, error) {
+		return "", errors.New("failed")
+	})
+	require.Error(t, err)
+	_, ok := resultCache.store.Get("test-failing")
+	assert.False(t, ok)
+	result, err := cached(context.Background(), "test", func() (string, error) { return "", errors.New("no key") }, compute)
+	require.NoError(t, err)
+	assert.Equal(t, "result", result)
+	assert.Equal(t, 2, calls)
+}
+
+func TestCacheControlMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useResultCache(t)
+	calls := 0
+	r := gin.New()
+	r.Use(cacheControlMiddleware())
+	r.GET("/result", func(c *gin.Context) {
+		result, _ := cached(c.Request.Context(), "test", func() (string, error) { return "key", nil }, func() (int, error) {
+			calls++
+			return calls, nil
+		})
+		c.JSON(http.StatusOK, result)
+	})
+	get := func(cacheControl string) string {
+		req := httptest.NewRequest(http.MethodGet, "/result", nil)
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	assert.Equal(t, "1", get(""))
+	assert.Equal(t, "1", get(""))
+	// no-store neither reads nor writes the cache.
+	assert.Equal(t, "2", get("no-store"))
+	assert.Equal(t, "1", get(""))
+	// no-cache computes a new result and caches it.
+	assert.Equal(t, "3", get("max-age=0, no-cache"))
+	assert.Equal(t, "3", get(""))
+}
+
+func TestCache_Whisper(t *testing.T) {
+	useResultCache(t)
+	dir := t.TempDir()
+	chunks := []string{filepath.Join(dir, "chunk-0-1.mp3"), filepath.Join(dir, "chunk-1-2.mp3")}
+	require.NoError(t, os.WriteFile(chunks[0], []byte("first"), 0o600))
+	require.NoError(t, os.WriteFile(chunks[1], []byte("second"), 0o600))
+	client := &countingTranscriber{}
+
+	_, err := transcribeChunks(context.Background(), client, chunks, "de", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, client.transcriptions)
+
+	// The same audio is answered from the cache, whatever the name of its file.
+	again := filepath.Join(dir, "again.mp3")
+	require.NoError(t, os.WriteFile(again, []byte("first"), 0o600))
+	transcriptions, err := transcribeChunks(context.Background(), client, []string{again}, "de", nil)
+	require.NoError(t, err)
+	require.Len(t, transcriptions, 1)
+	assert.Equal(t, "transcription of chunk-0-1.mp3", transcriptions[0].Text)
+	assert.Equal(t, 2, client.transcriptions)
+
+	// Other settings are transcribed again.
+	_, err = transcribeChunks(context.Background(), client, []string{again}, "en", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, client.transcriptions)
+}
+
+func TestCache_ChatCompletion(t *testing.T) {
+	useResultCache(t)
+	client := &chatFuncClient{complete: strings.ToUpper}
+
+	for i := 0; i < 2; i++ {
+		answer, err := createCompletion(context.Background(), client, "summary", "prompt", 100)
+		require.NoError(t, err)
+		assert.Equal(t, "PROMPT", answer)
+	}
+	_, err := createCompletion(context.Background(), client, "summary", "prompt", 200)
+	require.NoError(t, err)
+	assert.Len(t, client.prompts, 2, "a different token limit is another request")
+}
+
+func TestCache_StreamCompletion(t *testing.T) {
+	useResultCache(t)
+	client := &chatFuncClient{complete: func(prompt string) string { return "a streamed answer" }}
+
+	var deltas []string
+	require.NoError(t, streamCompletion(context.Background(), client, "summary", "prompt", 100, func(delta string) {
+		deltas = append(deltas, delta)
+	}))
+	assert.Greater(t, len(deltas), 1)
+
+	// A cached answer is emitted at once.
+	deltas = nil
+	require.NoError(t, streamCompletion(context.Background(), client, "summary", "prompt", 100, func(delta string) {
+		deltas = append(deltas, delta)
+	}))
+	assert.Equal(t, []string{"a streamed answer"}, deltas)
+	assert.Len(t, client.prompts, 1)
+}
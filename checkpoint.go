@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	checkpointsDir           = "checkpoints"
+	checkpointFile           = "checkpoint.json"
+	checkpointChunksDir      = "chunks"
+	checkpointTranscriptsDir = "transcripts"
+	checkpointCorrectionsDir = "corrections"
+
+	// checkpointTTL is how long the progress of a failed transcription is kept for a retry.
+	checkpointTTL = 24 * time.Hour
+)
+
+// checkpoints keeps the progress of transcriptions. It is set in main; without it nothing is checkpointed.
+var checkpoints *CheckpointStore
+
+// CheckpointStore keeps the progress of transcriptions on disk, so a transcription interrupted by a crash,
+// a shutdown or a failed request resumes from its last completed step when the same recording is sent
+// again, and chunks that were already transcribed are not transcribed and billed again. Checkpoints do not
+// keep the recording and the request: they are sent again by the client, or by the resumed webhook job.
+type CheckpointStore struct {
+	dir string
+
+	mu sync.Mutex
+	// locks serializes the transcriptions of every checkpoint. Locks are removed once nobody holds or
+	// waits for them.
+	locks map[string]*checkpointLock
+}
+
+// checkpointLock is the lock of a checkpoint with the number of its holders and waiters.
+type checkpointLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Checkpoint is the progress of a single transcription: the split plan, the transcripts of the chunks and
+// the corrected parts. All methods do nothing on a nil checkpoint.
+type Checkpoint struct {
+	dir    string
+	unlock func()
+
+	mu    sync.Mutex
+	state checkpointState
+}
+
+// checkpointState is the part of a checkpoint stored in checkpoint.json.
+type checkpointState struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Split is set once the recording was split. Chunks are the names of the chunk files in the chunks
+	// directory; no chunks mean the recording is transcribed as a whole.
+	Split  bool     `json:"split"`
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// openCheckpointStore creates the checkpoints directory in the data directory and removes expired
+// checkpoints.
+func openCheckpointStore(dataDir string) (*CheckpointStore, error) {
+	store := &CheckpointStore{dir: filepath.Join(dataDir, checkpointsDir), locks: map[string]*checkpointLock{}}
+	if err := os.MkdirAll(store.dir, 0o700); err != nil {
+		return nil, err
+	}
+	if _, err := store.RemoveExpired(time.Now()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// lock locks the checkpoint and returns the function unlocking it. The last unlock removes the lock from
+// the store, so the store does not keep a lock for every checkpoint it ever had.
+func (s *CheckpointStore) lock(id string) func() {
+	s.mu.Lock()
+	lock, ok := s.locks[id]
+	if !ok {
+		lock = &checkpointLock{}
+		s.locks[id] = lock
+	}
+	lock.refs++
+	s.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(s.locks, id)
+		}
+	}
+}
+
+// checkpointID identifies the transcription of the recording by the user with the settings, so sending the
+// same recording again resumes its transcription.
+func checkpointID(user, recordingPath string, settings ...string) (string, error) {
+	file, err := os.Open(recordingPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	for _, value := range append([]string{user}, settings...) {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Open returns the checkpoint of the transcription of the recording, creating it if it does not exist.
+// The checkpoint is locked until it is closed. Expired checkpoints are removed first, so the chunks of
+// failed transcriptions do not pile up while the server runs. A nil store returns a nil checkpoint.
+func (s *CheckpointStore) Open(user, recordingPath string, settings ...string) (*Checkpoint, error) {
+	if s == nil {
+		return nil, nil
+	}
+	if _, err := s.RemoveExpired(time.Now()); err != nil {
+		logEvent(context.Background(), slog.LevelWarn, "checkpoint_cleanup_failed", gin.H{
+			"error": err.Error(),
+		})
+	}
+	id, err := checkpointID(user, recordingPath, settings...)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := s.lock(id)
+	checkpoint := &Checkpoint{dir: filepath.Join(s.dir, id), unlock: unlock}
+	content, err := os.ReadFile(filepath.Join(checkpoint.dir, checkpointFile))
+	if err == nil {
+		err = json.Unmarshal(content, &checkpoint.state)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		checkpoint.state = checkpointState{ID: id, CreatedAt: time.Now().UTC()}
+		if err = os.MkdirAll(checkpoint.dir, 0o700); err == nil {
+			err = checkpoint.writeState()
+		}
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// RemoveExpired removes the checkpoints that were not modified for checkpointTTL and returns their
+// number.
+func (s *CheckpointStore) RemoveExpired(now time.Time) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		info, err := os.Stat(filepath.Join(s.dir, entry.Name(), checkpointFile))
+		if err != nil {
+			if info, err = entry.Info(); err != nil {
+				continue
+			}
+		}
+		if now.Sub(info.ModTime()) < checkpointTTL {
+			continue
+		}
+		unlock := s.lock(entry.Name())
+		err = os.RemoveAll(filepath.Join(s.dir, entry.Name()))
+		unlock()
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Count returns the number of stored checkpoints, i.e. of unfinished transcriptions.
+func (s *CheckpointStore) Count() int {
+	entries, _ := os.ReadDir(s.dir)
+	return len(entries)
+}
+
+// ID returns the ID of the checkpoint.
+func (c *Checkpoint) ID() string {
+	if c == nil {
+		return ""
+	}
+	return c.state.ID
+}
+
+// ChunkDir returns the directory to split the recording into. Chunks of a checkpoint are kept with it,
+// otherwise they are written to dir.
+func (c *Checkpoint) ChunkDir(dir string) (string, error) {
+	if c == nil {
+		return dir, nil
+	}
+	chunkDir := filepath.Join(c.dir, checkpointChunksDir)
+	return chunkDir, os.MkdirAll(chunkDir, 0o700)
+}
+
+// Chunks returns the chunks of a recording that was already split, the recording itself if it was not
+// split into chunks, and false if it was not split yet.
+func (c *Checkpoint) Chunks(recordingPath string) ([]string, bool) {
+	if c == nil || !c.state.Split {
+		return nil, false
+	}
+	if len(c.state.Chunks) == 0 {
+		return []string{recordingPath}, true
+	}
+	chunks := make([]string, len(c.state.Chunks))
+	for i, name := range c.state.Chunks {
+		chunks[i] = filepath.Join(c.dir, checkpointChunksDir, name)
+		if _, err := os.Stat(chunks[i]); err != nil {
+			return nil, false
+		}
+	}
+	return chunks, true
+}
+
+// SaveChunks stores the split plan, the chunks the recording was split into.
+func (c *Checkpoint) SaveChunks(recordingPath string, chunks []string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Split = true
+	c.state.Chunks = nil
+	if len(chunks) != 1 || chunks[0] != recordingPath {
+		for _, chunk := range chunks {
+			c.state.Chunks = append(c.state.Chunks, filepath.Base(chunk))
+		}
+	}
+	return c.writeState()
+}
+
+// Transcriber returns transcribe with the transcripts of the chunks checkpointed: chunks transcribed
+// before are returned from the checkpoint, new transcripts are stored as soon as they arrive.
+func (c *Checkpoint) Transcriber(transcribe chunkTranscriber) chunkTranscriber {
+	if c == nil {
+		return transcribe
+	}
+	return func(ctx context.Context, chunkPath string) (openai.AudioResponse, error) {
+		// Recordings that are not split are stored in the temp directory of the request, with another name
+		// every time they are sent.
+		name := filepath.Base(chunkPath)
+		if filepath.Dir(chunkPath) != filepath.Join(c.dir, checkpointChunksDir) {
+			name = "recording"
+		}
+		path := filepath.Join(c.dir, checkpointTranscriptsDir, name+".json")
+		var transcription openai.AudioResponse
+		if content, err := os.ReadFile(path); err == nil && json.Unmarshal(content, &transcription) == nil {
+			logEvent(ctx, slog.LevelDebug, "chunk_resumed", gin.H{"chunk_path": chunkPath})
+			return transcription, nil
+		}
+
+		transcription, err := transcribe(ctx, chunkPath)
+		if err != nil {
+			return transcription, err
+		}
+		c.save(ctx, path, transcription)
+		return transcription, nil
+	}
+}
+
+// Corrector returns correct with the corrected parts checkpointed by the hash of their prompt.
+func (c *Checkpoint) Corrector(correct func(ctx context.Context, prompt string) (string, error)) func(ctx context.Context, prompt string) (string, error) {
+	if c == nil {
+		return correct
+	}
+	return func(ctx context.Context, prompt string) (string, error) {
+		hash := sha256.Sum256([]byte(prompt))
+		path := filepath.Join(c.dir, checkpointCorrectionsDir, hex.EncodeToString(hash[:])+".json")
+		var corrected string
+		if content, err := os.ReadFile(path); err == nil && json.Unmarshal(content, &corrected) == nil {
+			logEvent(ctx, slog.LevelDebug, "correction_resumed", gin.H{})
+			return corrected, nil
+		}
+
+		corrected, err := correct(ctx, prompt)
+		if err != nil {
+			return corrected, err
+		}
+		c.save(ctx, path, corrected)
+		return corrected, nil
+	}
+}
+
+// save stores the result of a step. A result that cannot be stored is only logged, the transcription goes
+// on without it.
+func (c *Checkpoint) save(ctx context.Context, path string, result any) {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err == nil {
+		err = writeJSONFile(path, result)
+	}
+	if err != nil {
+		logEvent(ctx, slog.LevelWarn, "checkpoint_failed", gin.H{
+			"checkpoint_id": c.state.ID,
+			"error":         err.Error(),
+		})
+	}
+}
+
+// Close unlocks the checkpoint. If the transcription completed, the checkpoint is removed, otherwise it
+// is kept for a retry.
+func (c *Checkpoint) Close(completed bool) error {
+	if c == nil {
+		return nil
+	}
+	defer c.unlock()
+	if completed {
+		return os.RemoveAll(c.dir)
+	}
+	// Touch the checkpoint, so it expires checkpointTTL after the last attempt.
+	now := time.Now()
+	return os.Chtimes(filepath.Join(c.dir, checkpointFile), now, now)
+}
+
+func (c *Checkpoint) writeState() error {
+	return writeJSONFile(filepath.Join(c.dir, checkpointFile), c.state)
+}
+
+// writeJSONFile writes the value as JSON to a temp file that is renamed to path, so a crash never leaves a
+// partially written file behind.
+func writeJSONFile(path string, value any) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
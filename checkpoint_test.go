@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// interruptedClient counts transcriptions and fails chat completions with a quota error while failing is
+// set, like a transcription that is interrupted after its chunks were transcribed.
+type interruptedClient struct {
+	mockOpenAIClient
+
+	mu             sync.Mutex
+	transcriptions int
+	failing        bool
+}
+
+func (m *interruptedClient) CreateTranscription(ctx context.Context, request openai.AudioRequest) (openai.AudioResponse, error) {
+	m.mu.Lock()
+	m.transcriptions++
+	m.mu.Unlock()
+	return m.mockOpenAIClient.CreateTranscription(ctx, request)
+}
+
+func (m *interruptedClient) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	m.mu.Lock()
+	failing := m.failing
+	m.mu.Unlock()
+	if failing {
+		return openai.ChatCompletionResponse{}, &QuotaError{Period: "day", Resource: "tokens", ResetAt: time.Now().Add(time.Hour)}
+	}
+	return m.mockOpenAIClient.CreateChatCompletion(ctx, request)
+}
+
+// writeRecording writes the content to a new file in dir and returns its path.
+func writeRecording(t *testing.T, dir, content string) string {
+	file, err := os.CreateTemp(dir, "recording-*.mp3")
+	require.NoError(t, err)
+	_, err = file.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	return file.Name()
+}
+
+func TestCheckpoint_ResumesChunks(t *testing.T) {
+	store, err := openCheckpointStore(t.TempDir())
+	require.NoError(t, err)
+	recording := writeRecording(t, t.TempDir(), "recording")
+
+	checkpoint, err := store.Open("alice", recording, "v1", "de")
+	require.NoError(t, err)
+	_, split := checkpoint.Chunks(recording)
+	assert.False(t, split)
+	chunkDir, err := checkpoint.ChunkDir(t.TempDir())
+	require.NoError(t, err)
+	chunks := []string{filepath.Join(chunkDir, "chunk-0-1.mp3"), filepath.Join(chunkDir, "chunk-1-2.mp3")}
+	for _, chunk := range chunks {
+		require.NoError(t, os.WriteFile(chunk, []byte("chunk"), 0o600))
+	}
+	require.NoError(t, checkpoint.SaveChunks(recording, chunks))
+
+	var transcribed []string
+	transcribe := func(ctx context.Context, chunkPath string) (openai.AudioResponse, error) {
+		transcribed = append(transcribed, filepath.Base(chunkPath))
+		if strings.Contains(chunkPath, "chunk-1-2") {
+			return openai.AudioResponse{}, errors.New("timeout")
+		}
+		return openai.AudioResponse{Text: "first chunk", Duration: 60}, nil
+	}
+	_, err = checkpoint.Transcriber(transcribe)(context.Background(), chunks[0])
+	require.NoError(t, err)
+	_, err = checkpoint.Transcriber(transcribe)(context.Background(), chunks[1])
+	require.Error(t, err)
+	require.NoError(t, checkpoint.Close(false))
+
+	// The same recording sent again, e.g. after a restart, resumes with the second chunk.
+	again := writeRecording(t, t.TempDir(), "recording")
+	checkpoint, err = store.Open("alice", again, "v1", "de")
+	require.NoError(t, err)
+	resumed, split := checkpoint.Chunks(again)
+	require.True(t, split)
+	assert.Equal(t, chunks, resumed)
+
+	transcribed = nil
+	transcribe = func(ctx context.Context, chunkPath string) (openai.AudioResponse, error) {
+		transcribed = append(transcribed, filepath.Base(chunkPath))
+		return openai.AudioResponse{Text: "second chunk"}, nil
+	}
+	first, err := checkpoint.Transcriber(transcribe)(context.Background(), resumed[0])
+	require.NoError(t, err)
+	assert.Equal(t, openai.AudioResponse{Text: "first chunk", Duration: 60}, first)
+	_, err = checkpoint.Transcriber(transcribe)(context.Background(), resumed[1])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunk-1-2.mp3"}, transcribed)
+
+	require.NoError(t, checkpoint.Close(true))
+	assert.Equal(t, 0, store.Count())
+}
+
+func TestCheckpoint_ResumesCorrections(t *testing.T) {
+	store, err := openCheckpointStore(t.TempDir())
+	require.NoError(t, err)
+	recording := writeRecording(t, t.TempDir(), "recording")
+
+	calls := 0
+	correct := func(ctx context.Context, prompt string) (string, error) {
+		calls++
+		return strings.ToUpper(prompt), nil
+	}
+	for i := 0; i < 2; i++ {
+		checkpoint, err := store.Open("alice", recording)
+		require.NoError(t, err)
+		corrected, err := checkpoint.Corrector(correct)(context.Background(), "part one")
+		require.NoError(t, err)
+		assert.Equal(t, "PART ONE", corrected)
+		require.NoError(t, checkpoint.Close(false))
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestCheckpointStore_SeparatesUsersAndSettings(t *testing.T) {
+	store, err := openCheckpointStore(t.TempDir())
+	require.NoError(t, err)
+	recording := writeRecording(t, t.TempDir(), "recording")
+
+	ids := map[string]bool{}
+	for _, open := range []func() (*Checkpoint, error){
+		func() (*Checkpoint, error) { return store.Open("alice", recording, "v1", "") },
+		func() (*Checkpoint, error) { return store.Open("bob", recording, "v1", "") },
+		func() (*Checkpoint, error) { return store.Open("alice", recording, "v2", "") },
+		func() (*Checkpoint, error) { return store.Open("alice", recording, "v1", "de") },
+	} {
+		checkpoint, err := open()
+		require.NoError(t, err)
+		ids[checkpoint.ID()] = true
+		require.NoError(t, checkpoint.Close(false))
+	}
+	assert.Len(t, ids, 4)
+	assert.Empty(t, store.locks, "closed checkpoints release their locks")
+
+	var checkpoint *Checkpoint
+	assert.NoError(t, checkpoint.Close(true), "a nil checkpoint does nothing")
+}
+
+func TestCheckpointStore_RemoveExpired(t *testing.T) {
+	store, err := openCheckpointStore(t.TempDir())
+	require.NoError(t, err)
+	checkpoint, err := store.Open("alice", writeRecording(t, t.TempDir(), "recording"))
+	require.NoError(t, err)
+	require.NoError(t, checkpoint.Close(false))
+
+	removed, err := store.RemoveExpired(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	removed, err = store.RemoveExpired(time.Now().Add(checkpointTTL))
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 0, store.Count())
+	assert.Empty(t, store.locks)
+
+	// opening a checkpoint removes the expired ones, also while the server keeps running
+	checkpoint, err = store.Open("alice", writeRecording(t, t.TempDir(), "failed"))
+	require.NoError(t, err)
+	require.NoError(t, checkpoint.Close(false))
+	expired := time.Now().Add(-checkpointTTL - time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(store.dir, checkpoint.ID(), checkpointFile), expired, expired))
+	checkpoint, err = store.Open("alice", writeRecording(t, t.TempDir(), "another"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, store.Count())
+	require.NoError(t, checkpoint.Close(true))
+}
+
+func TestTranscribeRecording_ResumesFromCheckpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previousTempRoot := tempRoot
+	tempRoot = t.TempDir()
+	defer func() { tempRoot = previousTempRoot }()
+	previousCheckpoints := checkpoints
+	checkpoints, _ = openCheckpointStore(t.TempDir())
+	defer func() { checkpoints = previousCheckpoints }()
+	fakeMediaProbe(t, shortMP3, nil)
+
+	uploads, err := openUploadStore(t.TempDir())
+	require.NoError(t, err)
+	client := &interruptedClient{failing: true}
+	r := gin.New()
+	r.POST("/api/uploads", createUploadHandler(uploads))
+	r.PATCH("/api/uploads/:id", appendUploadHandler(uploads))
+	r.POST("/api/uploads/:id/complete", completeUploadHandler(client, uploads))
+	serve := func(method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	mp3, err := os.ReadFile("test/fixtures/short.mp3")
+	require.NoError(t, err)
+	w := serve("POST", "/api/uploads", []byte(`{"size": `+strconv.Itoa(len(mp3))+`}`), nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+	require.Equal(t, http.StatusOK, serve("PATCH", location, mp3, map[string]string{headerUploadOffset: "0"}).Code)
+
+	// The correction fails after the recording was transcribed.
+	w = serve("POST", location+"/complete", []byte(`{"language": "en"}`), nil)
+	require.Equal(t, http.StatusTooManyRequests, w.Code, w.Body.String())
+	assert.Equal(t, 1, checkpoints.Count())
+
+	client.failing = false
+	w = serve("POST", location+"/complete", []byte(`{"language": "en"}`), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Transcription string `json:"transcription"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "mock corrected transcription", strings.TrimSpace(response.Transcription))
+	assert.Equal(t, 1, client.transcriptions, "the recording is not transcribed again")
+	assert.Equal(t, 0, checkpoints.Count(), "the checkpoint is removed once the transcription completed")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// providerProbeInterval is how long the result of a probe of the OpenAI API is reused, so frequent
+	// readiness checks do not send a request to OpenAI each.
+	providerProbeInterval = time.Minute
+	providerProbeTimeout  = 5 * time.Second
+)
+
+// version is the version of the build, set with -ldflags "-X main.version=...".
+var version = "dev"
+
+// healthCheck checks a dependency the server needs to handle requests.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readinessChecks returns the checks of /readyz: ffmpeg and ffprobe are installed, the temp and data
+// directories are writable and, if a server key is configured, the OpenAI API can be reached with it.
+func readinessChecks(dataDir string, probeProvider func(ctx context.Context) error) []healthCheck {
+	checks := []healthCheck{
+		{"ffmpeg", binaryCheck("ffmpeg")},
+		{"ffprobe", binaryCheck("ffprobe")},
+		{"storage", storageCheck(dataDir)},
+	}
+	if probeProvider != nil {
+		probe := &cachedProbe{probe: probeProvider, interval: providerProbeInterval, now: time.Now}
+		checks = append(checks, healthCheck{"openai", probe.check})
+	}
+	return checks
+}
+
+// binaryCheck checks that the executable is in the PATH.
+func binaryCheck(name string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := exec.LookPath(name)
+		return err
+	}
+}
+
+// storageCheck checks that the temp directory of requests and the data directory are writable.
+func storageCheck(dataDir string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		dir, err := newRequestTempDir()
+		if err != nil {
+			return err
+		}
+		removeRequestTempDir(dir)
+
+		file, err := os.CreateTemp(dataDir, ".readyz-*")
+		if err != nil {
+			return err
+		}
+		file.Close()
+		return os.Remove(file.Name())
+	}
+}
+
+// newOpenAIProbe returns a probe listing the models of the OpenAI API with the key. Listing models is
+// free, and unlike the client of requests the probe does not retry.
+func newOpenAIProbe(key string) func(ctx context.Context) error {
+	config := openai.DefaultConfig(key)
+	config.HTTPClient = &http.Client{Timeout: providerProbeTimeout}
+	client := openai.NewClientWithConfig(config)
+	return func(ctx context.Context) error {
+		_, err := client.ListModels(ctx)
+		return err
+	}
+}
+
+// cachedProbe runs the probe at most once per interval and returns the last result in between.
+type cachedProbe struct {
+	probe    func(ctx context.Context) error
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (p *cachedProbe) check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now := p.now(); p.checked.IsZero() || now.Sub(p.checked) >= p.interval {
+		ctx, cancel := context.WithTimeout(ctx, providerProbeTimeout)
+		defer cancel()
+		p.err = p.probe(ctx)
+		p.checked = now
+	}
+	return p.err
+}
+
+// healthzHandler reports that the server is running.
+func healthzHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// readyzHandler runs the checks and responds with 200 OK if all pass, otherwise with 503 Service
+// Unavailable. The response lists the result of every check; the errors of failed checks are only logged,
+// since the endpoint is not behind authentication.
+func readyzHandler(checks []healthCheck) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := http.StatusOK
+		results := gin.H{}
+		for _, check := range checks {
+			if err := check.check(c.Request.Context()); err != nil {
+				logEvent(c, slog.LevelWarn, "readiness_check_failed", gin.H{
+					"check": check.name,
+					"error": err.Error(),
+				})
+				results[check.name] = "failed"
+				status = http.StatusServiceUnavailable
+				continue
+			}
+			results[check.name] = "ok"
+		}
+
+		body := gin.H{"status": "ready", "checks": results}
+		if status != http.StatusOK {
+			body["status"] = "not_ready"
+		}
+		c.JSON(status, body)
+	}
+}
+
+// versionHandler responds with the version of the build, the commit it was built from if known and the
+// Go version.
+func versionHandler() gin.HandlerFunc {
+	body := gin.H{"version": version, "go_version": runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				body["commit"] = setting.Value
+			case "vcs.time":
+				body["build_time"] = setting.Value
+			}
+		}
+	}
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, body)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	failing := errors.New("connection refused")
+	var providerErr error
+
+	r := gin.New()
+	r.GET("/healthz", healthzHandler())
+	r.GET("/readyz", readyzHandler([]healthCheck{
+		{"storage", storageCheck(t.TempDir())},
+		{"openai", func(ctx context.Context) error { return providerErr }},
+	}))
+	r.GET("/version", versionHandler())
+	r.NoRoute(func(c *gin.Context) { c.String(http.StatusOK, "index.html") })
+
+	get := func(path string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var body map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body), path)
+		return w.Code, body
+	}
+
+	code, body := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body["status"])
+
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", body["status"])
+	assert.Equal(t, map[string]any{"storage": "ok", "openai": "ok"}, body["checks"])
+
+	providerErr = failing
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not_ready", body["status"])
+	assert.Equal(t, map[string]any{"storage": "ok", "openai": "failed"}, body["checks"])
+
+	code, body = get("/version")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "dev", body["version"])
+	assert.Contains(t, body, "go_version")
+}
+
+func TestStorageCheck(t *testing.T) {
+	assert.NoError(t, storageCheck(t.TempDir())(context.Background()))
+	assert.Error(t, storageCheck("/nonexistent/data")(context.Background()))
+}
+
+func TestCachedProbe(t *testing.T) {
+	calls := 0
+	now := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+	probe := &cachedProbe{
+		probe: func(ctx context.Context) error {
+			calls++
+			if calls == 1 {
+				return errors.New("timeout")
+			}
+			return nil
+		},
+		interval: time.Minute,
+		now:      func() time.Time { return now },
+	}
+
+	assert.Error(t, probe.check(context.Background()))
+	now = now.Add(30 * time.Second)
+	assert.Error(t, probe.check(context.Background()), "the failure is cached")
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, probe.check(context.Background()))
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	webhookJobsDir     = "jobs"
+	webhookJobFile     = "job.json"
+	webhookJobBodyFile = "body"
+
+	// maxJobAttempts is how often a job is started before it is given up, so a job that crashes the server
+	// is not resumed forever.
+	maxJobAttempts = 3
+)
+
+// jobCredentialHeaders are not stored with jobs. Resumed jobs are run as the user that was authenticated
+// when the job was accepted.
+var jobCredentialHeaders = []string{"Authorization", "Cookie", headerAPIKey, headerOpenAIKey}
+
+// webhookJob is a request with a webhook that is handled in the background. It is stored with the body of
+// the request until it is done, so the server resumes it after a restart.
+type webhookJob struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	Endpoint string `json:"endpoint"`
+	// Header is the header of the request without credentials.
+	Header     http.Header `json:"header"`
+	RemoteAddr string      `json:"remote_addr"`
+	// User identifies the user in events, AuthenticatedUser is the authenticated user, empty without
+	// authentication.
+	User              string `json:"user"`
+	AuthenticatedUser string `json:"authenticated_user,omitempty"`
+	// OpenAIKeyHeader is set if the request sent its own OpenAI key, which is not stored, so the job
+	// cannot be resumed.
+	OpenAIKeyHeader bool      `json:"openai_key_header,omitempty"`
+	URLs            []string  `json:"urls"`
+	Attempts        int       `json:"attempts"`
+	CreatedAt       time.Time `json:"created_at"`
+
+	// dir holds the job and the body.
+	dir string
+}
+
+// resumedJobKey is the context key of the job a resumed request belongs to.
+type resumedJobKey struct{}
+
+// resumedJob returns the job of a request served again by Resume. Only the server can set it, so requests
+// of clients never count as resumed.
+func resumedJob(ctx context.Context) (webhookJob, bool) {
+	job, ok := ctx.Value(resumedJobKey{}).(webhookJob)
+	return job, ok
+}
+
+// startJob answers the request with 202 Accepted and the job ID and handles it in the background with a
+// context that is not cancelled with the request. The job and the request body are stored first, as the
+// body cannot be read once the request is answered. Shutdown waits for jobs like for deliveries, and jobs
+// that did not complete are resumed by the next start of the server.
+func (w *Webhooks) startJob(c *gin.Context, kind string, urls []string, handle gin.HandlerFunc) {
+	job := webhookJob{
+		ID:                newEventID(),
+		Kind:              kind,
+		Method:            c.Request.Method,
+		URL:               c.Request.URL.RequestURI(),
+		Endpoint:          c.FullPath(),
+		Header:            c.Request.Header.Clone(),
+		RemoteAddr:        c.Request.RemoteAddr,
+		User:              userID(c),
+		AuthenticatedUser: c.GetString(contextKeyUser),
+		OpenAIKeyHeader:   c.GetHeader(headerOpenAIKey) != "",
+		URLs:              urls,
+		Attempts:          1,
+		CreatedAt:         time.Now().UTC(),
+	}
+	for _, name := range jobCredentialHeaders {
+		job.Header.Del(name)
+	}
+	job, body, err := w.storeJob(job, c.Request.Body)
+	if err != nil {
+		logEvent(c, slog.LevelWarn, "job_request_failed", gin.H{
+			"error": err.Error(),
+		})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing request"})
+		return
+	}
+
+	jobCtx := c.Copy()
+	writer := newJobWriter()
+	jobCtx.Writer = writer
+	jobCtx.Request = c.Request.Clone(withJobID(context.WithoutCancel(c.Request.Context()), job.ID))
+	jobCtx.Request.Body = body
+
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		defer body.Close()
+		w.runJob(jobCtx, writer, job, handle)
+	}()
+
+	logEvent(c, slog.LevelInfo, "job_started", gin.H{
+		"job_id": job.ID,
+	})
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+}
+
+// storeJob stores the job and the request body in a directory of its own and returns the stored body to
+// read the request from. Without a jobs directory, the job is stored in a temp directory.
+func (w *Webhooks) storeJob(job webhookJob, requestBody io.Reader) (webhookJob, *os.File, error) {
+	var err error
+	if w.jobsDir == "" {
+		job.dir, err = newRequestTempDir()
+	} else {
+		job.dir = filepath.Join(w.jobsDir, job.ID)
+		err = os.MkdirAll(job.dir, 0o700)
+	}
+	if err != nil {
+		return job, nil, err
+	}
+
+	if requestBody == nil {
+		requestBody = http.NoBody
+	}
+	body, err := os.Create(filepath.Join(job.dir, webhookJobBodyFile))
+	if err == nil {
+		// Bodies over the upload limit are cut off just after it, so the handler still rejects them.
+		_, err = io.Copy(body, io.LimitReader(requestBody, maxUploadBytes+multipartOverheadBytes+1))
+		if err == nil {
+			_, err = body.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			err = writeJSONFile(filepath.Join(job.dir, webhookJobFile), job)
+		}
+	}
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		removeRequestTempDir(job.dir)
+		return job, nil, err
+	}
+	return job, body, nil
+}
+
+// runJob handles the request of the job, sends its event to the webhooks and removes the job.
+func (w *Webhooks) runJob(c *gin.Context, writer *jobWriter, job webhookJob, handle gin.HandlerFunc) {
+	defer trackJob(jobKindWebhookJob)()
+	defer removeRequestTempDir(job.dir)
+	defer func() {
+		if err := recover(); err != nil {
+			logEvent(c, slog.LevelError, "panic_recovered", gin.H{
+				"error": fmt.Sprint(err),
+				"stack": string(debug.Stack()),
+			})
+			writer.status, writer.body = http.StatusInternalServerError, bytes.Buffer{}
+			writer.WriteString(`{"error":"Internal server error"}`)
+		}
+		w.Send(c.Request.Context(), newWebhookEvent(c, job.Kind, job.ID, writer.Status(), writer.body.Bytes()), job.URLs)
+	}()
+	handle(c)
+}
+
+// Resume serves the requests of the jobs a previous run of the server did not complete again with
+// handler, e.g. after a crash or a shutdown that did not wait for them, and returns their number. Jobs
+// that cannot be resumed are removed and reported to their webhooks as failed.
+func (w *Webhooks) Resume(handler http.Handler) int {
+	if w.jobsDir == "" {
+		return 0
+	}
+	entries, err := os.ReadDir(w.jobsDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logEvent(context.Background(), slog.LevelError, "jobs_resume_failed", gin.H{
+				"error": err.Error(),
+			})
+		}
+		return 0
+	}
+
+	resumed := 0
+	for _, entry := range entries {
+		dir := filepath.Join(w.jobsDir, entry.Name())
+		var job webhookJob
+		content, err := os.ReadFile(filepath.Join(dir, webhookJobFile))
+		if err == nil {
+			err = json.Unmarshal(content, &job)
+		}
+		if err != nil {
+			// The server stopped while the job was stored, before it was accepted.
+			os.RemoveAll(dir)
+			continue
+		}
+		job.dir = dir
+		job.Attempts++
+
+		switch {
+		case job.OpenAIKeyHeader:
+			w.abandonJob(job, "The server restarted and the OpenAI key of the request is not stored")
+			continue
+		case job.Attempts > maxJobAttempts:
+			w.abandonJob(job, fmt.Sprintf("The job did not complete in %d attempts", maxJobAttempts))
+			continue
+		}
+		if err := w.resumeJob(handler, job); err != nil {
+			w.abandonJob(job, "The server restarted and the job could not be resumed")
+			continue
+		}
+		resumed++
+	}
+	return resumed
+}
+
+// resumeJob serves the stored request of the job with handler in the background.
+func (w *Webhooks) resumeJob(handler http.Handler, job webhookJob) error {
+	if err := writeJSONFile(filepath.Join(job.dir, webhookJobFile), job); err != nil {
+		return err
+	}
+	body, err := os.Open(filepath.Join(job.dir, webhookJobBodyFile))
+	if err != nil {
+		return err
+	}
+	info, err := body.Stat()
+	if err != nil {
+		body.Close()
+		return err
+	}
+	ctx := context.WithValue(withJobID(context.Background(), job.ID), resumedJobKey{}, job)
+	request, err := http.NewRequestWithContext(ctx, job.Method, job.URL, body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	request.Header = job.Header
+	request.RemoteAddr = job.RemoteAddr
+	request.ContentLength = info.Size()
+
+	logEvent(ctx, slog.LevelInfo, "job_resumed", gin.H{
+		"job_id":   job.ID,
+		"endpoint": job.Endpoint,
+		"attempt":  job.Attempts,
+	})
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		defer body.Close()
+		writer := newJobWriter()
+		handler.ServeHTTP(writer, request)
+		// The request did not reach the handler of the job, e.g. because its route or its OpenAI key is
+		// gone.
+		if _, err := os.Stat(job.dir); err == nil {
+			var response struct {
+				Error string `json:"error"`
+			}
+			json.Unmarshal(writer.body.Bytes(), &response)
+			if response.Error == "" {
+				response.Error = "The server restarted and the job could not be resumed"
+			}
+			w.abandonJob(job, response.Error)
+		}
+	}()
+	return nil
+}
+
+// abandonJob removes the job and sends a failed event to its webhooks.
+func (w *Webhooks) abandonJob(job webhookJob, message string) {
+	ctx := withJobID(context.Background(), job.ID)
+	logEvent(ctx, slog.LevelWarn, "job_abandoned", gin.H{
+		"job_id":   job.ID,
+		"endpoint": job.Endpoint,
+		"attempts": job.Attempts,
+		"error":    message,
+	})
+	removeRequestTempDir(job.dir)
+	w.Send(ctx, WebhookEvent{
+		ID:       job.ID,
+		Type:     job.Kind + ".failed",
+		Time:     time.Now().UTC(),
+		User:     job.User,
+		Endpoint: job.Endpoint,
+		Status:   http.StatusInternalServerError,
+		Error:    message,
+	}, job.URLs)
+}
+
+// jobWriter records the response of a job, which is handled in the background after its request was
+// answered.
+type jobWriter struct {
+	header http.Header
+	status int
+	// size is -1 until the response is written, like for gin's writer.
+	size int
+	body bytes.Buffer
+}
+
+func newJobWriter() *jobWriter {
+	return &jobWriter{header: http.Header{}, status: http.StatusOK, size: -1}
+}
+
+func (w *jobWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *jobWriter) WriteHeader(code int) {
+	if code > 0 && !w.Written() {
+		w.status = code
+	}
+}
+
+func (w *jobWriter) WriteHeaderNow() {
+	if !w.Written() {
+		w.size = 0
+	}
+}
+
+func (w *jobWriter) Write(data []byte) (int, error) {
+	w.WriteHeaderNow()
+	n, err := w.body.Write(data)
+	w.size += n
+	return n, err
+}
+
+func (w *jobWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *jobWriter) Status() int {
+	return w.status
+}
+
+func (w *jobWriter) Size() int {
+	return w.size
+}
+
+func (w *jobWriter) Written() bool {
+	return w.size != -1
+}
+
+func (w *jobWriter) Flush() {}
+
+func (w *jobWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
+
+// CloseNotify returns a channel that is never closed, as there is no client to disconnect.
+func (w *jobWriter) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func (w *jobWriter) Pusher() http.Pusher {
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/abadojack/whatlanggo"
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+const (
+	languageSourceUser        = "user"
+	languageSourceWhisper     = "whisper"
+	languageSourceStatistical = "statistical"
+	languageSourceLLM         = "llm"
+	languageSourceDefault     = "default"
+
+	defaultLanguageCode = "en"
+
+	// minStatisticalConfidence is the confidence from which on the local detector is trusted without asking the LLM.
+	minStatisticalConfidence = 0.8
+	// languageSampleLength is the number of characters of the text used for detection.
+	languageSampleLength = 1000
+)
+
+var ErrInvalidLanguage = errors.New("invalid language code")
+
+// whisperLanguageCodes are the languages Whisper can transcribe.
+var whisperLanguageCodes = []string{
+	"af", "am", "ar", "as", "az", "ba", "be", "bg", "bn", "bo", "br", "bs", "ca", "cs", "cy", "da", "de", "el",
+	"en", "es", "et", "eu", "fa", "fi", "fo", "fr", "gl", "gu", "ha", "haw", "he", "hi", "hr", "ht", "hu", "hy",
+	"id", "is", "it", "ja", "jv", "ka", "kk", "km", "kn", "ko", "la", "lb", "ln", "lo", "lt", "lv", "mg", "mi",
+	"mk", "ml", "mn", "mr", "ms", "mt", "my", "ne", "nl", "nn", "no", "oc", "pa", "pl", "ps", "pt", "ro", "ru",
+	"sa", "sd", "si", "sk", "sl", "sn", "so", "sq", "sr", "su", "sv", "sw", "ta", "te", "tg", "th", "tk", "tl",
+	"tr", "tt", "uk", "ur", "uz", "vi", "yi", "yo", "yue", "zh",
+}
+
+// whisperLanguageAliases maps language names Whisper reports that differ from the English display names.
+var whisperLanguageAliases = map[string]string{
+	"burmese":        "my",
+	"cantonese":      "yue",
+	"castilian":      "es",
+	"flemish":        "nl",
+	"haitian":        "ht",
+	"haitian creole": "ht",
+	"letzeburgesch":  "lb",
+	"mandarin":       "zh",
+	"moldavian":      "ro",
+	"moldovan":       "ro",
+	"myanmar":        "my",
+	"nynorsk":        "nn",
+	"panjabi":        "pa",
+	"pushto":         "ps",
+	"sinhalese":      "si",
+	"valencian":      "ca",
+}
+
+// whisperLanguages maps the lower-case English names of the Whisper languages to their codes.
+var whisperLanguages = func() map[string]string {
+	names := display.English.Languages()
+	languages := map[string]string{}
+	for _, code := range whisperLanguageCodes {
+		languages[strings.ToLower(names.Name(language.MustParse(code)))] = code
+	}
+	for name, code := range whisperLanguageAliases {
+		languages[name] = code
+	}
+	return languages
+}()
+
+// DetectedLanguage is the result of the language detection.
+type DetectedLanguage struct {
+	// Code is the BCP-47 language code, e.g. "en" or "pt-BR".
+	Code string `json:"code"`
+	// Name is the English name of the language.
+	Name       string  `json:"name"`
+	Confidence float64 `json:"confidence"`
+	// Source is the detector the language was taken from.
+	Source string `json:"source"`
+}
+
+func newDetectedLanguage(code string, confidence float64, source string) DetectedLanguage {
+	return DetectedLanguage{Code: code, Name: languageName(code), Confidence: confidence, Source: source}
+}
+
+// normalizeLanguageCode parses a BCP-47 language code and returns it in canonical form.
+func normalizeLanguageCode(code string) (string, error) {
+	tag, err := language.Parse(strings.TrimSpace(code))
+	if err != nil || tag == language.Und {
+		return "", fmt.Errorf("%w: %q", ErrInvalidLanguage, code)
+	}
+	return tag.String(), nil
+}
+
+// languageName returns the English name of a BCP-47 language code, or the code itself if it is unknown.
+func languageName(code string) string {
+	tag, err := language.Parse(code)
+	if err != nil {
+		return code
+	}
+	if name := display.English.Languages().Name(tag); name != "" {
+		return name
+	}
+	return code
+}
+
+// whisperLanguageCode returns the ISO-639-1 code Whisper expects for a BCP-47 language code.
+func whisperLanguageCode(code string) string {
+	tag, err := language.Parse(code)
+	if err != nil {
+		return ""
+	}
+	base, _ := tag.Base()
+	return base.String()
+}
+
+// languageFromWhisper maps the language reported by Whisper, which is usually an English name like
+// "german", to a language code.
+func languageFromWhisper(whisperLanguage string) (string, bool) {
+	name := strings.ToLower(strings.TrimSpace(whisperLanguage))
+	if code, ok := whisperLanguages[name]; ok {
+		return code, true
+	}
+	for _, code := range whisperLanguageCodes {
+		if name == code {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+// resolveLanguage validates the language selected for the request or, if none is selected, detects it.
+// The selection is updated with the resulting language code.
+func resolveLanguage(ctx context.Context, client OpenAIClient, text string, selection *PromptSelection, whisperLanguages []string) (DetectedLanguage, error) {
+	if selection.Language != "" {
+		code, err := normalizeLanguageCode(selection.Language)
+		if err != nil {
+			return DetectedLanguage{}, err
+		}
+		selection.Language = code
+	}
+
+	detected := detectLanguage(ctx, client, text, *selection, whisperLanguages)
+	selection.Language = detected.Code
+	return detected, nil
+}
+
+// detectLanguage determines the language of the given text. It uses, in this order, the language selected by
+// the user, the language Whisper detected for most chunks of the recording, the local statistical detector
+// if it is confident enough, and OpenAI's language model. If everything fails, English is assumed.
+func detectLanguage(ctx context.Context, client OpenAIClient, text string, selection PromptSelection, whisperLanguages []string) DetectedLanguage {
+	if selection.Language != "" {
+		return newDetectedLanguage(selection.Language, 1, languageSourceUser)
+	}
+
+	if code, confidence, ok := detectWhisperLanguage(whisperLanguages); ok {
+		return newDetectedLanguage(code, confidence, languageSourceWhisper)
+	}
+
+	// take the first characters of the text
+	if len(text) > languageSampleLength {
+		text = text[:languageSampleLength]
+	}
+
+	statistical := detectLanguageStatistically(text)
+	if statistical.Code != "" && statistical.Confidence >= minStatisticalConfidence {
+		return statistical
+	}
+
+	llm, err := detectLanguageWithLLM(ctx, client, text, selection)
+	if err == nil {
+		return llm
+	}
+	logEvent(ctx, slog.LevelWarn, "language_detection_failed", gin.H{
+		"error": err.Error(),
+	})
+
+	if statistical.Code != "" {
+		return statistical
+	}
+	return newDetectedLanguage(defaultLanguageCode, 0, languageSourceDefault)
+}
+
+// detectWhisperLanguage returns the language Whisper reported for most chunks and the share of chunks it was reported for.
+func detectWhisperLanguage(whisperLanguages []string) (string, float64, bool) {
+	counts := map[string]int{}
+	best := ""
+	for _, whisperLanguage := range whisperLanguages {
+		code, ok := languageFromWhisper(whisperLanguage)
+		if !ok {
+			continue
+		}
+		counts[code]++
+		if best == "" || counts[code] > counts[best] {
+			best = code
+		}
+	}
+	if best == "" {
+		return "", 0, false
+	}
+	return best, float64(counts[best]) / float64(len(whisperLanguages)), true
+}
+
+// detectLanguageStatistically detects the language with a local trigram-based detector.
+func detectLanguageStatistically(text string) DetectedLanguage {
+	info := whatlanggo.Detect(text)
+	code := info.Lang.Iso6391()
+	if code == "" {
+		return DetectedLanguage{Source: languageSourceStatistical}
+	}
+	return newDetectedLanguage(code, info.Confidence, languageSourceStatistical)
+}
+
+// detectLanguageWithLLM asks OpenAI's language model for the language of the text.
+func detectLanguageWithLLM(ctx context.Context, client OpenAIClient, text string, selection PromptSelection) (DetectedLanguage, error) {
+	prompt, err := promptStore.Render(promptLanguage, selection, PromptData{Text: text})
+	if err != nil {
+		return DetectedLanguage{}, err
+	}
+
+	detection, err := completeStructured[LanguageDetection](ctx, client, openai.GPT4oMini, "language", prompt, 0)
+	if err != nil {
+		return DetectedLanguage{}, err
+	}
+
+	code, err := normalizeLanguageCode(detection.Code)
+	if err != nil {
+		return DetectedLanguage{}, err
+	}
+	return newDetectedLanguage(code, detection.Confidence, languageSourceLLM), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeLanguageCode(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{input: "en", expected: "en"},
+		{input: "DE", expected: "de"},
+		{input: "pt-br", expected: "pt-BR"},
+		{input: " de-AT ", expected: "de-AT"},
+	}
+	for _, tc := range testCases {
+		code, err := normalizeLanguageCode(tc.input)
+		require.NoError(t, err, tc.input)
+		assert.Equal(t, tc.expected, code)
+	}
+
+	for _, input := range []string{"", "German", "not a language", "und"} {
+		_, err := normalizeLanguageCode(input)
+		assert.ErrorIs(t, err, ErrInvalidLanguage, input)
+	}
+}
+
+func TestLanguageNames(t *testing.T) {
+	assert.Equal(t, "German", languageName("de"))
+	assert.Equal(t, "Brazilian Portuguese", languageName("pt-BR"))
+	assert.Equal(t, "pt", whisperLanguageCode("pt-BR"))
+	assert.Equal(t, "de", whisperLanguageCode("de"))
+}
+
+func TestLanguageFromWhisper(t *testing.T) {
+	testCases := map[string]string{
+		"english":   "en",
+		"German":    "de",
+		"myanmar":   "my",
+		"cantonese": "yue",
+		"de":        "de",
+	}
+	for input, expected := range testCases {
+		code, ok := languageFromWhisper(input)
+		assert.True(t, ok, input)
+		assert.Equal(t, expected, code, input)
+	}
+
+	_, ok := languageFromWhisper("klingon")
+	assert.False(t, ok)
+}
+
+func TestDetectLanguage(t *testing.T) {
+	german := "Heute möchte ich euch erzählen, wie wir unsere Konferenz organisiert haben und was wir dabei gelernt haben. Es war nicht immer einfach, aber am Ende hat sich die Arbeit gelohnt."
+
+	testCases := []struct {
+		name             string
+		text             string
+		selection        PromptSelection
+		whisperLanguages []string
+		llmAnswer        string
+		expected         DetectedLanguage
+	}{
+		{
+			name:      "user selection wins",
+			text:      german,
+			selection: PromptSelection{Language: "en-GB"},
+			expected:  DetectedLanguage{Code: "en-GB", Name: "British English", Confidence: 1, Source: languageSourceUser},
+		},
+		{
+			name:             "majority of whisper chunks",
+			text:             german,
+			whisperLanguages: []string{"english", "german", "german", ""},
+			expected:         DetectedLanguage{Code: "de", Name: "German", Confidence: 0.5, Source: languageSourceWhisper},
+		},
+		{
+			name:     "statistical detector",
+			text:     german,
+			expected: DetectedLanguage{Code: "de", Name: "German", Source: languageSourceStatistical},
+		},
+		{
+			name:      "llm for short texts",
+			text:      "Ok.",
+			llmAnswer: `{"code": "fr", "confidence": 0.4}`,
+			expected:  DetectedLanguage{Code: "fr", Name: "French", Confidence: 0.4, Source: languageSourceLLM},
+		},
+		{
+			name:      "default if nothing works",
+			text:      "",
+			llmAnswer: `{}`,
+			expected:  DetectedLanguage{Code: "en", Name: "English", Source: languageSourceDefault},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &chatFuncClient{complete: func(prompt string) string { return tc.llmAnswer }}
+
+			detected := detectLanguage(context.Background(), client, tc.text, tc.selection, tc.whisperLanguages)
+			if tc.expected.Source == languageSourceStatistical {
+				assert.GreaterOrEqual(t, detected.Confidence, minStatisticalConfidence)
+				detected.Confidence = 0
+			}
+			assert.Equal(t, tc.expected, detected)
+			if tc.llmAnswer == "" {
+				assert.Empty(t, client.prompts, "the LLM should not be asked")
+			}
+		})
+	}
+}
+
+func TestResolveLanguage(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string { return "" }}
+
+	selection := PromptSelection{Language: "pt-br"}
+	detected, err := resolveLanguage(context.Background(), client, "text", &selection, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "pt-BR", detected.Code)
+	assert.Equal(t, "pt-BR", selection.Language)
+
+	selection = PromptSelection{Language: "Portuguese"}
+	_, err = resolveLanguage(context.Background(), client, "text", &selection, nil)
+	assert.True(t, errors.Is(err, ErrInvalidLanguage))
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	headerRequestID = "X-Request-ID"
+
+	// maxRequestIDLength limits request IDs sent by clients, which are written to every log event.
+	maxRequestIDLength = 128
+)
+
+// logger writes all log events. It is replaced in main by the logger configured with LOG_LEVEL, LOG_FORMAT
+// and LOG_CONTENT.
+var logger = newLogger(os.Stdout, LogConfig{Level: slog.LevelInfo, Format: "json"})
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// phonePattern matches numbers of at least eight digits in groups separated by spaces or dashes, with an
+	// optional country code, e.g. +49 30 1234567 or (555) 123-4567. Dates and IP addresses do not match.
+	phonePattern = regexp.MustCompile(`(?:\+\d{1,3}[\s-]?)?(?:\(\d{2,4}\)[\s-]?|\b\d{2,4}[\s-])\d{3,4}[\s-]?\d{3,4}\b`)
+)
+
+// LogConfig configures the logger.
+type LogConfig struct {
+	Level  slog.Level
+	Format string
+	// Content includes the text of transcripts, prompts and results in log events. Otherwise only their
+	// length and hash are logged.
+	Content bool
+}
+
+type requestIDKey struct{}
+
+type jobIDKey struct{}
+
+// loadLogger creates the logger configured by LOG_LEVEL (debug, info, warn or error, default info),
+// LOG_FORMAT (json or text, default json) and LOG_CONTENT (true to log transcript content, default false).
+func loadLogger(getenv func(string) string, w io.Writer) (*slog.Logger, error) {
+	config := LogConfig{Level: slog.LevelInfo, Format: strings.ToLower(getenv("LOG_FORMAT"))}
+	if value := getenv("LOG_LEVEL"); value != "" {
+		if err := config.Level.UnmarshalText([]byte(value)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error: %q", value)
+		}
+	}
+	if config.Format == "" {
+		config.Format = "json"
+	}
+	if config.Format != "json" && config.Format != "text" {
+		return nil, fmt.Errorf("LOG_FORMAT must be json or text: %q", config.Format)
+	}
+	if value := getenv("LOG_CONTENT"); value != "" {
+		content, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("LOG_CONTENT must be true or false: %q", value)
+		}
+		config.Content = content
+	}
+	return newLogger(w, config), nil
+}
+
+// newLogger returns a logger writing events as configured. Events keep the fields of earlier versions,
+// event_type, timestamp and data, and add the level and the IDs of the context. Email addresses and phone
+// numbers are removed from all strings, and content marked with redact is only logged if config.Content
+// is set.
+func newLogger(w io.Writer, config LogConfig) *slog.Logger {
+	options := &slog.HandlerOptions{
+		Level: config.Level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 {
+				switch attr.Key {
+				case slog.MessageKey:
+					attr.Key = "event_type"
+				case slog.TimeKey:
+					attr.Key = "timestamp"
+				}
+			}
+			switch value := attr.Value.Any().(type) {
+			case redactedText:
+				if config.Content {
+					attr.Value = slog.StringValue(scrubPII(string(value)))
+				} else {
+					attr.Value = value.summary()
+				}
+			case string:
+				attr.Value = slog.StringValue(scrubPII(value))
+			}
+			return attr
+		},
+	}
+	var handler slog.Handler
+	if config.Format == "text" {
+		handler = slog.NewTextHandler(w, options)
+	} else {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request and job IDs and the trace ID of the context to every event, so all events
+// of a request, including those of the goroutines it starts, can be correlated.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	// gin.Context only looks up its own keys, the IDs are stored in the context of the request.
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ctx = c.Request.Context()
+	}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if id, ok := ctx.Value(jobIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("job_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// logEvent logs an event with its data. ctx carries the request and job IDs; it may be a *gin.Context.
+func logEvent(ctx context.Context, level slog.Level, eventType string, data gin.H) {
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attrs := make([]any, len(keys))
+	for i, key := range keys {
+		attrs[i] = slog.Any(key, data[key])
+	}
+	logger.LogAttrs(ctx, level, eventType, slog.Group("data", attrs...))
+}
+
+// redactedText is content of users, such as transcripts, prompts and results, in the data of a log event.
+type redactedText string
+
+// redact marks the text as content that is only logged with LOG_CONTENT.
+func redact(text string) redactedText {
+	return redactedText(text)
+}
+
+// summary describes the text without revealing it. The hash allows to recognize the same text in
+// different events.
+func (t redactedText) summary() slog.Value {
+	hash := sha256.Sum256([]byte(t))
+	return slog.GroupValue(
+		slog.Int("length", len(t)),
+		slog.String("sha256", hex.EncodeToString(hash[:8])),
+	)
+}
+
+// scrubPII replaces email addresses and phone numbers in the text.
+func scrubPII(text string) string {
+	text = emailPattern.ReplaceAllString(text, "[email]")
+	return phonePattern.ReplaceAllString(text, "[phone]")
+}
+
+// fatal logs a configuration error and exits.
+func fatal(eventType string, err error) {
+	logEvent(context.Background(), slog.LevelError, eventType, gin.H{
+		"error": err.Error(),
+	})
+	os.Exit(1)
+}
+
+// withRequestID returns a context whose log events carry the request ID.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// withJobID returns a context whose log events carry the job ID, e.g. of an upload or a webhook delivery
+// that spans several requests or outlives its request.
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, id)
+}
+
+// setJobID attaches the job ID to the log events of the request and everything it starts.
+func setJobID(c *gin.Context, id string) {
+	c.Request = c.Request.WithContext(withJobID(c.Request.Context(), id))
+}
+
+// newRequestID returns a random ID for a request that did not send one.
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// validRequestID reports whether a request ID sent by a client can be used. IDs are restricted to
+// characters that cannot forge log fields.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogMiddleware assigns every request an ID, taken from the X-Request-ID header if the client sent
+// a valid one, returns it in the X-Request-ID header and logs the request once it is handled.
+func requestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(headerRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Header(headerRequestID, id)
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("request.id", id))
+
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+		logEvent(c, level, "request_completed", gin.H{
+			"method":      c.Request.Method,
+			"path":        c.Request.URL.Path,
+			"route":       c.FullPath(),
+			"status":      status,
+			"size":        c.Writer.Size(),
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+	}
+}
+
+// recoveryMiddleware responds with 500 Internal Server Error to requests whose handler panicked and logs
+// the panic with its stack trace.
+func recoveryMiddleware() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		logEvent(c, slog.LevelError, "panic_recovered", gin.H{
+			"error": fmt.Sprint(err),
+			"stack": string(debug.Stack()),
+		})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logBuffer collects the log events written by concurrent goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// events returns the JSON log events written so far.
+func (b *logBuffer) events(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var event map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+// captureLogs replaces the logger with one writing JSON events of the given minimum level to the returned
+// buffer for the duration of the test.
+func captureLogs(t *testing.T, level slog.Level) *logBuffer {
+	buffer := &logBuffer{}
+	previous := logger
+	logger = newLogger(buffer, LogConfig{Level: level, Format: "json"})
+	t.Cleanup(func() { logger = previous })
+	return buffer
+}
+
+func TestLoadLogger(t *testing.T) {
+	env := func(values map[string]string) func(string) string {
+		return func(key string) string { return values[key] }
+	}
+
+	var buffer bytes.Buffer
+	l, err := loadLogger(env(nil), &buffer)
+	require.NoError(t, err)
+	assert.True(t, l.Enabled(context.Background(), slog.LevelInfo))
+	assert.False(t, l.Enabled(context.Background(), slog.LevelDebug))
+
+	l, err = loadLogger(env(map[string]string{"LOG_LEVEL": "debug", "LOG_FORMAT": "text"}), &buffer)
+	require.NoError(t, err)
+	assert.True(t, l.Enabled(context.Background(), slog.LevelDebug))
+	l.InfoContext(withRequestID(context.Background(), "abc"), "test_event")
+	assert.Contains(t, buffer.String(), "event_type=test_event")
+	assert.Contains(t, buffer.String(), "request_id=abc")
+
+	_, err = loadLogger(env(map[string]string{"LOG_LEVEL": "verbose"}), &buffer)
+	assert.Error(t, err)
+	_, err = loadLogger(env(map[string]string{"LOG_FORMAT": "xml"}), &buffer)
+	assert.Error(t, err)
+	_, err = loadLogger(env(map[string]string{"LOG_CONTENT": "sometimes"}), &buffer)
+	assert.Error(t, err)
+}
+
+func TestLogEvent_RedactsContent(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+
+	transcript := "Call me at +49 30 1234567 or write to jane.doe@example.com."
+	logEvent(context.Background(), slog.LevelInfo, "transcribed", gin.H{
+		"transcription": redact(transcript),
+		"error":         "no answer from jane.doe@example.com",
+	})
+
+	events := logs.events(t)
+	require.Len(t, events, 1)
+	data := events[0]["data"].(map[string]any)
+	summary := data["transcription"].(map[string]any)
+	assert.Equal(t, float64(len(transcript)), summary["length"])
+	assert.Len(t, summary["sha256"], 16)
+	assert.Equal(t, "no answer from [email]", data["error"])
+	assert.NotContains(t, logs.buf.String(), "Call me")
+
+	// With LOG_CONTENT the content is logged, but still without personal data.
+	logs = &logBuffer{}
+	logger = newLogger(logs, LogConfig{Level: slog.LevelInfo, Format: "json", Content: true})
+	logEvent(context.Background(), slog.LevelInfo, "transcribed", gin.H{
+		"transcription": redact(transcript),
+	})
+	events = logs.events(t)
+	require.Len(t, events, 1)
+	assert.Equal(t, "Call me at [phone] or write to [email].", events[0]["data"].(map[string]any)["transcription"])
+}
+
+func TestScrubPII(t *testing.T) {
+	testCases := []struct {
+		text     string
+		expected string
+	}{
+		{"mail bob+talks@mail.example.org now", "mail [email] now"},
+		{"call (555) 123-4567", "call [phone]"},
+		{"call 555-123-4567 or +1 555 123 4567", "call [phone] or [phone]"},
+		{"+44 20 7946 0958", "[phone]"},
+		{"period 2024-05-31", "period 2024-05-31"},
+		{"ip:192.168.100.200", "ip:192.168.100.200"},
+		{"chunk-600000000000-1200000000000.mp3", "chunk-600000000000-1200000000000.mp3"},
+		{"3 chunks, 1024 bytes", "3 chunks, 1024 bytes"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, scrubPII(tc.text), tc.text)
+	}
+}
+
+func TestLogEvent(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+
+	ctx := withJobID(withRequestID(context.Background(), "request-1"), "job-1")
+	logEvent(ctx, slog.LevelWarn, "something_happened", gin.H{"count": 2})
+	logEvent(ctx, slog.LevelDebug, "hidden", gin.H{})
+
+	events := logs.events(t)
+	require.Len(t, events, 1)
+	event := events[0]
+	assert.Equal(t, "something_happened", event["event_type"])
+	assert.Equal(t, "WARN", event["level"])
+	assert.Equal(t, "request-1", event["request_id"])
+	assert.Equal(t, "job-1", event["job_id"])
+	assert.Contains(t, event, "timestamp")
+	assert.Equal(t, map[string]any{"count": float64(2)}, event["data"])
+}
+
+func TestLogEvent_ChunkGoroutinesCarryRequestID(t *testing.T) {
+	logs := captureLogs(t, slog.LevelDebug)
+
+	ctx := withRequestID(context.Background(), "request-1")
+	_, err := transcribeChunks(ctx, &mockOpenAIClient{}, []string{"chunk1.mp3", "chunk2.mp3"}, "", nil)
+	require.NoError(t, err)
+
+	events := logs.events(t)
+	require.NotEmpty(t, events)
+	for _, event := range events {
+		assert.Equal(t, "request-1", event["request_id"], event["event_type"])
+	}
+}
+
+func TestRequestLogMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logs := captureLogs(t, slog.LevelInfo)
+
+	r := gin.New()
+	r.Use(requestLogMiddleware(), recoveryMiddleware())
+	r.GET("/ok", func(c *gin.Context) {
+		logEvent(c, slog.LevelInfo, "handled", gin.H{})
+		c.Status(http.StatusOK)
+	})
+	r.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ok", nil))
+	generated := w.Header().Get(headerRequestID)
+	assert.Len(t, generated, 16)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ok", nil)
+	req.Header.Set(headerRequestID, "client-id.1")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "client-id.1", w.Header().Get(headerRequestID))
+
+	// IDs that could forge log fields are replaced.
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/ok", nil)
+	req.Header.Set(headerRequestID, "id\" injected=\"1")
+	r.ServeHTTP(w, req)
+	assert.NotEqual(t, "id\" injected=\"1", w.Header().Get(headerRequestID))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	events := logs.events(t)
+	require.Len(t, events, 8)
+	assert.Equal(t, "handled", events[0]["event_type"])
+	assert.Equal(t, generated, events[0]["request_id"])
+	assert.Equal(t, "request_completed", events[1]["event_type"])
+	assert.Equal(t, generated, events[1]["request_id"])
+	assert.Equal(t, "client-id.1", events[2]["request_id"])
+	assert.Equal(t, "panic_recovered", events[6]["event_type"])
+	assert.Equal(t, "ERROR", events[6]["level"])
+	assert.Equal(t, "request_completed", events[7]["event_type"])
+	assert.Equal(t, "ERROR", events[7]["level"])
+}
@@ -2,21 +2,22 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"mime/multipart"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -29,20 +30,131 @@ const (
 type OpenAIClient interface {
 	CreateTranscription(ctx context.Context, request openai.AudioRequest) (response openai.AudioResponse, err error)
 	CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (response openai.ChatCompletionResponse, err error)
+	CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (stream *openai.ChatCompletionStream, err error)
 }
 
 func main() {
+	var err error
+	logger, err = loadLogger(os.Getenv, os.Stdout)
+	if err != nil {
+		fatal("invalid_logging", err)
+	}
+	tracerProvider, err := loadTracerProvider(context.Background(), os.Getenv)
+	if err != nil {
+		fatal("invalid_tracing", err)
+	}
+	if tracerProvider != nil {
+		defer tracerProvider.Shutdown(context.Background())
+		tracer = tracerProvider.Tracer(tracerName)
+	}
 
-	token := os.Getenv("OPENAI_API_KEY")
-	clientConfig := openai.DefaultConfig(token)
-	clientConfig.HTTPClient = retryablehttp.NewClient().HTTPClient
-	openaiClient := openai.NewClientWithConfig(clientConfig)
+	if os.Getenv("PROMPTS_DIR") != "" || os.Getenv("PROMPT_VERSION") != "" {
+		store, err := loadPromptStore(os.Getenv("PROMPT_VERSION"), os.Getenv("PROMPTS_DIR"))
+		if err != nil {
+			fatal("invalid_prompts", err)
+		}
+		promptStore = store
+	}
 
-	r := gin.Default()
-	r.Use(cors.Default())
+	if path := os.Getenv("PRICES_FILE"); path != "" {
+		table, err := loadPriceTable(path)
+		if err != nil {
+			fatal("invalid_prices", err)
+		}
+		prices = table
+	}
 
-	r.GET("/*path", func(c *gin.Context) {
-		path := c.Param("path")
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
+	usageLog, err = openUsageLog(dataDir)
+	if err != nil {
+		fatal("invalid_data_dir", err)
+	}
+	if err := loadQuotas(); err != nil {
+		fatal("invalid_quotas", err)
+	}
+	maxUploadBytes, err = loadMaxUploadBytes(os.Getenv)
+	if err != nil {
+		fatal("invalid_upload_limit", err)
+	}
+	shutdownTimeout, err := loadShutdownTimeout(os.Getenv)
+	if err != nil {
+		fatal("invalid_shutdown_timeout", err)
+	}
+	cleanOrphanedTempFiles()
+	sources = loadSourceConfig(os.Getenv)
+	webhookConfig, err := loadWebhookConfig(os.Getenv)
+	if err != nil {
+		fatal("invalid_webhooks", err)
+	}
+	webhooks := newWebhooks(webhookConfig, dataDir)
+	uploads, err := openUploadStore(dataDir)
+	if err != nil {
+		fatal("invalid_data_dir", err)
+	}
+	checkpoints, err = openCheckpointStore(dataDir)
+	if err != nil {
+		fatal("invalid_data_dir", err)
+	}
+	resultCache, err = loadResultCache(os.Getenv, dataDir)
+	if err != nil {
+		fatal("invalid_cache", err)
+	}
+	if count := checkpoints.Count(); count > 0 {
+		logEvent(context.Background(), slog.LevelInfo, "checkpoints_found", gin.H{
+			"count": count,
+			"hint":  "unfinished transcriptions resume when their recordings are sent again",
+		})
+	}
+
+	// Without a server key, users have to supply their own OpenAI key.
+	var openaiClient OpenAIClient
+	var probeOpenAI func(ctx context.Context) error
+	if token := os.Getenv("OPENAI_API_KEY"); token != "" {
+		openaiClient = newOpenAIClient(token)
+		probeOpenAI = newOpenAIProbe(token)
+	} else {
+		logEvent(context.Background(), slog.LevelWarn, "server_openai_key_missing", gin.H{
+			"hint": "requests need an " + headerOpenAIKey + " header or a stored key",
+		})
+	}
+	var openAIKeys *OpenAIKeyStore
+	if encryptionKey := os.Getenv("OPENAI_KEY_ENCRYPTION_KEY"); encryptionKey != "" {
+		openAIKeys, err = openOpenAIKeyStore(dataDir, encryptionKey)
+		if err != nil {
+			fatal("invalid_openai_key_encryption_key", err)
+		}
+	}
+
+	authConfig := loadAuthConfig(os.Getenv)
+	authenticators, err := authConfig.authenticators()
+	if err != nil {
+		fatal("invalid_auth", err)
+	}
+	if len(authenticators) == 0 {
+		logEvent(context.Background(), slog.LevelWarn, "authentication_disabled", gin.H{
+			"hint": "set API_KEYS or OIDC_ISSUER to require authentication",
+		})
+	}
+
+	server := newServer(shutdownTimeout)
+	r := gin.New()
+	// Clients are identified by their IP address without authentication, so X-Forwarded-For is only
+	// believed from the configured proxies.
+	if err := r.SetTrustedProxies(splitList(os.Getenv("TRUSTED_PROXIES"))); err != nil {
+		fatal("invalid_trusted_proxies", err)
+	}
+	r.Use(tracingMiddleware(), requestLogMiddleware(), metricsMiddleware(), recoveryMiddleware(), server.middleware(), authConfig.corsMiddleware(), cacheControlMiddleware())
+
+	// Static files are served for all unknown paths, so they do not shadow the API routes.
+	r.NoRoute(func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) || strings.HasPrefix(path, "/api/") {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
 		c.Header("Cross-Origin-Opener-Policy", "same-origin")
 		c.Header("Cross-Origin-Embedder-Policy", "require-corp")
 		if path != "" {
@@ -54,125 +166,301 @@ func main() {
 		c.File("client/dist/index.html")
 	})
 
-	r.POST("/api/transcribe", func(c *gin.Context) {
-		file, _, err := c.Request.FormFile("audio")
-		if err != nil {
-			log.Println("no_file_provided")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
-			return
-		}
+	r.GET("/metrics", metricsHandler())
 
-		chunks, err := splitAudio(file)
+	r.GET("/healthz", healthzHandler())
 
-		if err != nil {
-			log.Println("error_splitting_audio", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Error splitting audio"})
-			return
-		}
+	r.GET("/readyz", readyzHandler(readinessChecks(dataDir, probeOpenAI)))
 
-		transcriptions := transcribeChunks(openaiClient, chunks)
+	r.GET("/version", versionHandler())
 
-		transcription := ""
-		for _, t := range transcriptions {
-			transcription += t + " "
-		}
-		transcription = strings.TrimSpace(transcription)
+	api := r.Group("/api", authMiddleware(authenticators))
+	// Routes calling OpenAI use the key selected for the request.
+	openaiRoutes := api.Group("", openAIClientMiddleware(openaiClient, openAIKeys, newOpenAIClient))
 
-		correctedTranscription, _ := correctTranscription(openaiClient, transcription, tokensForCompletion)
+	openaiRoutes.POST("/transcribe", webhooks.handler("transcription", transcribeHandler(openaiClient)))
 
-		response := gin.H{
-			"original_transcription": transcription,
-			"transcription":          correctedTranscription,
-			"transcriptions":         transcriptions,
-			"num_chunks":             len(chunks),
-		}
+	openaiRoutes.POST("/outline", webhooks.handler("outline", outlineHandler(openaiClient)))
+
+	openaiRoutes.POST("/outline/stream", webhooks.handler("outline", outlineStreamHandler(openaiClient)))
+
+	openaiRoutes.POST("/bulletpoints", webhooks.handler("bulletpoints", bulletpointsHandler(openaiClient)))
+
+	openaiRoutes.POST("/bulletpoints/stream", webhooks.handler("bulletpoints", bulletpointsStreamHandler(openaiClient)))
+
+	openaiRoutes.POST("/transform", transformHandler(openaiClient))
+
+	openaiRoutes.POST("/translate", translateHandler(openaiClient))
+
+	api.POST("/uploads", createUploadHandler(uploads))
+
+	api.GET("/uploads/:id", uploadStatusHandler(uploads))
+
+	api.PATCH("/uploads/:id", appendUploadHandler(uploads))
+
+	api.DELETE("/uploads/:id", deleteUploadHandler(uploads))
 
-		logEvent("transcription_completed", response)
+	openaiRoutes.POST("/uploads/:id/complete", webhooks.handler("transcription", completeUploadHandler(openaiClient, uploads)))
 
-		c.JSON(http.StatusOK, response)
+	api.GET("/usage", usageHandler())
+
+	api.GET("/webhooks/deliveries", webhookDeliveriesHandler(webhooks))
+
+	api.GET("/openai-key", openAIKeyHandler(openAIKeys))
+
+	api.PUT("/openai-key", storeOpenAIKeyHandler(openAIKeys))
+
+	api.DELETE("/openai-key", deleteOpenAIKeyHandler(openAIKeys))
+
+	if resumed := webhooks.Resume(r); resumed > 0 {
+		logEvent(context.Background(), slog.LevelInfo, "jobs_resumed", gin.H{
+			"count": resumed,
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	listener, err := net.Listen("tcp", loadListenAddr(os.Getenv))
+	if err != nil {
+		fatal("listen_failed", err)
+	}
+	if err := server.Serve(ctx, listener, r); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("server_failed", err)
+	}
+
+	// Webhook deliveries are not cancelled with their requests and get the timeout again to complete.
+	waitCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if !waitFor(waitCtx, webhooks.Wait) {
+		logEvent(context.Background(), slog.LevelWarn, "webhook_deliveries_abandoned", gin.H{})
+	}
+	logEvent(context.Background(), slog.LevelInfo, "shutdown_completed", gin.H{
+		"temp_dirs_removed": removeRequestTempDirs(),
 	})
+}
 
-	r.POST("/api/outline", func(c *gin.Context) {
-		// read body as JSON
-		var jsonBody map[string]string
-		err := c.BindJSON(&jsonBody)
-		if err != nil {
-			logEvent("invalid_json", gin.H{
-				"error": "Invalid JSON",
-				"data":  c.Request.Body,
-			})
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+func transcribeHandler(client OpenAIClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := requestClient(c, client)
+		defer client.save(c)
+		if abortOnQuotaError(c, client.checkQuota()) {
 			return
 		}
 
-		text := jsonBody["text"]
-		if text == "" {
-			logEvent("no_text_provided", gin.H{
-				"error": "No text provided",
-				"data":  c.Request.Body,
+		// All files of the request are kept in its own directory, which is removed however the request ends.
+		dir, err := newRequestTempDir()
+		if err != nil {
+			logEvent(c, slog.LevelError, "temp_dir_failed", gin.H{
+				"error": err.Error(),
 			})
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No text provided"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing upload"})
 			return
 		}
+		defer removeRequestTempDir(dir)
 
-		response, err := createOutline(openaiClient, text)
+		// JSON requests name a source to download the recording from instead of uploading it.
+		if c.ContentType() == gin.MIMEJSON {
+			request, path, err := receiveSource(c, dir)
+			if err != nil {
+				abortOnSourceError(c, err)
+				return
+			}
+			transcribeRecording(c, client, path, dir, request.PromptVersion, request.Language)
+			return
+		}
 
+		upload, err := receiveUpload(c, "audio", dir, maxUploadBytes)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating response"})
+			abortOnUploadError(c, err, maxUploadBytes)
 			return
 		}
+		observeUpload(uploadSourceMultipart, upload.Size)
+		logEvent(c, slog.LevelInfo, "upload_received", gin.H{
+			"size":   upload.Size,
+			"format": strings.TrimPrefix(filepath.Ext(upload.Path), "."),
+		})
 
-		c.JSON(http.StatusOK, gin.H{"response": response})
-	})
+		transcribeRecording(c, client, upload.Path, dir, upload.Fields["prompt_version"], upload.Fields["language"])
+	}
+}
 
-	r.POST("/api/bulletpoints", func(c *gin.Context) {
-		// read body as JSON
-		var jsonBody map[string]string
-		err := c.BindJSON(&jsonBody)
+// transcribeRecording splits the recording into chunks in dir, transcribes and corrects them and responds
+// with the transcription. It reports whether the transcription succeeded. The progress is checkpointed, so
+// a failed transcription of the recording resumes where it stopped when the recording is sent again.
+func transcribeRecording(c *gin.Context, client *usageClient, path, dir, promptVersion, language string) (completed bool) {
+	defer trackJob(jobKindTranscription)()
+
+	var err error
+	prompt := PromptSelection{
+		Version:  promptVersion,
+		Language: language,
+	}
+	if !promptStore.HasVersion(prompt.Version) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt version"})
+		return false
+	}
+	if prompt.Language != "" {
+		prompt.Language, err = normalizeLanguageCode(prompt.Language)
 		if err != nil {
-			logEvent("invalid_json", gin.H{
-				"error": "Invalid JSON",
-				"data":  c.Request.Body,
-			})
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
-			return
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid language"})
+			return false
 		}
+	}
 
-		text := jsonBody["text"]
-		if text == "" {
-			logEvent("no_text_provided", gin.H{
-				"error": "No text provided",
-				"data":  c.Request.Body,
-			})
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No text provided"})
-			return
+	ctx := c.Request.Context()
+	media, err := probeMedia(ctx, path)
+	if err != nil {
+		logEvent(c, slog.LevelWarn, "media_probe_failed", gin.H{
+			"error": err.Error(),
+		})
+		if errors.Is(err, ErrUnsupportedMediaType) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported file type, upload an audio or video file"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading recording"})
 		}
+		return false
+	}
+	if !media.HasAudio() {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "The recording has no audio"})
+		return false
+	}
+	logEvent(c, slog.LevelInfo, "media_probed", gin.H{
+		"format":           media.Format,
+		"codec":            media.Codec,
+		"duration_seconds": media.Duration.Seconds(),
+		"bit_rate":         media.BitRate,
+		"channels":         media.Channels,
+		"sample_rate":      media.SampleRate,
+		"streams":          len(media.Streams),
+	})
+	if abortOnQuotaError(c, client.checkRecordingQuota(media.Duration)) {
+		return false
+	}
 
-		response, err := createBulletpoints(openaiClient, text, tokensForCompletion)
+	checkpoint, err := checkpoints.Open(userID(c), path, prompt.Version, prompt.Language)
+	if err != nil {
+		logEvent(c, slog.LevelWarn, "checkpoint_failed", gin.H{
+			"error": err.Error(),
+		})
+	}
+	defer func() {
+		if err := checkpoint.Close(completed); err != nil {
+			logEvent(c, slog.LevelWarn, "checkpoint_failed", gin.H{
+				"checkpoint_id": checkpoint.ID(),
+				"error":         err.Error(),
+			})
+		}
+	}()
 
+	chunks, split := checkpoint.Chunks(path)
+	if split {
+		logEvent(c, slog.LevelInfo, "transcription_resumed", gin.H{
+			"checkpoint_id": checkpoint.ID(),
+			"num_chunks":    len(chunks),
+		})
+	} else {
+		chunkDir, err := checkpoint.ChunkDir(dir)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating response"})
-			return
+			logEvent(c, slog.LevelWarn, "checkpoint_failed", gin.H{
+				"checkpoint_id": checkpoint.ID(),
+				"error":         err.Error(),
+			})
+			chunkDir = dir
 		}
+		chunks, err = splitAudio(ctx, path, chunkDir, media)
+		if err != nil {
+			logEvent(c, slog.LevelWarn, "audio_split_failed", gin.H{
+				"error": err.Error(),
+			})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error splitting audio"})
+			return false
+		}
+		if err := checkpoint.SaveChunks(path, chunks); err != nil {
+			logEvent(c, slog.LevelWarn, "checkpoint_failed", gin.H{
+				"checkpoint_id": checkpoint.ID(),
+				"error":         err.Error(),
+			})
+		}
+	}
+	chunksPerRecording.Observe(float64(len(chunks)))
+
+	responses, err := transcribeChunks(ctx, client, chunks, prompt.Language, checkpoint)
+	if abortOnQuotaError(c, err) {
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error transcribing audio"})
+		return false
+	}
+
+	transcription := ""
+	transcriptions := make([]string, len(responses))
+	whisperLanguages := make([]string, len(responses))
+	for i, r := range responses {
+		transcription += r.Text + " "
+		transcriptions[i] = r.Text
+		whisperLanguages[i] = r.Language
+	}
+	transcription = strings.TrimSpace(transcription)
 
-		c.JSON(http.StatusOK, gin.H{"response": response})
+	detected := detectLanguage(ctx, client, transcription, prompt, whisperLanguages)
+	prompt.Language = detected.Code
+
+	correctedTranscription, err := correctTranscription(ctx, client, transcription, tokensForCompletion, prompt, checkpoint)
+	if abortOnQuotaError(c, err) {
+		return false
+	}
+
+	response := gin.H{
+		"original_transcription": transcription,
+		"transcription":          correctedTranscription,
+		"transcriptions":         transcriptions,
+		"num_chunks":             len(chunks),
+		"language":               detected,
+		"segments":               collectSegments(responses),
+		"usage":                  client.Usage(),
+	}
+
+	logEvent(c, slog.LevelInfo, "transcription_completed", gin.H{
+		"original_transcription": redact(transcription),
+		"transcription":          redact(correctedTranscription),
+		"num_chunks":             len(chunks),
+		"language":               detected.Code,
+		"usage":                  response["usage"],
 	})
 
-	r.Run()
+	c.JSON(http.StatusOK, response)
+	return true
 }
 
-func saveFile(src multipart.File, dstPath string) error {
-	data, err := ioutil.ReadAll(src)
+// saveFile copies src to a new file at dstPath without reading it into memory.
+func saveFile(src io.Reader, dstPath string) error {
+	dst, err := os.Create(dstPath)
 	if err != nil {
 		return err
 	}
-
-	return ioutil.WriteFile(dstPath, data, 0644)
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
 }
 
-func transcribeChunks(client OpenAIClient, chunkPaths []string) []string {
-	// Initialize a slice of string pointers with the same length as chunkPaths.
-	transcriptions := make([]*string, len(chunkPaths))
+// chunkTranscriber transcribes a single chunk.
+type chunkTranscriber func(ctx context.Context, chunkPath string) (openai.AudioResponse, error)
+
+// transcribeChunks transcribes all chunks in parallel. If language is not empty, it is passed to Whisper
+// as the language of the recording; otherwise Whisper detects the language of every chunk. Chunks stored
+// in the checkpoint are not transcribed again. If a chunk cannot be transcribed, one of the errors is
+// returned.
+func transcribeChunks(ctx context.Context, client OpenAIClient, chunkPaths []string, language string, checkpoint *Checkpoint) ([]openai.AudioResponse, error) {
+	transcribe := checkpoint.Transcriber(func(ctx context.Context, chunkPath string) (openai.AudioResponse, error) {
+		return transcribeChunk(ctx, client, chunkPath, language)
+	})
+
+	// Initialize a slice of response pointers with the same length as chunkPaths.
+	transcriptions := make([]*openai.AudioResponse, len(chunkPaths))
+	errs := make(chan error, len(chunkPaths))
 	// Create a WaitGroup to track the completion of all goroutines.
 	var wg sync.WaitGroup
 
@@ -187,65 +475,99 @@ func transcribeChunks(client OpenAIClient, chunkPaths []string) []string {
 			defer wg.Done()
 
 			// Log the processing event.
-			logEvent("processing_chunk", gin.H{"chunk_number": chunkNumber + 1})
+			logEvent(ctx, slog.LevelDebug, "processing_chunk", gin.H{"chunk_number": chunkNumber + 1})
 
 			// Call the transcribeChunk function and handle errors.
-			transcription, err := transcribeChunk(client, chunkPath)
+			transcription, err := transcribe(ctx, chunkPath)
 			if err != nil {
-				log.Println("transcribe_chunk_error:", err)
+				logEvent(ctx, slog.LevelError, "chunk_transcription_failed", gin.H{
+					"chunk_number": chunkNumber + 1,
+					"error":        err.Error(),
+				})
+				errs <- err
 				return
 			}
 
 			// Assign the transcription directly to its respective index in the transcriptions slice.
 			transcriptions[chunkNumber] = &transcription
-			// Remove the chunk file.
-			os.Remove(chunkPath)
 		}(i, chunkPath) // Pass the index and chunkPath as arguments to the goroutine.
 	}
 
 	// Wait for all goroutines to complete.
 	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
 
-	// Convert the []*string transcriptions to []string.
-	orderedTranscriptions := make([]string, len(transcriptions))
+	// Convert the []*openai.AudioResponse transcriptions to []openai.AudioResponse.
+	orderedTranscriptions := make([]openai.AudioResponse, len(transcriptions))
 	for i, transcription := range transcriptions {
 		orderedTranscriptions[i] = *transcription
 	}
 
-	return orderedTranscriptions
+	return orderedTranscriptions, nil
 }
 
-func transcribeChunk(client OpenAIClient, chunkPath string) (string, error) {
-	var transcription string
+// transcribeChunk transcribes the chunk with Whisper, retrying failed attempts. Transcriptions of the same
+// audio with the same settings are answered from the result cache.
+func transcribeChunk(ctx context.Context, client OpenAIClient, chunkPath string, language string) (openai.AudioResponse, error) {
+	req := openai.AudioRequest{
+		Model:    openai.Whisper1,
+		FilePath: chunkPath,
+		Format:   openai.AudioResponseFormatVerboseJSON,
+	}
+	if language != "" {
+		req.Language = whisperLanguageCode(language)
+	}
+	return cached(ctx, cacheKindWhisper, whisperCacheKey(req), func() (openai.AudioResponse, error) {
+		return createTranscription(ctx, client, req)
+	})
+}
+
+func createTranscription(ctx context.Context, client OpenAIClient, req openai.AudioRequest) (openai.AudioResponse, error) {
+	var transcription openai.AudioResponse
 	var err error
+	chunkPath := req.FilePath
 
 	for retries := 0; retries < maxRetries; retries++ {
-		ctx := context.Background()
-
-		req := openai.AudioRequest{
-			Model:    openai.Whisper1,
-			FilePath: chunkPath,
+		logEvent(ctx, slog.LevelDebug, "transcribing_chunk", gin.H{"chunk_path": chunkPath})
+		if retries > 0 {
+			whisperRetries.Inc()
+		}
+		attemptCtx, span := startSpan(ctx, "transcribe_chunk",
+			attribute.String("audio.chunk", filepath.Base(chunkPath)),
+			attribute.Int("whisper.attempt", retries+1),
+		)
+		start := time.Now()
+		transcription, err = client.CreateTranscription(attemptCtx, req)
+		endSpan(span, err)
+		if errors.Is(err, ErrQuotaExceeded) {
+			break
 		}
-		logEvent("transcribing_chunk", gin.H{"chunk_path": chunkPath})
-		resp, err := client.CreateTranscription(ctx, req)
+		whisperRequestDuration.WithLabelValues(metricsResult(err)).Observe(time.Since(start).Seconds())
 		if err == nil {
-			transcription = resp.Text
+			audioProcessed.Add(transcription.Duration)
 			break
 		}
 
-		logEvent("transcription_failed", gin.H{
+		logEvent(ctx, slog.LevelWarn, "transcription_failed", gin.H{
 			"retry":       retries + 1,
 			"max_retries": maxRetries,
 			"error":       err.Error(),
 		})
 
-		time.Sleep(retryDelay)
+		select {
+		case <-ctx.Done():
+			return transcription, ctx.Err()
+		case <-time.After(retryDelay):
+		}
 	}
 
 	return transcription, err
 }
 
-type TextProcessor func(part string) (string, error)
+type TextProcessor func(ctx context.Context, part string) (string, error)
 
 type TextProcessingOptions struct {
 	Client    OpenAIClient
@@ -255,18 +577,33 @@ type TextProcessingOptions struct {
 	Processor TextProcessor
 }
 
-func processTextInParallel(options TextProcessingOptions) (string, error) {
-	splitText := splitLongString(options.Text, options.MaxTokens)
+func processTextInParallel(ctx context.Context, options TextProcessingOptions) (string, error) {
+	results, err := processPartsInParallel(ctx, splitLongString(options.Text, options.MaxTokens), options.Processor)
+	if err != nil {
+		return "", err
+	}
 
+	return strings.TrimSpace(strings.Join(results, options.JoinSep)), nil
+}
+
+// processPartsInParallel runs the processor on every part concurrently and returns the results in the
+// order of the parts. Every part is processed in a span of its own, which the processor receives in ctx. If
+// any part fails, one of the errors is returned.
+func processPartsInParallel[P, T any](ctx context.Context, parts []P, processor func(ctx context.Context, part P) (T, error)) ([]T, error) {
 	var wg sync.WaitGroup
-	results := make([]string, len(splitText))
-	errors := make(chan error, len(splitText))
+	results := make([]T, len(parts))
+	errors := make(chan error, len(parts))
 
-	for i, part := range splitText {
+	for i, part := range parts {
 		wg.Add(1)
-		go func(i int, part string) {
+		go func(i int, part P) {
 			defer wg.Done()
-			result, err := options.Processor(part)
+			partCtx, span := startSpan(ctx, "process_part",
+				attribute.Int("part.index", i),
+				attribute.Int("part.count", len(parts)),
+			)
+			result, err := processor(partCtx, part)
+			endSpan(span, err)
 			if err != nil {
 				errors <- err
 			} else {
@@ -280,155 +617,36 @@ func processTextInParallel(options TextProcessingOptions) (string, error) {
 
 	if len(errors) > 0 {
 		err := <-errors
-		logEvent("completion_failed", gin.H{
+		logEvent(ctx, slog.LevelError, "completion_failed", gin.H{
 			"error": err.Error(),
 		})
-		return "", err
+		return nil, err
 	}
 
-	return strings.TrimSpace(strings.Join(results, options.JoinSep)), nil
+	return results, nil
 }
 
-func correctTranscription(client OpenAIClient, transcription string, maxTokens int) (string, error) {
-	return processTextInParallel(TextProcessingOptions{
+// correctTranscription corrects the parts of the transcription in parallel. Parts stored in the checkpoint
+// are not corrected again.
+func correctTranscription(ctx context.Context, client OpenAIClient, transcription string, maxTokens int, selection PromptSelection, checkpoint *Checkpoint) (string, error) {
+	correct := checkpoint.Corrector(func(ctx context.Context, prompt string) (string, error) {
+		return createCompletion(ctx, client, promptCorrection, prompt, maxTokens)
+	})
+
+	return processTextInParallel(ctx, TextProcessingOptions{
 		Client:    client,
 		Text:      transcription,
 		MaxTokens: maxTokens,
 		JoinSep:   " ",
-		Processor: func(part string) (string, error) {
-			prompt := fmt.Sprintf("Correct the errors from the following audio transcription and add proper formatting. Also correct grammar errors. Just output the corrected text in its original language:\n%s\n\nCorrected text:", part)
-			logEvent("completing_transcription", gin.H{
-				"prompt": prompt,
-			})
-			resp, err := client.CreateChatCompletion(
-				context.Background(),
-				openai.ChatCompletionRequest{
-					Model:     openai.GPT4oLatest,
-					MaxTokens: 16384 - maxTokens,
-					Messages: []openai.ChatCompletionMessage{
-						{
-							Role:    openai.ChatMessageRoleUser,
-							Content: prompt,
-						},
-					},
-				},
-			)
+		Processor: func(ctx context.Context, part string) (string, error) {
+			prompt, err := promptStore.Render(promptCorrection, selection, selection.data(part))
 			if err != nil {
 				return "", err
 			}
-			return strings.TrimSpace(resp.Choices[0].Message.Content), nil
-		},
-	})
-}
-
-func createBulletpoints(client OpenAIClient, text string, maxTokens int) (string, error) {
-	return processTextInParallel(TextProcessingOptions{
-		Client:    client,
-		Text:      text,
-		MaxTokens: maxTokens,
-		JoinSep:   "\n",
-		Processor: func(part string) (string, error) {
-			logEvent("creating_bulletpoints", gin.H{
-				"part": part,
+			logEvent(ctx, slog.LevelDebug, "completing_transcription", gin.H{
+				"prompt": redact(prompt),
 			})
-			prompt := fmt.Sprintf("Turn the following text into bulletpoints:\n%s\n\nBulletpoints:", part)
-			resp, err := client.CreateChatCompletion(
-				context.Background(),
-				openai.ChatCompletionRequest{
-					Model:     openai.GPT4oLatest,
-					MaxTokens: 16384 - maxTokens,
-					Messages: []openai.ChatCompletionMessage{
-						{
-							Role:    openai.ChatMessageRoleUser,
-							Content: prompt,
-						},
-					},
-				},
-			)
-			if err != nil {
-				return "", err
-			}
-			return strings.TrimSpace(resp.Choices[0].Message.Content), nil
-		},
-	})
-}
-
-func createOutline(client OpenAIClient, text string) (string, error) {
-
-	language := determineLanguage(client, text)
-
-	prompt := fmt.Sprintf("Create a %s speaker outline based on the following script in the language of the script. The outline shall be detailed enough so it can be used to give a talk right away. The outline must be in the same language as the script. \nSTART SCRIPT\n%s\nEND SCRIPT\n\nOutline:", language, text)
-	logEvent("creating_outline", gin.H{
-		"prompt": prompt,
-	})
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: openai.GPT4oLatest,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: prompt,
-				},
-			},
+			return correct(ctx, prompt)
 		},
-	)
-
-	if err != nil {
-		logEvent("completion_failed", gin.H{
-			"error": err.Error(),
-		})
-		return "", err
-	}
-
-	outline := strings.TrimSpace(resp.Choices[0].Message.Content)
-
-	logEvent("outline_created", gin.H{
-		"outline": outline,
 	})
-	return outline, nil
-}
-
-// determineLanguage returns the language of the given text using OpenAI's language model
-func determineLanguage(client OpenAIClient, text string) string {
-
-	// take the first 1000 characters of the text
-	if len(text) > 1000 {
-		text = text[:1000]
-	}
-
-	prompt := fmt.Sprintf("Determine the language of the following text. Do not output any other characters than the language itself:\n%s\n\nLanguage:", text)
-
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: openai.GPT4oMini,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: prompt,
-				},
-			},
-		},
-	)
-
-	language := strings.TrimSpace(resp.Choices[0].Message.Content)
-
-	if err != nil {
-		logEvent("language_detection_failed", gin.H{
-			"error": err.Error(),
-		})
-		return "English"
-	}
-	return language
-}
-
-func logEvent(eventType string, data gin.H) {
-	logData := gin.H{
-		"event_type": eventType,
-		"timestamp":  time.Now(),
-		"data":       data,
-	}
-	logJSON, _ := json.Marshal(logData)
-	fmt.Println(string(logJSON))
 }
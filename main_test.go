@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	openai "github.com/sashabaranov/go-openai"
 	"github.com/stretchr/testify/assert"
@@ -33,6 +34,37 @@ func (m *mockOpenAIClient) CreateChatCompletion(ctx context.Context, request ope
 	}, nil
 }
 
+func (m *mockOpenAIClient) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (stream *openai.ChatCompletionStream, err error) {
+	return nil, errors.New("streaming is not supported by the mock")
+}
+
+// unavailableWhisperClient fails every transcription and cancels the context of the request when it is
+// first called.
+type unavailableWhisperClient struct {
+	mockOpenAIClient
+
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (m *unavailableWhisperClient) CreateTranscription(ctx context.Context, request openai.AudioRequest) (openai.AudioResponse, error) {
+	m.calls++
+	m.cancel()
+	return openai.AudioResponse{}, errors.New("whisper is unavailable")
+}
+
+func TestCreateTranscription_StopsRetryingWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &unavailableWhisperClient{cancel: cancel}
+
+	start := time.Now()
+	_, err := createTranscription(ctx, client, openai.AudioRequest{FilePath: "chunk.mp3"})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, client.calls)
+	assert.Less(t, time.Since(start), retryDelay)
+}
+
 func TestSaveFile(t *testing.T) {
 	file := createDummyMP3File(t)
 	defer os.Remove(file.Name())
@@ -48,18 +80,19 @@ func TestSaveFile(t *testing.T) {
 func TestTranscribeChunks(t *testing.T) {
 	chunks := []string{"chunk1.mp3", "chunk2.mp3"}
 	mockClient := &mockOpenAIClient{}
-	transcriptions := transcribeChunks(mockClient, chunks)
+	transcriptions, err := transcribeChunks(context.Background(), mockClient, chunks, "", nil)
+	require.NoError(t, err)
 	assert.Len(t, transcriptions, len(chunks))
 
 	for _, transcription := range transcriptions {
-		assert.Equal(t, "mock transcription", transcription)
+		assert.Equal(t, "mock transcription", transcription.Text)
 	}
 }
 
 func TestCorrectTranscription(t *testing.T) {
 	transcription := "mock transcription"
 	mockClient := &mockOpenAIClient{}
-	correctedTranscription, err := correctTranscription(mockClient, transcription, tokensForCompletion)
+	correctedTranscription, err := correctTranscription(context.Background(), mockClient, transcription, tokensForCompletion, PromptSelection{}, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, "mock corrected transcription", strings.TrimSpace(correctedTranscription))
 }
@@ -88,7 +121,7 @@ func TestProcessTextInParallel(t *testing.T) {
 				Text:      "This is a test. This is only a test.",
 				MaxTokens: 10,
 				JoinSep:   " ",
-				Processor: func(part string) (string, error) {
+				Processor: func(ctx context.Context, part string) (string, error) {
 					return strings.ToUpper(part), nil
 				},
 			},
@@ -101,7 +134,7 @@ func TestProcessTextInParallel(t *testing.T) {
 				Text:      "This is a test. This is only a test.",
 				MaxTokens: 10,
 				JoinSep:   " ",
-				Processor: func(part string) (string, error) {
+				Processor: func(ctx context.Context, part string) (string, error) {
 					return "", errors.New("an error occurred")
 				},
 			},
@@ -112,7 +145,7 @@ func TestProcessTextInParallel(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result, err := processTextInParallel(tc.options)
+			result, err := processTextInParallel(context.Background(), tc.options)
 			assert.Equal(t, tc.expectedResult, result)
 			if tc.expectedErr != nil {
 				assert.EqualError(t, err, tc.expectedErr.Error())
@@ -128,7 +161,7 @@ func TestProcessTextInParallelMultipleCalls(t *testing.T) {
 	var counterMutex sync.Mutex
 
 	// TextProcessor function that increments the call counter
-	testProcessor := func(part string) (string, error) {
+	testProcessor := func(ctx context.Context, part string) (string, error) {
 		counterMutex.Lock()
 		callCounter++
 		counterMutex.Unlock()
@@ -142,7 +175,7 @@ func TestProcessTextInParallelMultipleCalls(t *testing.T) {
 		Processor: testProcessor,
 	}
 
-	_, err := processTextInParallel(options)
+	_, err := processTextInParallel(context.Background(), options)
 	assert.NoError(t, err)
 
 	assert.Greater(t, callCounter, 1, "TextProcessor should be called multiple times")
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	metricsNamespace = "talktailor"
+
+	// Sources of recordings in the uploads metrics.
+	uploadSourceMultipart = "multipart"
+	uploadSourceResumable = "resumable"
+	uploadSourceDownload  = "download"
+
+	// Kinds of jobs in the jobs_in_progress metric.
+	jobKindTranscription   = "transcription"
+	jobKindWebhookJob      = "webhook_job"
+	jobKindWebhookDelivery = "webhook_delivery"
+)
+
+// metricsRegistry holds all metrics served by /metrics. A registry of its own keeps the metrics of the
+// server separate from those registered by libraries.
+var metricsRegistry = prometheus.NewRegistry()
+
+var metricsFactory = promauto.With(metricsRegistry)
+
+var (
+	httpRequests = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route and status code.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by route.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"method", "route"})
+
+	uploadsReceived = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_total",
+		Help:      "Recordings received by source: multipart, resumable or download.",
+	}, []string{"source"})
+	uploadSizeBytes = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_size_bytes",
+		Help:      "Size of received recordings by source.",
+		Buckets:   prometheus.ExponentialBuckets(1<<20, 2, 10),
+	}, []string{"source"})
+
+	audioProcessed = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audio_processed_seconds_total",
+		Help:      "Duration of the audio transcribed by Whisper.",
+	})
+	chunksPerRecording = metricsFactory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "chunks_per_recording",
+		Help:      "Number of chunks recordings are split into.",
+		Buckets:   []float64{1, 2, 3, 4, 6, 8, 12, 16, 24, 32},
+	})
+	whisperRequestDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "whisper_request_duration_seconds",
+		Help:      "Duration of every attempt to transcribe a chunk by result: ok or error.",
+		Buckets:   []float64{1, 5, 10, 20, 30, 60, 90, 120, 180, 300},
+	}, []string{"result"})
+	whisperRetries = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "whisper_retries_total",
+		Help:      "Retried attempts to transcribe a chunk.",
+	})
+
+	llmRequestDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "llm_request_duration_seconds",
+		Help:      "Duration of chat completions by task, model and result: ok or error.",
+		Buckets:   []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"task", "model", "result"})
+	llmTokens = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "llm_tokens_total",
+		Help:      "Tokens of chat completions by task, model and type: prompt or completion.",
+	}, []string{"task", "model", "type"})
+
+	ffmpegDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ffmpeg_duration_seconds",
+		Help:      "Duration of ffmpeg and ffprobe runs by operation and result: ok or error.",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120},
+	}, []string{"operation", "result"})
+
+	cacheRequests = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_requests_total",
+		Help:      "Lookups of cached results by kind, whisper or chat, and result: hit or miss.",
+	}, []string{"kind", "result"})
+
+	jobsInProgress = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_in_progress",
+		Help:      "Jobs being processed by kind: transcription or webhook_delivery. Jobs are started as requests arrive, so this is the depth of the work queue.",
+	}, []string{"kind"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// metricsMiddleware counts requests and measures their duration. Requests without a route, such as those
+// for static files, are counted with the route "unmatched".
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeUpload records a received recording.
+func observeUpload(source string, size int64) {
+	uploadsReceived.WithLabelValues(source).Inc()
+	uploadSizeBytes.WithLabelValues(source).Observe(float64(size))
+}
+
+// observeLLMCall records the duration and tokens of a chat completion started at start. Requests rejected
+// by a quota never reached OpenAI and are not recorded.
+func observeLLMCall(task, model string, start time.Time, usage *openai.Usage, err error) {
+	if errors.Is(err, ErrQuotaExceeded) {
+		return
+	}
+	llmRequestDuration.WithLabelValues(task, model, metricsResult(err)).Observe(time.Since(start).Seconds())
+	if usage != nil {
+		llmTokens.WithLabelValues(task, model, "prompt").Add(float64(usage.PromptTokens))
+		llmTokens.WithLabelValues(task, model, "completion").Add(float64(usage.CompletionTokens))
+	}
+}
+
+// observeFFmpeg records the duration of an ffmpeg run started at start.
+func observeFFmpeg(operation string, start time.Time, err error) {
+	ffmpegDuration.WithLabelValues(operation, metricsResult(err)).Observe(time.Since(start).Seconds())
+}
+
+// trackJob counts a job as in progress until the returned function is called.
+func trackJob(kind string) func() {
+	jobsInProgress.WithLabelValues(kind).Inc()
+	return jobsInProgress.WithLabelValues(kind).Dec
+}
+
+func metricsResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(metricsMiddleware())
+	r.GET("/metrics", metricsHandler())
+	r.GET("/api/ping", func(c *gin.Context) { c.Status(http.StatusTeapot) })
+
+	before := testutil.ToFloat64(httpRequests.WithLabelValues(http.MethodGet, "/api/ping", "418"))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/ping", nil))
+	assert.Equal(t, before+1, testutil.ToFloat64(httpRequests.WithLabelValues(http.MethodGet, "/api/ping", "418")))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	body, _ := io.ReadAll(w.Body)
+	assert.Contains(t, string(body), `talktailor_http_requests_total{method="GET",route="/api/ping",status="418"}`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
+
+func TestMetrics_Pipeline(t *testing.T) {
+	client := &usageMockClient{chatFuncClient{complete: func(prompt string) string { return "answer" }}}
+
+	audioBefore := testutil.ToFloat64(audioProcessed)
+	_, err := transcribeChunks(context.Background(), client, []string{"chunk1.mp3", "chunk2.mp3"}, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, audioBefore+180, testutil.ToFloat64(audioProcessed))
+	assert.GreaterOrEqual(t, testutil.CollectAndCount(whisperRequestDuration), 1)
+
+	prompt := llmTokens.WithLabelValues("summary", openai.GPT4oLatest, "prompt")
+	completion := llmTokens.WithLabelValues("summary", openai.GPT4oLatest, "completion")
+	promptBefore, completionBefore := testutil.ToFloat64(prompt), testutil.ToFloat64(completion)
+	_, err = createCompletion(context.Background(), client, "summary", "prompt", 100)
+	require.NoError(t, err)
+	assert.Equal(t, promptBefore+1000, testutil.ToFloat64(prompt))
+	assert.Equal(t, completionBefore+200, testutil.ToFloat64(completion))
+}
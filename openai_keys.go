@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	headerOpenAIKey = "X-OpenAI-API-Key"
+	openAIKeysFile  = "openai_keys.json"
+
+	// contextKeyOpenAIClient is the key of the OpenAIClient of the request in the gin context.
+	contextKeyOpenAIClient = "openai_client"
+	// contextKeyOpenAIKeySource is the key of the source of the OpenAI key in the gin context.
+	contextKeyOpenAIKeySource = "openai_key_source"
+
+	// keySourceServer marks requests using the server's OPENAI_API_KEY.
+	keySourceServer = "server"
+	// keySourceUser marks requests using a key supplied by the user.
+	keySourceUser = "user"
+)
+
+var (
+	ErrInvalidEncryptionKey = errors.New("encryption key must be 32 bytes, base64 encoded")
+	ErrOpenAIKeyCorrupted   = errors.New("stored OpenAI key cannot be decrypted")
+)
+
+// newOpenAIClient returns a client for the OpenAI API that authenticates with the given key.
+func newOpenAIClient(key string) OpenAIClient {
+	clientConfig := openai.DefaultConfig(key)
+	clientConfig.HTTPClient = retryablehttp.NewClient().HTTPClient
+	return openai.NewClientWithConfig(clientConfig)
+}
+
+// OpenAIKeyStore stores the OpenAI keys of users encrypted with AES-GCM in a JSON file.
+type OpenAIKeyStore struct {
+	mu   sync.Mutex
+	path string
+	aead cipher.AEAD
+}
+
+// openOpenAIKeyStore returns a store writing to openai_keys.json in the data directory. The encryption
+// key is a base64 encoded 32 byte key.
+func openOpenAIKeyStore(dataDir, encryptionKey string) (*OpenAIKeyStore, error) {
+	key, err := base64.StdEncoding.DecodeString(encryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &OpenAIKeyStore{path: filepath.Join(dataDir, openAIKeysFile), aead: aead}, nil
+}
+
+// Get returns the key of the user and whether the user has stored one.
+func (s *OpenAIKeyStore) Get(user string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, err := s.read()
+	if err != nil {
+		return "", false, err
+	}
+	encrypted, ok := keys[user]
+	if !ok {
+		return "", false, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", false, ErrOpenAIKeyCorrupted
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	// The user is authenticated data, so a key cannot be copied to another user in the file.
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(user))
+	if err != nil {
+		return "", false, ErrOpenAIKeyCorrupted
+	}
+	return string(plaintext), true, nil
+}
+
+// Set stores the key of the user, replacing a stored key.
+func (s *OpenAIKeyStore) Set(user, key string) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(key), []byte(user))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, err := s.read()
+	if err != nil {
+		return err
+	}
+	keys[user] = base64.StdEncoding.EncodeToString(sealed)
+	return s.write(keys)
+}
+
+// Delete removes the key of the user.
+func (s *OpenAIKeyStore) Delete(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, err := s.read()
+	if err != nil {
+		return err
+	}
+	delete(keys, user)
+	return s.write(keys)
+}
+
+// read returns the encrypted keys by user. The caller must hold s.mu.
+func (s *OpenAIKeyStore) read() (map[string]string, error) {
+	keys := map[string]string{}
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", s.path, err)
+	}
+	return keys, nil
+}
+
+// write replaces the file with the encrypted keys. The caller must hold s.mu.
+func (s *OpenAIKeyStore) write(keys map[string]string) error {
+	content, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// openAIClientMiddleware selects the OpenAI key of the request: the key of the X-OpenAI-API-Key header,
+// the key the user stored, or the server key as a fallback. The client for the key is stored in the
+// context and used by requestClient. serverClient is nil if the server has no key of its own, and keys
+// is nil if users cannot store keys.
+func openAIClientMiddleware(serverClient OpenAIClient, keys *OpenAIKeyStore, newClient func(string) OpenAIClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(c.GetHeader(headerOpenAIKey))
+		if key == "" && keys != nil && c.GetString(contextKeyUser) != "" {
+			stored, ok, err := keys.Get(c.GetString(contextKeyUser))
+			if err != nil {
+				logEvent(c, slog.LevelError, "openai_key_lookup_failed", gin.H{
+					"user":  userID(c),
+					"error": err.Error(),
+				})
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Error reading the stored OpenAI API key"})
+				return
+			}
+			if ok {
+				key = stored
+			}
+		}
+
+		switch {
+		case key != "":
+			c.Set(contextKeyOpenAIClient, newClient(key))
+			c.Set(contextKeyOpenAIKeySource, keySourceUser)
+		case serverClient != nil:
+			c.Set(contextKeyOpenAIClient, serverClient)
+			c.Set(contextKeyOpenAIKeySource, keySourceServer)
+		default:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "OpenAI API key required: send it in the " + headerOpenAIKey + " header or store it with PUT /api/openai-key",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requestClient returns a usage accounting client for the request. It uses the client selected by
+// openAIClientMiddleware, or the given client if the middleware did not run.
+func requestClient(c *gin.Context, client OpenAIClient) *usageClient {
+	source := keySourceServer
+	if selected, ok := c.Get(contextKeyOpenAIClient); ok {
+		client = selected.(OpenAIClient)
+		source = c.GetString(contextKeyOpenAIKeySource)
+	}
+	usage := newUsageClient(client, userID(c))
+	usage.keySource = source
+	return usage
+}
+
+// OpenAIKeyRequest is the JSON body of PUT /api/openai-key.
+type OpenAIKeyRequest struct {
+	APIKey string `json:"api_key" binding:"required"`
+}
+
+// openAIKeyHandler returns whether the user stored an OpenAI key, with only the last characters of the key.
+func openAIKeyHandler(keys *OpenAIKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := keyStoreUser(c, keys)
+		if !ok {
+			return
+		}
+		key, stored, err := keys.Get(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading the stored OpenAI API key"})
+			return
+		}
+		response := gin.H{"stored": stored}
+		if stored {
+			response["key_hint"] = "..." + key[max(0, len(key)-4):]
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// storeOpenAIKeyHandler stores the OpenAI key of the user.
+func storeOpenAIKeyHandler(keys *OpenAIKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := keyStoreUser(c, keys)
+		if !ok {
+			return
+		}
+		var request OpenAIKeyRequest
+		if err := c.ShouldBindJSON(&request); err != nil || strings.TrimSpace(request.APIKey) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: api_key is required"})
+			return
+		}
+		if err := keys.Set(user, strings.TrimSpace(request.APIKey)); err != nil {
+			logEvent(c, slog.LevelError, "openai_key_store_failed", gin.H{
+				"user":  user,
+				"error": err.Error(),
+			})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing the OpenAI API key"})
+			return
+		}
+		logEvent(c, slog.LevelInfo, "openai_key_stored", gin.H{
+			"user": user,
+		})
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// deleteOpenAIKeyHandler removes the OpenAI key of the user.
+func deleteOpenAIKeyHandler(keys *OpenAIKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := keyStoreUser(c, keys)
+		if !ok {
+			return
+		}
+		if err := keys.Delete(user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting the OpenAI API key"})
+			return
+		}
+		logEvent(c, slog.LevelInfo, "openai_key_deleted", gin.H{
+			"user": user,
+		})
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// keyStoreUser returns the authenticated user, or responds with an error if keys cannot be stored.
+// Keys are only stored for authenticated users, as users identified by their IP address may share it.
+func keyStoreUser(c *gin.Context, keys *OpenAIKeyStore) (string, bool) {
+	if keys == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Storing OpenAI API keys is not configured"})
+		return "", false
+	}
+	user := c.GetString(contextKeyUser)
+	if user == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Storing OpenAI API keys requires authentication"})
+		return "", false
+	}
+	return user, true
+}
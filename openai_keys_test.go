@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEncryptionKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func TestOpenAIKeyStore(t *testing.T) {
+	_, err := openOpenAIKeyStore(t.TempDir(), "c2hvcnQ=")
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+
+	dir := t.TempDir()
+	store, err := openOpenAIKeyStore(dir, testEncryptionKey)
+	require.NoError(t, err)
+
+	_, ok, err := store.Get("alice")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.Set("alice", "sk-alice-secret"))
+	require.NoError(t, store.Set("bob", "sk-bob-secret"))
+	key, ok, err := store.Get("alice")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "sk-alice-secret", key)
+
+	content, err := os.ReadFile(filepath.Join(dir, openAIKeysFile))
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "sk-alice-secret", "keys are encrypted at rest")
+
+	// a key copied to another user does not decrypt
+	swapped := strings.Replace(string(content), `"bob"`, `"mallory"`, 1)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, openAIKeysFile), []byte(swapped), 0o600))
+	_, _, err = store.Get("mallory")
+	assert.ErrorIs(t, err, ErrOpenAIKeyCorrupted)
+
+	otherKey := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	other, err := openOpenAIKeyStore(dir, otherKey)
+	require.NoError(t, err)
+	_, _, err = other.Get("alice")
+	assert.ErrorIs(t, err, ErrOpenAIKeyCorrupted)
+
+	require.NoError(t, store.Delete("alice"))
+	_, ok, err = store.Get("alice")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// keyRecordingClient remembers the OpenAI key it was created for.
+type keyRecordingClient struct {
+	chatFuncClient
+	key string
+}
+
+func TestOpenAIClientMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, err := openOpenAIKeyStore(t.TempDir(), testEncryptionKey)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("alice", "sk-stored"))
+
+	newRouter := func(serverClient OpenAIClient) *gin.Engine {
+		r := gin.New()
+		r.Use(func(c *gin.Context) {
+			if user := c.GetHeader("X-Test-User"); user != "" {
+				c.Set(contextKeyUser, user)
+			}
+		})
+		newClient := func(key string) OpenAIClient { return &keyRecordingClient{key: key} }
+		r.POST("/api/outline", openAIClientMiddleware(serverClient, store, newClient), func(c *gin.Context) {
+			client := requestClient(c, nil)
+			key := "server"
+			if recording, ok := client.OpenAIClient.(*keyRecordingClient); ok {
+				key = recording.key
+			}
+			c.String(http.StatusOK, client.keySource+" "+key)
+		})
+		return r
+	}
+	serve := func(r *gin.Engine, user, key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/outline", nil)
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		if key != "" {
+			req.Header.Set(headerOpenAIKey, key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	withServerKey := newRouter(&chatFuncClient{})
+	assert.Equal(t, "user sk-header", serve(withServerKey, "alice", "sk-header").Body.String())
+	assert.Equal(t, "user sk-stored", serve(withServerKey, "alice", "").Body.String())
+	assert.Equal(t, "server server", serve(withServerKey, "bob", "").Body.String())
+
+	withoutServerKey := newRouter(nil)
+	assert.Equal(t, "user sk-header", serve(withoutServerKey, "", "sk-header").Body.String())
+	assert.Equal(t, "user sk-stored", serve(withoutServerKey, "alice", "").Body.String())
+	assert.Equal(t, http.StatusUnauthorized, serve(withoutServerKey, "bob", "").Code)
+}
+
+func TestOpenAIKeyHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, err := openOpenAIKeyStore(t.TempDir(), testEncryptionKey)
+	require.NoError(t, err)
+
+	newRouter := func(keys *OpenAIKeyStore) *gin.Engine {
+		r := gin.New()
+		r.Use(func(c *gin.Context) {
+			if user := c.GetHeader("X-Test-User"); user != "" {
+				c.Set(contextKeyUser, user)
+			}
+		})
+		r.GET("/api/openai-key", openAIKeyHandler(keys))
+		r.PUT("/api/openai-key", storeOpenAIKeyHandler(keys))
+		r.DELETE("/api/openai-key", deleteOpenAIKeyHandler(keys))
+		return r
+	}
+	serve := func(r *gin.Engine, method, user, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/api/openai-key", strings.NewReader(body))
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	r := newRouter(store)
+	assert.Equal(t, http.StatusForbidden, serve(r, "PUT", "", `{"api_key": "sk-anonymous"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(r, "PUT", "alice", `{}`).Code)
+	assert.Equal(t, http.StatusNoContent, serve(r, "PUT", "alice", `{"api_key": "sk-alice-1234"}`).Code)
+	assert.JSONEq(t, `{"stored": true, "key_hint": "...1234"}`, serve(r, "GET", "alice", "").Body.String())
+	assert.Equal(t, http.StatusNoContent, serve(r, "DELETE", "alice", "").Code)
+	assert.JSONEq(t, `{"stored": false}`, serve(r, "GET", "alice", "").Body.String())
+
+	assert.Equal(t, http.StatusNotImplemented, serve(newRouter(nil), "GET", "alice", "").Code)
+}
+
+func TestUsageClient_UserKeySkipsQuota(t *testing.T) {
+	withQuotas(t, QuotaLimits{TokensPerDay: 1})
+	quotaTracker.Add("alice", time.Now(), Usage{PromptTokens: 10})
+
+	client := newUsageClient(&chatFuncClient{}, "alice")
+	assert.ErrorIs(t, client.checkQuota(), ErrQuotaExceeded)
+	client.keySource = keySourceUser
+	assert.NoError(t, client.checkQuota())
+}
+
+func TestQuotaTrackerLoad_SkipsUserKeys(t *testing.T) {
+	now := time.Now()
+	tracker := newQuotaTracker()
+	tracker.Load([]UsageRecord{
+		{Time: now, User: "alice", KeySource: keySourceServer, Usage: Usage{PromptTokens: 10}},
+		{Time: now, User: "alice", KeySource: keySourceUser, Usage: Usage{PromptTokens: 1000}},
+	}, now)
+	day, _ := tracker.Usage("alice", now)
+	assert.Equal(t, 10, day.Tokens)
+}
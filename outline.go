@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	promptOutlinePart  = "outline_part"
+	promptOutlineMerge = "outline_merge"
+
+	// outlineModeAuto creates the outline in a single request if the text fits into the token budget
+	// and falls back to map-reduce otherwise.
+	outlineModeAuto = "auto"
+	// outlineModeSingle sends the whole text in a single request.
+	outlineModeSingle = "single"
+	// outlineModeMapReduce outlines every part of the text separately and merges the partial outlines.
+	outlineModeMapReduce = "map_reduce"
+
+	gpt4oContextWindow      = 128000
+	outlineCompletionTokens = 8192
+	outlinePartTokens       = 16000
+)
+
+var ErrTokenBudgetExceeded = errors.New("prompt exceeds the token budget")
+
+// OutlineOptions controls how createOutline splits the text and how many tokens a single prompt may use.
+type OutlineOptions struct {
+	Mode string
+	// TokenBudget is the maximum number of tokens of a single prompt.
+	TokenBudget int
+	// PartTokens is the maximum number of tokens of a text part in map-reduce mode.
+	PartTokens int
+	// CompletionTokens is the maximum number of tokens the model may generate per request.
+	CompletionTokens int
+}
+
+var defaultOutlineOptions = OutlineOptions{
+	Mode:             outlineModeAuto,
+	TokenBudget:      gpt4oContextWindow - outlineCompletionTokens,
+	PartTokens:       outlinePartTokens,
+	CompletionTokens: outlineCompletionTokens,
+}
+
+// OutlineRequest is the JSON body of POST /api/outline and POST /api/outline/stream.
+type OutlineRequest struct {
+	Text          string `json:"text"`
+	PromptVersion string `json:"prompt_version"`
+	Language      string `json:"language"`
+	Mode          string `json:"mode"`
+}
+
+func isOutlineMode(mode string) bool {
+	return mode == outlineModeAuto || mode == outlineModeSingle || mode == outlineModeMapReduce
+}
+
+func outlineHandler(client OpenAIClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := requestClient(c, client)
+		defer client.save(c)
+		if abortOnQuotaError(c, client.checkQuota()) {
+			return
+		}
+
+		request, prompt, language, options, ok := bindOutlineRequest(c, client)
+		if !ok {
+			return
+		}
+
+		outline, err := createOutline(c.Request.Context(), client, request.Text, prompt, options)
+
+		if abortOnQuotaError(c, err) {
+			return
+		}
+		if errors.Is(err, ErrTokenBudgetExceeded) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Text exceeds the token budget"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating response"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"response": outline.Markdown(), "outline": outline, "language": language, "usage": client.Usage()})
+	}
+}
+
+// outlineStreamHandler streams the outline as Markdown via server-sent events. Long texts are outlined
+// part by part like in map-reduce mode, but the partial outlines are not merged.
+func outlineStreamHandler(client OpenAIClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := requestClient(c, client)
+		defer client.save(c)
+		if abortOnQuotaError(c, client.checkQuota()) {
+			return
+		}
+
+		request, prompt, language, options, ok := bindOutlineRequest(c, client)
+		if !ok {
+			return
+		}
+
+		task, parts, err := outlineStreamParts(request.Text, prompt, options)
+		if errors.Is(err, ErrTokenBudgetExceeded) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Text exceeds the token budget"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating response"})
+			return
+		}
+
+		streamMarkdown(c, client, task, parts, ParagraphSeparator, options.CompletionTokens, func(ctx context.Context, part string) (string, error) {
+			return promptStore.Render(task, prompt, prompt.data(part))
+		}, func(response string) gin.H {
+			return gin.H{"response": response, "language": language, "usage": client.Usage()}
+		})
+	}
+}
+
+// bindOutlineRequest parses and validates the outline request and resolves its language. If the request
+// is invalid, an error response is written and ok is false.
+func bindOutlineRequest(c *gin.Context, client OpenAIClient) (request OutlineRequest, prompt PromptSelection, language DetectedLanguage, options OutlineOptions, ok bool) {
+	if err := c.ShouldBindJSON(&request); err != nil {
+		logEvent(c, slog.LevelInfo, "invalid_json", gin.H{
+			"error": err.Error(),
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	if request.Text == "" {
+		logEvent(c, slog.LevelInfo, "no_text_provided", gin.H{
+			"error": "No text provided",
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No text provided"})
+		return
+	}
+
+	prompt = PromptSelection{
+		Version:  request.PromptVersion,
+		Language: request.Language,
+	}
+	if !promptStore.HasVersion(prompt.Version) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt version"})
+		return
+	}
+
+	language, err := resolveLanguage(c.Request.Context(), client, request.Text, &prompt, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid language"})
+		return
+	}
+
+	options = defaultOutlineOptions
+	if request.Mode != "" {
+		if !isOutlineMode(request.Mode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown outline mode"})
+			return
+		}
+		options.Mode = request.Mode
+	}
+
+	return request, prompt, language, options, true
+}
+
+// outlineMode resolves the auto mode for the tokens of the rendered single-request prompt.
+func outlineMode(promptTokens int, options OutlineOptions) string {
+	if options.Mode != "" && options.Mode != outlineModeAuto {
+		return options.Mode
+	}
+	if promptTokens > options.TokenBudget {
+		return outlineModeMapReduce
+	}
+	return outlineModeSingle
+}
+
+// outlineStreamParts returns the template and the text parts the streamed outline is created from.
+func outlineStreamParts(text string, selection PromptSelection, options OutlineOptions) (string, []string, error) {
+	prompt, err := promptStore.Render(promptOutline, selection, selection.data(text))
+	if err != nil {
+		return "", nil, err
+	}
+
+	promptTokens := getNumTokens(prompt)
+	switch outlineMode(promptTokens, options) {
+	case outlineModeMapReduce:
+		return promptOutlinePart, splitLongString(text, options.PartTokens), nil
+	default:
+		if promptTokens > options.TokenBudget {
+			return "", nil, ErrTokenBudgetExceeded
+		}
+		return promptOutline, []string{text}, nil
+	}
+}
+
+func createOutline(ctx context.Context, client OpenAIClient, text string, selection PromptSelection, options OutlineOptions) (*StructuredOutline, error) {
+
+	if selection.Language == "" {
+		selection.Language = detectLanguage(ctx, client, text, selection, nil).Code
+	}
+
+	prompt, err := promptStore.Render(promptOutline, selection, selection.data(text))
+	if err != nil {
+		return nil, err
+	}
+
+	promptTokens := getNumTokens(prompt)
+	mode := outlineMode(promptTokens, options)
+
+	var outline *StructuredOutline
+	if mode == outlineModeMapReduce {
+		outline, err = createOutlineMapReduce(ctx, client, text, selection, options)
+	} else {
+		outline, err = completeOutline(ctx, client, prompt, promptTokens, options)
+	}
+	if err != nil {
+		logEvent(ctx, slog.LevelError, "completion_failed", gin.H{
+			"error": err.Error(),
+		})
+		return nil, err
+	}
+
+	logEvent(ctx, slog.LevelInfo, "outline_created", gin.H{
+		"mode":    mode,
+		"outline": redact(outline.Markdown()),
+	})
+	return outline, nil
+}
+
+// createOutlineMapReduce outlines every part of the text produced by splitLongString in parallel and merges
+// the partial outlines hierarchically until a single outline is left.
+func createOutlineMapReduce(ctx context.Context, client OpenAIClient, text string, selection PromptSelection, options OutlineOptions) (*StructuredOutline, error) {
+	parts := splitLongString(text, options.PartTokens)
+	outlines, err := processPartsInParallel(ctx, parts, func(ctx context.Context, part string) (*StructuredOutline, error) {
+		prompt, err := promptStore.Render(promptOutlinePart, selection, selection.data(part))
+		if err != nil {
+			return nil, err
+		}
+		return completeOutline(ctx, client, prompt, getNumTokens(prompt), options)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeOutlines(ctx, client, outlines, selection, options)
+}
+
+// mergeOutlines merges the outlines level by level. On every level consecutive outlines are grouped so that
+// each merge prompt stays within the token budget, and all groups of a level are merged in parallel. The
+// tokens of every outline are counted once, when it is created.
+func mergeOutlines(ctx context.Context, client OpenAIClient, outlines []*StructuredOutline, selection PromptSelection, options OutlineOptions) (*StructuredOutline, error) {
+	emptyPrompt, err := promptStore.Render(promptOutlineMerge, selection, selection.data(""))
+	if err != nil {
+		return nil, err
+	}
+	promptTokens := getNumTokens(emptyPrompt)
+	tokens := map[*StructuredOutline]int{}
+	for _, outline := range outlines {
+		tokens[outline] = estimateOutlineTokens(outline)
+	}
+
+	for level := 1; len(outlines) > 1; level++ {
+		groups, err := groupOutlines(outlines, tokens, promptTokens, options.TokenBudget)
+		if err != nil {
+			return nil, err
+		}
+
+		logEvent(ctx, slog.LevelDebug, "merging_outlines", gin.H{
+			"level":    level,
+			"outlines": len(outlines),
+			"groups":   len(groups),
+		})
+
+		// Groups with a single outline are carried over to the next level as they are.
+		next := make([]*StructuredOutline, len(groups))
+		var merging [][]*StructuredOutline
+		var indices []int
+		for i, group := range groups {
+			if len(group) == 1 {
+				next[i] = group[0]
+				continue
+			}
+			merging = append(merging, group)
+			indices = append(indices, i)
+		}
+
+		merged, err := processPartsInParallel(ctx, merging, func(ctx context.Context, group []*StructuredOutline) (*StructuredOutline, error) {
+			prompt, err := promptStore.Render(promptOutlineMerge, selection, selection.data(joinOutlines(group)))
+			if err != nil {
+				return nil, err
+			}
+			groupTokens := promptTokens
+			for _, outline := range group {
+				groupTokens += tokens[outline]
+			}
+			return completeOutline(ctx, client, prompt, groupTokens, options)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range indices {
+			next[i] = merged[j]
+			tokens[merged[j]] = estimateOutlineTokens(merged[j])
+		}
+		outlines = next
+	}
+
+	return outlines[0], nil
+}
+
+// groupOutlines greedily combines consecutive outlines into groups whose merge prompt fits into the token
+// budget, given the tokens of the empty merge prompt and of every outline. Every group contains at least
+// two outlines, except for a single outline left over at the end.
+func groupOutlines(outlines []*StructuredOutline, tokens map[*StructuredOutline]int, promptTokens, tokenBudget int) ([][]*StructuredOutline, error) {
+	var groups [][]*StructuredOutline
+	var group []*StructuredOutline
+	groupTokens := promptTokens
+	for _, outline := range outlines {
+		outlineTokens := tokens[outline]
+		if len(group) >= 2 && groupTokens+outlineTokens > tokenBudget {
+			groups = append(groups, group)
+			group = nil
+			groupTokens = promptTokens
+		}
+		group = append(group, outline)
+		groupTokens += outlineTokens
+		if len(group) == 2 && groupTokens > tokenBudget {
+			return nil, fmt.Errorf("merging two partial outlines: %w", ErrTokenBudgetExceeded)
+		}
+	}
+
+	return append(groups, group), nil
+}
+
+// estimateOutlineTokens returns the number of tokens an outline adds to a merge prompt, including the separator.
+func estimateOutlineTokens(outline *StructuredOutline) int {
+	return getNumTokens(joinOutlines([]*StructuredOutline{outline})) + getNumTokens(ParagraphSeparator)
+}
+
+// joinOutlines renders the outlines as Markdown for the merge prompt.
+func joinOutlines(outlines []*StructuredOutline) string {
+	wrapped := make([]string, len(outlines))
+	for i, outline := range outlines {
+		wrapped[i] = "START OUTLINE\n" + outline.Markdown() + "\nEND OUTLINE"
+	}
+	return strings.Join(wrapped, "\n\n")
+}
+
+// completeOutline checks the tokens of the prompt against the token budget and requests a structured outline
+// from the chat model.
+func completeOutline(ctx context.Context, client OpenAIClient, prompt string, promptTokens int, options OutlineOptions) (*StructuredOutline, error) {
+	if promptTokens > options.TokenBudget {
+		return nil, ErrTokenBudgetExceeded
+	}
+
+	logEvent(ctx, slog.LevelDebug, "creating_outline", gin.H{
+		"prompt": redact(prompt),
+	})
+	return completeStructured[StructuredOutline](ctx, client, structuredOutputModel, "outline", prompt, options.CompletionTokens)
+}
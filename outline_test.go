@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func isMergePrompt(prompt string) bool {
+	return strings.HasPrefix(prompt, "The following English speaker outlines")
+}
+
+func testOutline(heading string) *StructuredOutline {
+	return &StructuredOutline{
+		Sections: []OutlineSection{
+			{Heading: heading, Points: []OutlinePoint{{Text: "point", Details: []string{}}}},
+		},
+	}
+}
+
+func testOutlineJSON(heading string) string {
+	content, _ := json.Marshal(testOutline(heading))
+	return string(content)
+}
+
+func TestCreateOutline_Single(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string { return testOutlineJSON("Intro") }}
+
+	outline, err := createOutline(context.Background(), client, "A short talk.", PromptSelection{Language: "en"}, defaultOutlineOptions)
+	require.NoError(t, err)
+	assert.Equal(t, testOutline("Intro"), outline)
+	require.Len(t, client.prompts, 1)
+	assert.True(t, strings.HasPrefix(client.prompts[0], "Create a English speaker outline based on the following script"))
+}
+
+func TestCreateOutline_MapReduce(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string {
+		if isMergePrompt(prompt) {
+			return testOutlineJSON("Merged")
+		}
+		return testOutlineJSON("Part")
+	}}
+
+	options := defaultOutlineOptions
+	options.Mode = outlineModeMapReduce
+	options.PartTokens = 5
+
+	outline, err := createOutline(context.Background(), client, "First part.\n\nSecond part.\n\nThird part.", PromptSelection{Language: "en"}, options)
+	require.NoError(t, err)
+	assert.Equal(t, testOutline("Merged"), outline)
+
+	// three part outlines that fit into a single merge prompt
+	require.Len(t, client.prompts, 4)
+	assert.True(t, isMergePrompt(client.prompts[3]))
+	assert.Equal(t, 3, strings.Count(client.prompts[3], "START OUTLINE\n## Part\n- point\nEND OUTLINE"))
+}
+
+func TestCreateOutline_AutoSwitchesToMapReduce(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string { return testOutlineJSON("Part") }}
+
+	text := strings.Repeat("This is one paragraph of the talk.\n\n", 12)
+	singlePrompt, err := promptStore.Render(promptOutline, PromptSelection{}, PromptSelection{Language: "en"}.data(text))
+	require.NoError(t, err)
+
+	options := defaultOutlineOptions
+	options.TokenBudget = getNumTokens(singlePrompt) - 1
+	options.PartTokens = 50
+
+	_, err = createOutline(context.Background(), client, text, PromptSelection{Language: "en"}, options)
+	require.NoError(t, err)
+	require.Greater(t, len(client.prompts), 2)
+	assert.True(t, isMergePrompt(client.prompts[len(client.prompts)-1]))
+	for _, prompt := range client.prompts {
+		assert.LessOrEqual(t, getNumTokens(prompt), options.TokenBudget)
+	}
+}
+
+func TestCreateOutline_SingleExceedsBudget(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string { return testOutlineJSON("Intro") }}
+
+	options := defaultOutlineOptions
+	options.Mode = outlineModeSingle
+	options.TokenBudget = 10
+
+	_, err := createOutline(context.Background(), client, "A short talk.", PromptSelection{Language: "en"}, options)
+	assert.ErrorIs(t, err, ErrTokenBudgetExceeded)
+	assert.Empty(t, client.prompts)
+}
+
+func TestOutlineHandlers_ExceedBudget(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previousOptions := defaultOutlineOptions
+	defaultOutlineOptions.TokenBudget = 10
+	defer func() { defaultOutlineOptions = previousOptions }()
+
+	client := &chatFuncClient{complete: func(prompt string) string { return testOutlineJSON("Intro") }}
+	r := gin.New()
+	r.POST("/api/outline", outlineHandler(client))
+	r.POST("/api/outline/stream", outlineStreamHandler(client))
+	for _, path := range []string{"/api/outline", "/api/outline/stream"} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"text": "A short talk.", "language": "en", "mode": "single"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+	assert.Empty(t, client.prompts)
+}
+
+func TestMergeOutlines_Hierarchical(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string { return testOutlineJSON("Part") }}
+
+	selection := PromptSelection{Language: "en"}
+	emptyPrompt, err := promptStore.Render(promptOutlineMerge, selection, selection.data(""))
+	require.NoError(t, err)
+
+	// Only two outlines fit into a single merge prompt.
+	options := defaultOutlineOptions
+	options.TokenBudget = getNumTokens(emptyPrompt) + 2*estimateOutlineTokens(testOutline("Part"))
+
+	testCases := []struct {
+		name           string
+		outlines       int
+		expectedMerges int
+	}{
+		{name: "single outline", outlines: 1, expectedMerges: 0},
+		{name: "two outlines", outlines: 2, expectedMerges: 1},
+		{name: "three outlines", outlines: 3, expectedMerges: 2},
+		{name: "four outlines", outlines: 4, expectedMerges: 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client.prompts = nil
+			outlines := make([]*StructuredOutline, tc.outlines)
+			for i := range outlines {
+				outlines[i] = testOutline("Part")
+			}
+
+			outline, err := mergeOutlines(context.Background(), client, outlines, selection, options)
+			require.NoError(t, err)
+			assert.Equal(t, testOutline("Part"), outline)
+			assert.Len(t, client.prompts, tc.expectedMerges)
+			for _, prompt := range client.prompts {
+				assert.LessOrEqual(t, getNumTokens(prompt), options.TokenBudget)
+			}
+		})
+	}
+}
+
+func TestGroupOutlines(t *testing.T) {
+	selection := PromptSelection{Language: "en"}
+	emptyPrompt, err := promptStore.Render(promptOutlineMerge, selection, selection.data(""))
+	require.NoError(t, err)
+	promptTokens := getNumTokens(emptyPrompt)
+
+	a, b, c := testOutline("A"), testOutline("B"), testOutline("C")
+	outlineTokens := estimateOutlineTokens(a)
+	tokens := map[*StructuredOutline]int{a: outlineTokens, b: outlineTokens, c: outlineTokens}
+
+	groups, err := groupOutlines([]*StructuredOutline{a, b, c}, tokens, promptTokens, promptTokens+2*outlineTokens)
+	require.NoError(t, err)
+	assert.Equal(t, [][]*StructuredOutline{{a, b}, {c}}, groups)
+
+	groups, err = groupOutlines([]*StructuredOutline{a, b, c}, tokens, promptTokens, promptTokens+3*outlineTokens)
+	require.NoError(t, err)
+	assert.Equal(t, [][]*StructuredOutline{{a, b, c}}, groups)
+
+	_, err = groupOutlines([]*StructuredOutline{a, b}, tokens, promptTokens, promptTokens+outlineTokens)
+	assert.ErrorIs(t, err, ErrTokenBudgetExceeded)
+}
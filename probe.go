@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MediaInfo describes a recording as reported by ffprobe.
+type MediaInfo struct {
+	// Format is the container format, e.g. "mp3" or "mov,mp4,m4a,3gp,3g2,mj2".
+	Format   string
+	Duration time.Duration
+	// BitRate is the bit rate of the whole file in bits per second, 0 if unknown.
+	BitRate int64
+	// Codec, Channels and SampleRate are those of the first audio stream.
+	Codec      string
+	Channels   int
+	SampleRate int
+	Streams    []MediaStream
+}
+
+// MediaStream is a single stream of a recording.
+type MediaStream struct {
+	Index int
+	// Type is audio, video, subtitle, data or attachment.
+	Type       string
+	Codec      string
+	BitRate    int64
+	Channels   int
+	SampleRate int
+	Duration   time.Duration
+}
+
+// ffprobeOutput is the part of the JSON output of ffprobe -show_format -show_streams that is used. Most
+// numbers are reported as strings.
+type ffprobeOutput struct {
+	Streams []struct {
+		Index      int    `json:"index"`
+		CodecType  string `json:"codec_type"`
+		CodecName  string `json:"codec_name"`
+		SampleRate string `json:"sample_rate"`
+		Channels   int    `json:"channels"`
+		BitRate    string `json:"bit_rate"`
+		Duration   string `json:"duration"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// probeMedia reads the format and the streams of the recording with ffprobe, without decoding it. It
+// returns ErrUnsupportedMediaType if ffprobe cannot read the file. Tests replace it to run without
+// ffprobe.
+var probeMedia = ffprobe
+
+func ffprobe(ctx context.Context, path string) (media MediaInfo, err error) {
+	ctx, span := startSpan(ctx, "probe_media")
+	start := time.Now()
+	defer func() {
+		observeFFmpeg("probe", start, err)
+		span.SetAttributes(
+			attribute.String("media.format", media.Format),
+			attribute.String("media.codec", media.Codec),
+			attribute.Float64("media.duration_seconds", media.Duration.Seconds()),
+		)
+		endSpan(span, err)
+	}()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_format", "-show_streams", "-of", "json", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if ctx.Err() == nil && errors.As(err, &exitErr) {
+			return MediaInfo{}, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, strings.TrimSpace(stderr.String()))
+		}
+		return MediaInfo{}, err
+	}
+	return parseProbeOutput(stdout.Bytes())
+}
+
+// parseProbeOutput parses the JSON output of ffprobe. Values ffprobe does not report are left zero.
+func parseProbeOutput(output []byte) (MediaInfo, error) {
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return MediaInfo{}, fmt.Errorf("parsing ffprobe output: %w", err)
+	}
+
+	media := MediaInfo{
+		Format:   probe.Format.FormatName,
+		Duration: parseProbeSeconds(probe.Format.Duration),
+		BitRate:  parseProbeInt(probe.Format.BitRate),
+	}
+	for _, s := range probe.Streams {
+		stream := MediaStream{
+			Index:      s.Index,
+			Type:       s.CodecType,
+			Codec:      s.CodecName,
+			BitRate:    parseProbeInt(s.BitRate),
+			Channels:   s.Channels,
+			SampleRate: int(parseProbeInt(s.SampleRate)),
+			Duration:   parseProbeSeconds(s.Duration),
+		}
+		media.Streams = append(media.Streams, stream)
+		if stream.Type == "audio" && media.Codec == "" {
+			media.Codec = stream.Codec
+			media.Channels = stream.Channels
+			media.SampleRate = stream.SampleRate
+		}
+	}
+	// Some containers only report the duration of their streams.
+	if media.Duration == 0 {
+		for _, stream := range media.Streams {
+			media.Duration = max(media.Duration, stream.Duration)
+		}
+	}
+	return media, nil
+}
+
+// parseProbeSeconds parses a duration in seconds like "3.056327". It returns 0 for missing values and
+// "N/A".
+func parseProbeSeconds(value string) time.Duration {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func parseProbeInt(value string) int64 {
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return 0
+	}
+	return number
+}
+
+// HasAudio reports whether the recording has an audio stream to transcribe.
+func (m MediaInfo) HasAudio() bool {
+	return m.Codec != ""
+}
+
+// AudioBitRate returns the bit rate of the first audio stream or, if ffprobe does not report it, of the
+// whole file, which is at least as high. It returns 0 if neither is known.
+func (m MediaInfo) AudioBitRate() int64 {
+	for _, stream := range m.Streams {
+		if stream.Type == "audio" {
+			if stream.BitRate > 0 {
+				return stream.BitRate
+			}
+			break
+		}
+	}
+	return m.BitRate
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMediaProbe replaces ffprobe with a probe that reports every recording as the given media for the
+// duration of the test.
+func fakeMediaProbe(t *testing.T, media MediaInfo, err error) {
+	previous := probeMedia
+	probeMedia = func(ctx context.Context, path string) (MediaInfo, error) {
+		return media, err
+	}
+	t.Cleanup(func() { probeMedia = previous })
+}
+
+// shortMP3 is the media info of test/fixtures/short.mp3.
+var shortMP3 = MediaInfo{
+	Format:     "mp3",
+	Duration:   3 * time.Second,
+	BitRate:    128000,
+	Codec:      "mp3",
+	Channels:   2,
+	SampleRate: 44100,
+	Streams:    []MediaStream{{Type: "audio", Codec: "mp3", BitRate: 128000, Channels: 2, SampleRate: 44100, Duration: 3 * time.Second}},
+}
+
+func TestProbeMedia(t *testing.T) {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		t.Skip("ffprobe is not installed")
+	}
+	media, err := probeMedia(context.Background(), "test/fixtures/short.mp3")
+	require.NoError(t, err)
+	assert.Equal(t, "mp3", media.Format)
+	assert.Equal(t, "mp3", media.Codec)
+	assert.Greater(t, media.Duration, 2*time.Second)
+	assert.True(t, media.HasAudio())
+
+	_, err = probeMedia(context.Background(), "README.md")
+	assert.ErrorIs(t, err, ErrUnsupportedMediaType)
+}
+
+func TestParseProbeOutput(t *testing.T) {
+	output := `{
+		"streams": [
+			{"index": 0, "codec_name": "h264", "codec_type": "video", "bit_rate": "2000000", "duration": "60.000000"},
+			{"index": 1, "codec_name": "aac", "codec_type": "audio", "sample_rate": "48000", "channels": 2, "bit_rate": "128000", "duration": "60.010000"},
+			{"index": 2, "codec_name": "mov_text", "codec_type": "subtitle", "duration": "N/A"}
+		],
+		"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "60.010000", "bit_rate": "2131000"}
+	}`
+	media, err := parseProbeOutput([]byte(output))
+	require.NoError(t, err)
+	assert.Equal(t, "mov,mp4,m4a,3gp,3g2,mj2", media.Format)
+	assert.Equal(t, 60010*time.Millisecond, media.Duration)
+	assert.Equal(t, int64(2131000), media.BitRate)
+	assert.Equal(t, "aac", media.Codec)
+	assert.Equal(t, 2, media.Channels)
+	assert.Equal(t, 48000, media.SampleRate)
+	assert.Equal(t, int64(128000), media.AudioBitRate())
+	require.Len(t, media.Streams, 3)
+	assert.Equal(t, MediaStream{Index: 2, Type: "subtitle", Codec: "mov_text"}, media.Streams[2])
+
+	// WebM reports neither the bit rate of its streams nor, for live recordings, the duration of the file.
+	media, err = parseProbeOutput([]byte(`{
+		"streams": [{"index": 0, "codec_name": "opus", "codec_type": "audio", "sample_rate": "48000", "channels": 1, "duration": "12.5"}],
+		"format": {"format_name": "matroska,webm", "bit_rate": "64000"}
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, 12500*time.Millisecond, media.Duration)
+	assert.Equal(t, int64(64000), media.AudioBitRate())
+
+	media, err = parseProbeOutput([]byte(`{"streams": [{"index": 0, "codec_name": "png", "codec_type": "video"}], "format": {"format_name": "png_pipe"}}`))
+	require.NoError(t, err)
+	assert.False(t, media.HasAudio())
+
+	_, err = parseProbeOutput([]byte("not json"))
+	assert.Error(t, err)
+}
+
+func TestChunkPlanning(t *testing.T) {
+	for _, tc := range []struct {
+		codec     string
+		extension string
+		copied    bool
+	}{
+		{"mp3", "mp3", true},
+		{"aac", "m4a", true},
+		{"opus", "ogg", true},
+		{"flac", "flac", true},
+		{"pcm_s16le", "wav", true},
+		{"amr_nb", "mp3", false},
+	} {
+		extension, copied := chunkFormat(tc.codec)
+		assert.Equal(t, tc.extension, extension, tc.codec)
+		assert.Equal(t, tc.copied, copied, tc.codec)
+	}
+
+	assert.Equal(t, maxChunkTime, chunkTargetTime(shortMP3))
+	assert.Equal(t, maxChunkTime, chunkTargetTime(MediaInfo{Codec: "mp3"}), "the bit rate is unknown")
+	assert.Equal(t, maxChunkTime, chunkTargetTime(MediaInfo{Codec: "amr_nb", BitRate: 12200}), "the chunks are encoded")
+
+	// Chunks of uncompressed audio are much shorter, so they stay below the limit of Whisper with a silence
+	// found after the target time.
+	wav := MediaInfo{Codec: "pcm_s16le", BitRate: 1411200}
+	target := chunkTargetTime(wav)
+	assert.Less(t, target, 3*time.Minute)
+	assert.LessOrEqual(t, float64(target+target/5)*float64(wav.BitRate)/8/float64(time.Second), float64(maxChunkBytes))
+}
+
+func TestTranscribeHandler_ValidatesMedia(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previousTempRoot := tempRoot
+	tempRoot = t.TempDir()
+	defer func() { tempRoot = previousTempRoot }()
+
+	mp3, err := os.ReadFile("test/fixtures/short.mp3")
+	require.NoError(t, err)
+	r := gin.New()
+	r.POST("/api/transcribe", transcribeHandler(&mockOpenAIClient{}))
+	transcribe := func() *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, err := form.CreateFormFile("audio", "talk.mp3")
+		require.NoError(t, err)
+		_, err = part.Write(mp3)
+		require.NoError(t, err)
+		require.NoError(t, form.Close())
+		req := httptest.NewRequest(http.MethodPost, "/api/transcribe", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	fakeMediaProbe(t, MediaInfo{}, errors.New("exec: \"ffprobe\": executable file not found in $PATH"))
+	assert.Equal(t, http.StatusInternalServerError, transcribe().Code)
+
+	fakeMediaProbe(t, MediaInfo{}, ErrUnsupportedMediaType)
+	assert.Equal(t, http.StatusUnsupportedMediaType, transcribe().Code)
+
+	fakeMediaProbe(t, MediaInfo{Format: "mp4", Streams: []MediaStream{{Type: "video", Codec: "h264"}}}, nil)
+	w := transcribe()
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Contains(t, w.Body.String(), "no audio")
+
+	fakeMediaProbe(t, shortMP3, nil)
+	assert.Equal(t, http.StatusOK, transcribe().Code)
+}
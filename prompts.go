@@ -0,0 +1,279 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//go:embed prompts
+var embeddedPrompts embed.FS
+
+const (
+	defaultPromptVersion = "v1"
+	promptFileExtension  = ".tmpl"
+
+	promptCorrection   = "correction"
+	promptBulletpoints = "bulletpoints"
+	promptOutline      = "outline"
+	promptLanguage     = "language"
+
+	// customPromptPrefix marks the tasks of prompt files in <version>/custom/, which /api/transform offers
+	// as custom operations.
+	customPromptPrefix = "custom/"
+)
+
+// requiredPrompts lists the tasks every prompt version has to provide a language-neutral template for.
+var requiredPrompts = []string{promptCorrection, promptBulletpoints, promptOutline, promptLanguage}
+
+var ErrUnknownPromptVersion = errors.New("unknown prompt version")
+
+// promptStore holds the prompt templates used by the server. It starts out with the embedded
+// defaults and is replaced in main when PROMPTS_DIR or PROMPT_VERSION are set.
+var promptStore = mustLoadPromptStore(defaultPromptVersion, "")
+
+// PromptData is the data every prompt template is executed with.
+type PromptData struct {
+	Text string
+	// Language is the BCP-47 code of the language of the text, e.g. "de".
+	Language string
+	// LanguageName is the English name of the language of the text, e.g. "German".
+	LanguageName string
+	// TargetLanguage is the BCP-47 code of the language to translate into. It is only set for translations.
+	TargetLanguage string
+	// TargetLanguageName is the English name of the language to translate into.
+	TargetLanguageName string
+}
+
+// PromptSelection chooses the prompt version and language for a single request.
+// Empty fields fall back to the defaults of the PromptStore.
+type PromptSelection struct {
+	Version string
+	// Language is the BCP-47 code of the language of the text.
+	Language string
+}
+
+// data returns the template data for the given text in the selected language.
+func (s PromptSelection) data(text string) PromptData {
+	data := PromptData{Text: text, Language: s.Language}
+	if s.Language != "" {
+		data.LanguageName = languageName(s.Language)
+	}
+	return data
+}
+
+// PromptStore keeps parsed prompt templates by version, task and language.
+//
+// Templates are read from a directory tree of the form <version>/<task>.tmpl for the
+// language-neutral template and <version>/<task>.<language code>.tmpl for language-specific variants.
+// Templates in <version>/custom/ are tasks prefixed with custom/.
+type PromptStore struct {
+	defaultVersion string
+	// versions maps version -> task -> language ("" for the language-neutral template) -> template.
+	versions map[string]map[string]map[string]*template.Template
+}
+
+// loadPromptStore loads the embedded prompt templates and, if overrideDir is not empty, the templates
+// found in overrideDir on top of them. Files in overrideDir replace embedded files with the same
+// version, task and language, and may add new versions. The resulting store is validated before it is returned.
+func loadPromptStore(defaultVersion, overrideDir string) (*PromptStore, error) {
+	if defaultVersion == "" {
+		defaultVersion = defaultPromptVersion
+	}
+
+	store := &PromptStore{
+		defaultVersion: defaultVersion,
+		versions:       map[string]map[string]map[string]*template.Template{},
+	}
+
+	embedded, err := fs.Sub(embeddedPrompts, "prompts")
+	if err != nil {
+		return nil, err
+	}
+	if err := store.load(embedded); err != nil {
+		return nil, fmt.Errorf("loading embedded prompts: %w", err)
+	}
+
+	if overrideDir != "" {
+		if err := store.load(os.DirFS(overrideDir)); err != nil {
+			return nil, fmt.Errorf("loading prompts from %s: %w", overrideDir, err)
+		}
+	}
+
+	if err := store.validate(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func mustLoadPromptStore(defaultVersion, overrideDir string) *PromptStore {
+	store, err := loadPromptStore(defaultVersion, overrideDir)
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+func (s *PromptStore) load(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(filePath) != promptFileExtension {
+			return nil
+		}
+
+		version, name, _ := strings.Cut(filePath, "/")
+		dir, name := path.Split(name)
+		if version == filePath || (dir != "" && dir != customPromptPrefix) {
+			return fmt.Errorf("%s: prompt templates must be placed in <version>/<task>.tmpl or <version>/custom/<task>.tmpl", filePath)
+		}
+
+		task, language, _ := strings.Cut(strings.TrimSuffix(name, promptFileExtension), ".")
+		task = dir + task
+		language = strings.ToLower(language)
+
+		content, err := fs.ReadFile(fsys, filePath)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(filePath).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return err
+		}
+
+		if s.versions[version] == nil {
+			s.versions[version] = map[string]map[string]*template.Template{}
+		}
+		if s.versions[version][task] == nil {
+			s.versions[version][task] = map[string]*template.Template{}
+		}
+		s.versions[version][task][language] = tmpl
+		return nil
+	})
+}
+
+// validate makes sure the default version exists, every version provides all required tasks and
+// every template can be executed with sample data.
+func (s *PromptStore) validate() error {
+	if _, ok := s.versions[s.defaultVersion]; !ok {
+		return fmt.Errorf("default prompt version %q: %w", s.defaultVersion, ErrUnknownPromptVersion)
+	}
+
+	sample := PromptData{
+		Text:               "Sample text.",
+		Language:           "en",
+		LanguageName:       "English",
+		TargetLanguage:     "de",
+		TargetLanguageName: "German",
+	}
+	for _, version := range s.Versions() {
+		tasks := s.versions[version]
+		for _, task := range requiredPrompts {
+			if _, ok := tasks[task][""]; !ok {
+				return fmt.Errorf("prompt version %q is missing the %q template", version, task)
+			}
+		}
+		for _, languages := range tasks {
+			for _, tmpl := range languages {
+				if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+					return fmt.Errorf("invalid prompt template: %w", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Versions returns all known prompt versions in sorted order.
+func (s *PromptStore) Versions() []string {
+	versions := make([]string, 0, len(s.versions))
+	for version := range s.versions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// HasVersion reports whether the given version is known. The empty version refers to the default version.
+func (s *PromptStore) HasVersion(version string) bool {
+	if version == "" {
+		return true
+	}
+	_, ok := s.versions[version]
+	return ok
+}
+
+// HasTask reports whether a template for the given task is available for the selected version.
+func (s *PromptStore) HasTask(task string, selection PromptSelection) bool {
+	_, err := s.lookup(task, selection)
+	return err == nil
+}
+
+// HasTaskInAnyLanguage reports whether the selected version has a template for the task in the selected
+// language or, if no language is selected, in any language. It checks tasks before the language of the text
+// is detected.
+func (s *PromptStore) HasTaskInAnyLanguage(task string, selection PromptSelection) bool {
+	if selection.Language != "" {
+		return s.HasTask(task, selection)
+	}
+	version := selection.Version
+	if version == "" {
+		version = s.defaultVersion
+	}
+	languages, ok := s.versions[version][task]
+	if !ok {
+		languages = s.versions[s.defaultVersion][task]
+	}
+	return len(languages) > 0
+}
+
+// lookup finds the template for the given task. It prefers the template for the selected language and
+// falls back to the language-neutral template of the same version. Tasks that are not required and
+// missing in the selected version are taken from the default version.
+func (s *PromptStore) lookup(task string, selection PromptSelection) (*template.Template, error) {
+	version := selection.Version
+	if version == "" {
+		version = s.defaultVersion
+	}
+
+	tasks, ok := s.versions[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPromptVersion, version)
+	}
+
+	languages, ok := tasks[task]
+	if !ok {
+		languages = s.versions[s.defaultVersion][task]
+	}
+
+	// Try the full language code ("pt-br"), its base language ("pt") and the language-neutral template.
+	code := strings.ToLower(selection.Language)
+	base, _, _ := strings.Cut(code, "-")
+	for _, language := range []string{code, base, ""} {
+		if tmpl, ok := languages[language]; ok {
+			return tmpl, nil
+		}
+	}
+	return nil, fmt.Errorf("prompt version %q has no %q template", version, task)
+}
+
+// Render executes the template for the given task with the given data.
+func (s *PromptStore) Render(task string, selection PromptSelection, data PromptData) (string, error) {
+	tmpl, err := s.lookup(task, selection)
+	if err != nil {
+		return "", err
+	}
+
+	var prompt strings.Builder
+	if err := tmpl.Execute(&prompt, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(prompt.String()), nil
+}
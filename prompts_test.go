@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePromptFile(t *testing.T, dir, name, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+}
+
+func TestLoadPromptStore_Defaults(t *testing.T) {
+	store, err := loadPromptStore("", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultPromptVersion}, store.Versions())
+
+	for _, task := range requiredPrompts {
+		prompt, err := store.Render(task, PromptSelection{}, PromptSelection{Language: "en"}.data("Hello world."))
+		require.NoError(t, err, task)
+		assert.Contains(t, prompt, "Hello world.")
+	}
+
+	prompt, err := store.Render(promptOutline, PromptSelection{}, PromptSelection{Language: "de"}.data("Hallo Welt."))
+	require.NoError(t, err)
+	assert.Contains(t, prompt, "Create a German speaker outline")
+}
+
+func TestLoadPromptStore_OverrideDir(t *testing.T) {
+	dir := t.TempDir()
+	writePromptFile(t, dir, "v1/bulletpoints.tmpl", "Custom bulletpoints:\n{{.Text}}")
+	writePromptFile(t, dir, "v1/bulletpoints.de.tmpl", "Stichpunkte:\n{{.Text}}")
+	writePromptFile(t, dir, "v1/bulletpoints.pt-BR.tmpl", "Tópicos:\n{{.Text}}")
+	writePromptFile(t, dir, "v2/correction.tmpl", "Fix: {{.Text}}")
+	writePromptFile(t, dir, "v2/bulletpoints.tmpl", "Bullets: {{.Text}}")
+	writePromptFile(t, dir, "v2/outline.tmpl", "Outline in {{.LanguageName}} ({{.Language}}): {{.Text}}")
+	writePromptFile(t, dir, "v2/language.tmpl", "Language of: {{.Text}}")
+
+	store, err := loadPromptStore("", dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1", "v2"}, store.Versions())
+
+	prompt, err := store.Render(promptBulletpoints, PromptSelection{}, PromptData{Text: "text"})
+	require.NoError(t, err)
+	assert.Equal(t, "Custom bulletpoints:\ntext", prompt)
+
+	prompt, err = store.Render(promptBulletpoints, PromptSelection{Language: "de"}, PromptData{Text: "text"})
+	require.NoError(t, err)
+	assert.Equal(t, "Stichpunkte:\ntext", prompt)
+
+	// Regional variants fall back to the template of their base language.
+	prompt, err = store.Render(promptBulletpoints, PromptSelection{Language: "de-AT"}, PromptData{Text: "text"})
+	require.NoError(t, err)
+	assert.Equal(t, "Stichpunkte:\ntext", prompt)
+
+	prompt, err = store.Render(promptBulletpoints, PromptSelection{Language: "pt-BR"}, PromptData{Text: "text"})
+	require.NoError(t, err)
+	assert.Equal(t, "Tópicos:\ntext", prompt)
+
+	// Languages without a specific template fall back to the language-neutral one.
+	prompt, err = store.Render(promptBulletpoints, PromptSelection{Language: "fr"}, PromptData{Text: "text"})
+	require.NoError(t, err)
+	assert.Equal(t, "Custom bulletpoints:\ntext", prompt)
+
+	prompt, err = store.Render(promptOutline, PromptSelection{Version: "v2"}, PromptSelection{Language: "en"}.data("text"))
+	require.NoError(t, err)
+	assert.Equal(t, "Outline in English (en): text", prompt)
+
+	// Embedded templates that were not overridden are still available.
+	prompt, err = store.Render(promptCorrection, PromptSelection{Version: "v1"}, PromptData{Text: "text"})
+	require.NoError(t, err)
+	assert.Contains(t, prompt, "Corrected text:")
+}
+
+func TestLoadPromptStore_Validation(t *testing.T) {
+	testCases := []struct {
+		name           string
+		files          map[string]string
+		defaultVersion string
+	}{
+		{
+			name:  "syntax error",
+			files: map[string]string{"v1/outline.tmpl": "{{.Text"},
+		},
+		{
+			name:  "unknown field",
+			files: map[string]string{"v1/outline.tmpl": "{{.Speaker}}"},
+		},
+		{
+			name:  "missing task",
+			files: map[string]string{"v2/outline.tmpl": "{{.Text}}"},
+		},
+		{
+			name:           "unknown default version",
+			defaultVersion: "v3",
+		},
+		{
+			name:  "template outside of a version directory",
+			files: map[string]string{"outline.tmpl": "{{.Text}}"},
+		},
+		{
+			name:  "template in another subdirectory",
+			files: map[string]string{"v1/internal/outline.tmpl": "{{.Text}}"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tc.files {
+				writePromptFile(t, dir, name, content)
+			}
+			_, err := loadPromptStore(tc.defaultVersion, dir)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPromptStore_UnknownVersion(t *testing.T) {
+	store, err := loadPromptStore("", "")
+	require.NoError(t, err)
+
+	assert.True(t, store.HasVersion(""))
+	assert.True(t, store.HasVersion(defaultPromptVersion))
+	assert.False(t, store.HasVersion("v42"))
+
+	_, err = store.Render(promptOutline, PromptSelection{Version: "v42"}, PromptData{Text: "text"})
+	assert.ErrorIs(t, err, ErrUnknownPromptVersion)
+}
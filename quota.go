@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	quotaPeriodDay   = "day"
+	quotaPeriodMonth = "month"
+
+	quotaResourceAudioMinutes = "audio_minutes"
+	quotaResourceTokens       = "tokens"
+
+	// contextKeyUser is the key of the ID of the authenticated user in the gin context.
+	contextKeyUser = "user_id"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaLimits are the limits every user has. Zero means unlimited.
+type QuotaLimits struct {
+	AudioMinutesPerDay   float64 `json:"audio_minutes_per_day"`
+	AudioMinutesPerMonth float64 `json:"audio_minutes_per_month"`
+	TokensPerDay         int     `json:"tokens_per_day"`
+	TokensPerMonth       int     `json:"tokens_per_month"`
+}
+
+// quotaLimits are enforced for all users. They are set in main from the QUOTA_* environment variables.
+var quotaLimits QuotaLimits
+
+// quotaTracker keeps the usage of all users in the current periods.
+var quotaTracker = newQuotaTracker()
+
+// loadQuotaLimits reads the limits from the QUOTA_* environment variables.
+func loadQuotaLimits(getenv func(string) string) (QuotaLimits, error) {
+	var limits QuotaLimits
+	floats := map[string]*float64{
+		"QUOTA_AUDIO_MINUTES_PER_DAY":   &limits.AudioMinutesPerDay,
+		"QUOTA_AUDIO_MINUTES_PER_MONTH": &limits.AudioMinutesPerMonth,
+	}
+	for name, limit := range floats {
+		if value := getenv(name); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed < 0 {
+				return QuotaLimits{}, fmt.Errorf("%s must be a non-negative number: %q", name, value)
+			}
+			*limit = parsed
+		}
+	}
+	ints := map[string]*int{
+		"QUOTA_TOKENS_PER_DAY":   &limits.TokensPerDay,
+		"QUOTA_TOKENS_PER_MONTH": &limits.TokensPerMonth,
+	}
+	for name, limit := range ints {
+		if value := getenv(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return QuotaLimits{}, fmt.Errorf("%s must be a non-negative integer: %q", name, value)
+			}
+			*limit = parsed
+		}
+	}
+	return limits, nil
+}
+
+// QuotaError explains which limit a user has reached.
+type QuotaError struct {
+	Period   string    `json:"period"`
+	Resource string    `json:"resource"`
+	Used     float64   `json:"used"`
+	Limit    float64   `json:"limit"`
+	ResetAt  time.Time `json:"reset_at"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v of %v %s per %s used, the quota resets at %s",
+		e.Used, e.Limit, e.Resource, e.Period, e.ResetAt.Format(time.RFC3339))
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// PeriodUsage is the usage of a user in a day or month.
+type PeriodUsage struct {
+	// Period is the day ("2006-01-02") or month ("2006-01") in UTC.
+	Period       string  `json:"period"`
+	Requests     int     `json:"requests"`
+	AudioMinutes float64 `json:"audio_minutes"`
+	Tokens       int     `json:"tokens"`
+	Cost         float64 `json:"estimated_cost_usd"`
+}
+
+func (p *PeriodUsage) add(usage Usage) {
+	p.Requests++
+	p.AudioMinutes += usage.AudioSeconds / 60
+	p.Tokens += usage.PromptTokens + usage.CompletionTokens
+	p.Cost += usage.Cost
+}
+
+// QuotaTracker accumulates the usage per user, day and month.
+type QuotaTracker struct {
+	mu sync.Mutex
+	// usage maps user -> period -> usage.
+	usage map[string]map[string]*PeriodUsage
+	// prunedDay is the day up to which past periods were removed.
+	prunedDay string
+}
+
+func newQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{usage: map[string]map[string]*PeriodUsage{}}
+}
+
+func quotaPeriods(at time.Time) (string, string) {
+	at = at.UTC()
+	return at.Format("2006-01-02"), at.Format("2006-01")
+}
+
+// Load adds the records of the month of now, so quotas survive restarts. Records of requests that used
+// the user's own OpenAI key do not count towards quotas.
+func (t *QuotaTracker) Load(records []UsageRecord, now time.Time) {
+	_, month := quotaPeriods(now)
+	for _, record := range records {
+		if record.KeySource == keySourceUser {
+			continue
+		}
+		if _, recordMonth := quotaPeriods(record.Time); recordMonth == month {
+			t.Add(record.User, record.Time, record.Usage)
+		}
+	}
+}
+
+// Add adds the usage of a request of the user at the given time. The first usage of a new day removes the
+// periods that have passed.
+func (t *QuotaTracker) Add(user string, at time.Time, usage Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.usage[user] == nil {
+		t.usage[user] = map[string]*PeriodUsage{}
+	}
+	day, month := quotaPeriods(at)
+	for _, period := range []string{day, month} {
+		if t.usage[user][period] == nil {
+			t.usage[user][period] = &PeriodUsage{Period: period}
+		}
+		t.usage[user][period].add(usage)
+	}
+	if day > t.prunedDay {
+		t.prune(day, month)
+		t.prunedDay = day
+	}
+}
+
+// prune removes the usage of days before day and months before month, and users without usage left.
+// Periods are compared as strings, which sort chronologically.
+func (t *QuotaTracker) prune(day, month string) {
+	for user, periods := range t.usage {
+		for period := range periods {
+			if (len(period) == len(day) && period < day) || (len(period) == len(month) && period < month) {
+				delete(periods, period)
+			}
+		}
+		if len(periods) == 0 {
+			delete(t.usage, user)
+		}
+	}
+}
+
+// Usage returns the usage of the user in the day and month of at.
+func (t *QuotaTracker) Usage(user string, at time.Time) (PeriodUsage, PeriodUsage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	day, month := quotaPeriods(at)
+	dayUsage, monthUsage := PeriodUsage{Period: day}, PeriodUsage{Period: month}
+	if usage := t.usage[user][day]; usage != nil {
+		dayUsage = *usage
+	}
+	if usage := t.usage[user][month]; usage != nil {
+		monthUsage = *usage
+	}
+	return dayUsage, monthUsage
+}
+
+// Check returns a *QuotaError if the recorded usage of the user plus the pending usage of a running
+// request reaches any of the limits.
+func (t *QuotaTracker) Check(user string, now time.Time, limits QuotaLimits, pending Usage) error {
+	for _, check := range t.checks(user, now, limits, pending) {
+		if check.Limit > 0 && check.Used >= check.Limit {
+			return &check
+		}
+	}
+	return nil
+}
+
+// CheckRecording returns a *QuotaError if transcribing a recording of the given duration on top of the
+// recorded and pending usage of the user would exceed an audio limit. It is checked before a recording is
+// split, so recordings longer than the remaining quota are rejected before they are sent to OpenAI.
+func (t *QuotaTracker) CheckRecording(user string, now time.Time, limits QuotaLimits, pending Usage, duration time.Duration) error {
+	pending.AudioSeconds += duration.Seconds()
+	for _, check := range t.checks(user, now, limits, pending) {
+		if check.Resource == quotaResourceAudioMinutes && check.Limit > 0 && check.Used > check.Limit {
+			return &check
+		}
+	}
+	return nil
+}
+
+// checks returns the usage of the user plus the pending usage against every limit.
+func (t *QuotaTracker) checks(user string, now time.Time, limits QuotaLimits, pending Usage) []QuotaError {
+	day, month := t.Usage(user, now)
+	day.add(pending)
+	month.add(pending)
+
+	now = now.UTC()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	nextDay := startOfDay.AddDate(0, 0, 1)
+	nextMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0)
+
+	return []QuotaError{
+		{Period: quotaPeriodDay, Resource: quotaResourceAudioMinutes, Used: day.AudioMinutes, Limit: limits.AudioMinutesPerDay, ResetAt: nextDay},
+		{Period: quotaPeriodMonth, Resource: quotaResourceAudioMinutes, Used: month.AudioMinutes, Limit: limits.AudioMinutesPerMonth, ResetAt: nextMonth},
+		{Period: quotaPeriodDay, Resource: quotaResourceTokens, Used: float64(day.Tokens), Limit: float64(limits.TokensPerDay), ResetAt: nextDay},
+		{Period: quotaPeriodMonth, Resource: quotaResourceTokens, Used: float64(month.Tokens), Limit: float64(limits.TokensPerMonth), ResetAt: nextMonth},
+	}
+}
+
+// userID returns the ID of the user making the request. Requests without an authenticated user are
+// identified by their client IP address.
+func userID(c *gin.Context) string {
+	if user := c.GetString(contextKeyUser); user != "" {
+		return user
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// abortOnQuotaError responds with 429 Too Many Requests and reports true if err is a quota error.
+func abortOnQuotaError(c *gin.Context, err error) bool {
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+
+	logEvent(c, slog.LevelWarn, "quota_exceeded", gin.H{
+		"user":     userID(c),
+		"period":   quotaErr.Period,
+		"resource": quotaErr.Resource,
+		"used":     quotaErr.Used,
+		"limit":    quotaErr.Limit,
+	})
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(quotaErr.ResetAt).Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, quotaErrorBody(quotaErr))
+	return true
+}
+
+func quotaErrorBody(err *QuotaError) gin.H {
+	return gin.H{"error": "Quota exceeded: " + err.Error(), "quota": err}
+}
+
+// usageHandler returns the usage and limits of the requesting user.
+func usageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := userID(c)
+		day, month := quotaTracker.Usage(user, time.Now())
+		c.JSON(http.StatusOK, gin.H{
+			"user":   user,
+			"day":    day,
+			"month":  month,
+			"limits": quotaLimits,
+		})
+	}
+}
+
+// loadQuotas configures the quota limits from the environment and restores the usage of the current
+// month from the usage log.
+func loadQuotas() error {
+	limits, err := loadQuotaLimits(os.Getenv)
+	if err != nil {
+		return err
+	}
+	quotaLimits = limits
+
+	records, err := usageLog.Records()
+	if err != nil {
+		return err
+	}
+	quotaTracker.Load(records, time.Now())
+	return nil
+}
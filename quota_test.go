@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withQuotas sets the quota limits and a fresh tracker for the duration of the test.
+func withQuotas(t *testing.T, limits QuotaLimits) {
+	previousLimits, previousTracker := quotaLimits, quotaTracker
+	quotaLimits, quotaTracker = limits, newQuotaTracker()
+	t.Cleanup(func() { quotaLimits, quotaTracker = previousLimits, previousTracker })
+}
+
+func TestLoadQuotaLimits(t *testing.T) {
+	env := map[string]string{
+		"QUOTA_AUDIO_MINUTES_PER_DAY":   "60",
+		"QUOTA_AUDIO_MINUTES_PER_MONTH": "600.5",
+		"QUOTA_TOKENS_PER_MONTH":        "1000000",
+	}
+	limits, err := loadQuotaLimits(func(name string) string { return env[name] })
+	require.NoError(t, err)
+	assert.Equal(t, QuotaLimits{AudioMinutesPerDay: 60, AudioMinutesPerMonth: 600.5, TokensPerMonth: 1000000}, limits)
+
+	for name, value := range map[string]string{"QUOTA_TOKENS_PER_DAY": "1.5", "QUOTA_AUDIO_MINUTES_PER_DAY": "-1"} {
+		_, err := loadQuotaLimits(func(n string) string {
+			if n == name {
+				return value
+			}
+			return ""
+		})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestQuotaTracker(t *testing.T) {
+	tracker := newQuotaTracker()
+	now := time.Date(2024, 5, 31, 22, 0, 0, 0, time.UTC)
+	tracker.Add("alice", now.AddDate(0, 0, -1), Usage{AudioSeconds: 1800, PromptTokens: 100, Cost: 0.5})
+	tracker.Add("alice", now, Usage{AudioSeconds: 600, CompletionTokens: 50, Cost: 0.25})
+	tracker.Add("bob", now, Usage{PromptTokens: 1000})
+
+	day, month := tracker.Usage("alice", now)
+	assert.Equal(t, PeriodUsage{Period: "2024-05-31", Requests: 1, AudioMinutes: 10, Tokens: 50, Cost: 0.25}, day)
+	assert.Equal(t, PeriodUsage{Period: "2024-05", Requests: 2, AudioMinutes: 40, Tokens: 150, Cost: 0.75}, month)
+
+	assert.NoError(t, tracker.Check("alice", now, QuotaLimits{AudioMinutesPerDay: 11, TokensPerMonth: 200}, Usage{}))
+
+	err := tracker.Check("alice", now, QuotaLimits{AudioMinutesPerDay: 11}, Usage{AudioSeconds: 60})
+	var quotaErr *QuotaError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Equal(t, QuotaError{
+		Period:   quotaPeriodDay,
+		Resource: quotaResourceAudioMinutes,
+		Used:     11,
+		Limit:    11,
+		ResetAt:  time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+	}, *quotaErr)
+
+	err = tracker.Check("alice", now, QuotaLimits{TokensPerMonth: 150}, Usage{})
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, quotaPeriodMonth, quotaErr.Period)
+	assert.Equal(t, quotaResourceTokens, quotaErr.Resource)
+
+	// a new month starts with an empty quota
+	assert.NoError(t, tracker.Check("alice", now.Add(3*time.Hour), QuotaLimits{TokensPerMonth: 150}, Usage{}))
+
+	// a recording may use up the remaining audio minutes, but not more
+	limits := QuotaLimits{AudioMinutesPerDay: 15, TokensPerMonth: 150}
+	assert.NoError(t, tracker.CheckRecording("alice", now, limits, Usage{}, 5*time.Minute))
+	err = tracker.CheckRecording("alice", now, limits, Usage{AudioSeconds: 60}, 5*time.Minute)
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, quotaResourceAudioMinutes, quotaErr.Resource)
+	assert.Equal(t, 16.0, quotaErr.Used)
+}
+
+func TestQuotaTracker_RemovesPastPeriods(t *testing.T) {
+	tracker := newQuotaTracker()
+	now := time.Date(2024, 5, 31, 22, 0, 0, 0, time.UTC)
+	tracker.Add("alice", now.AddDate(0, 0, -1), Usage{PromptTokens: 100})
+	tracker.Add("bob", now, Usage{PromptTokens: 10})
+	tracker.Add("alice", now, Usage{PromptTokens: 50})
+
+	// the previous day of the month is removed, the month is kept
+	assert.Equal(t, map[string]map[string]*PeriodUsage{
+		"alice": {
+			"2024-05-31": {Period: "2024-05-31", Requests: 1, Tokens: 50},
+			"2024-05":    {Period: "2024-05", Requests: 2, Tokens: 150},
+		},
+		"bob": {
+			"2024-05-31": {Period: "2024-05-31", Requests: 1, Tokens: 10},
+			"2024-05":    {Period: "2024-05", Requests: 1, Tokens: 10},
+		},
+	}, tracker.usage)
+
+	// a new month removes the old month and users without usage in it
+	tracker.Add("alice", now.Add(3*time.Hour), Usage{PromptTokens: 5})
+	assert.Equal(t, map[string]map[string]*PeriodUsage{
+		"alice": {
+			"2024-06-01": {Period: "2024-06-01", Requests: 1, Tokens: 5},
+			"2024-06":    {Period: "2024-06", Requests: 1, Tokens: 5},
+		},
+	}, tracker.usage)
+
+	// late usage of a past day does not remove the current periods
+	tracker.Add("bob", now, Usage{PromptTokens: 10})
+	day, month := tracker.Usage("alice", now.Add(3*time.Hour))
+	assert.Equal(t, 5, day.Tokens)
+	assert.Equal(t, 5, month.Tokens)
+}
+
+func TestQuotaTracker_Load(t *testing.T) {
+	tracker := newQuotaTracker()
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	tracker.Load([]UsageRecord{
+		{Time: now.AddDate(0, -1, 0), User: "alice", Usage: Usage{PromptTokens: 1000}},
+		{Time: now.AddDate(0, 0, -3), User: "alice", Usage: Usage{PromptTokens: 10}},
+		{Time: now, User: "alice", Usage: Usage{PromptTokens: 5}},
+	}, now)
+
+	day, month := tracker.Usage("alice", now)
+	assert.Equal(t, 5, day.Tokens)
+	assert.Equal(t, 15, month.Tokens)
+}
+
+func TestUsageClient_EnforcesQuotaDuringProcessing(t *testing.T) {
+	withQuotas(t, QuotaLimits{TokensPerDay: 1000})
+	client := newUsageClient(&usageMockClient{chatFuncClient{complete: func(prompt string) string { return "answer" }}}, "alice")
+	request := openai.ChatCompletionRequest{Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "prompt"}}}
+
+	// the first request is allowed, its 1200 tokens exhaust the quota for the second one
+	_, err := client.CreateChatCompletion(context.Background(), request)
+	require.NoError(t, err)
+	_, err = client.CreateChatCompletion(context.Background(), request)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = client.CreateTranscription(context.Background(), openai.AudioRequest{})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestTranscribeHandler_RecordingExceedsQuota(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previousTempRoot := tempRoot
+	tempRoot = t.TempDir()
+	defer func() { tempRoot = previousTempRoot }()
+	withQuotas(t, QuotaLimits{AudioMinutesPerDay: 10})
+	quotaTracker.Add("ip:192.0.2.1", time.Now(), Usage{AudioSeconds: 300})
+
+	mp3, err := os.ReadFile("test/fixtures/short.mp3")
+	require.NoError(t, err)
+	client := &countingTranscriber{}
+	r := gin.New()
+	r.POST("/api/transcribe", transcribeHandler(client))
+	transcribe := func() *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, err := form.CreateFormFile("audio", "talk.mp3")
+		require.NoError(t, err)
+		_, err = part.Write(mp3)
+		require.NoError(t, err)
+		require.NoError(t, form.Close())
+		req := httptest.NewRequest(http.MethodPost, "/api/transcribe", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// the recording is longer than the remaining 5 minutes
+	long := shortMP3
+	long.Duration = 6 * time.Minute
+	fakeMediaProbe(t, long, nil)
+	w := transcribe()
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), quotaResourceAudioMinutes)
+	assert.Zero(t, client.transcriptions)
+
+	fakeMediaProbe(t, shortMP3, nil)
+	assert.Equal(t, http.StatusOK, transcribe().Code)
+}
+
+func TestQuotaEndpoints(t *testing.T) {
+	withQuotas(t, QuotaLimits{TokensPerDay: 1000})
+	quotaTracker.Add("alice", time.Now(), Usage{PromptTokens: 1000, Cost: 0.01})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(contextKeyUser, c.GetHeader("X-Test-User"))
+	})
+	r.POST("/api/transform", transformHandler(&chatFuncClient{complete: func(prompt string) string { return "summary" }}))
+	r.GET("/api/usage", usageHandler())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/transform", strings.NewReader(`{"text": "Some text.", "operation": "summary", "language": "en"}`))
+	req.Header.Set("X-Test-User", "alice")
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	var body struct {
+		Error string     `json:"error"`
+		Quota QuotaError `json:"quota"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.True(t, strings.HasPrefix(body.Error, "Quota exceeded: 1000 of 1000 tokens per day used"), body.Error)
+	assert.Equal(t, quotaResourceTokens, body.Quota.Resource)
+
+	// other users are not affected
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/transform", strings.NewReader(`{"text": "Some text.", "operation": "summary", "language": "en"}`))
+	req.Header.Set("X-Test-User", "bob")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/usage", nil)
+	req.Header.Set("X-Test-User", "alice")
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var usage struct {
+		User   string      `json:"user"`
+		Day    PeriodUsage `json:"day"`
+		Month  PeriodUsage `json:"month"`
+		Limits QuotaLimits `json:"limits"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	assert.Equal(t, "alice", usage.User)
+	// the rejected request is recorded without usage
+	assert.Equal(t, 2, usage.Day.Requests)
+	assert.Equal(t, 1000, usage.Month.Tokens)
+	assert.Equal(t, 1000, usage.Limits.TokensPerDay)
+}
+
+func TestUserID(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("GET", "/api/usage", nil)
+	c.Request.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "ip:192.0.2.1", userID(c))
+
+	c.Set(contextKeyUser, "alice")
+	assert.Equal(t, "alice", userID(c))
+}
+
+func TestUserID_TrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	userOf := func(trustedProxies []string) string {
+		r := gin.New()
+		require.NoError(t, r.SetTrustedProxies(trustedProxies))
+		r.GET("/api/usage", func(c *gin.Context) { c.String(http.StatusOK, userID(c)) })
+		req := httptest.NewRequest(http.MethodGet, "/api/usage", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// a client cannot change its identity with a spoofed header
+	assert.Equal(t, "ip:192.0.2.1", userOf(splitList("")))
+	assert.Equal(t, "ip:192.0.2.1", userOf(splitList("10.0.0.0/8")))
+	// behind a trusted proxy, the client is identified by the forwarded address
+	assert.Equal(t, "ip:198.51.100.7", userOf(splitList("192.0.2.0/24")))
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	uploadsDir         = "uploads"
+	uploadMetadataFile = "upload.json"
+	uploadDataFile     = "data"
+
+	// headerUploadOffset carries the number of bytes received so far, as in the tus protocol.
+	headerUploadOffset = "Upload-Offset"
+	headerUploadLength = "Upload-Length"
+
+	// resumableUploadTTL is how long an upload can be resumed after its last part was received.
+	resumableUploadTTL = 24 * time.Hour
+)
+
+var (
+	ErrUploadNotFound    = errors.New("upload not found")
+	ErrOffsetMismatch    = errors.New("upload offset does not match the received bytes")
+	ErrUploadIncomplete  = errors.New("upload is incomplete")
+	ErrInvalidUploadSize = errors.New("invalid upload size")
+)
+
+// ResumableUpload is a recording uploaded in parts.
+type ResumableUpload struct {
+	ID       string `json:"id"`
+	User     string `json:"-"`
+	Filename string `json:"filename,omitempty"`
+	// Size is the total size of the recording in bytes.
+	Size int64 `json:"size"`
+	// Offset is the number of bytes received so far.
+	Offset int64 `json:"offset"`
+	// Format is the file extension of the detected format, once enough bytes were received.
+	Format    string    `json:"format,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Complete reports whether all bytes of the upload were received.
+func (u ResumableUpload) Complete() bool {
+	return u.Offset == u.Size
+}
+
+// uploadMetadata is the part of an upload stored in upload.json. The offset is the size of the data file.
+type uploadMetadata struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Filename  string    `json:"filename,omitempty"`
+	Size      int64     `json:"size"`
+	Format    string    `json:"format,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UploadStore keeps resumable uploads on disk, every upload in its own directory, so uploads survive
+// restarts of the server.
+type UploadStore struct {
+	dir string
+
+	mu sync.Mutex
+	// locks serializes the requests of every upload.
+	locks map[string]*sync.Mutex
+}
+
+// openUploadStore creates the uploads directory in the data directory and removes expired uploads.
+func openUploadStore(dataDir string) (*UploadStore, error) {
+	store := &UploadStore{dir: filepath.Join(dataDir, uploadsDir), locks: map[string]*sync.Mutex{}}
+	if err := os.MkdirAll(store.dir, 0o700); err != nil {
+		return nil, err
+	}
+	if _, err := store.RemoveExpired(time.Now()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// lock locks the upload and returns the function unlocking it.
+func (s *UploadStore) lock(id string) func() {
+	s.mu.Lock()
+	lock, ok := s.locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[id] = lock
+	}
+	s.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Create starts an upload of the user for a recording of the given size.
+func (s *UploadStore) Create(user, filename string, size int64) (ResumableUpload, error) {
+	if size <= 0 {
+		return ResumableUpload{}, ErrInvalidUploadSize
+	}
+	if size > maxUploadBytes {
+		return ResumableUpload{}, ErrUploadTooLarge
+	}
+	if _, err := s.RemoveExpired(time.Now()); err != nil {
+		logEvent(context.Background(), slog.LevelWarn, "upload_cleanup_failed", gin.H{
+			"error": err.Error(),
+		})
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ResumableUpload{}, err
+	}
+	metadata := uploadMetadata{
+		ID:        hex.EncodeToString(id),
+		User:      user,
+		Size:      size,
+		CreatedAt: time.Now().UTC(),
+	}
+	if filename != "" {
+		metadata.Filename = filepath.Base(filename)
+	}
+
+	dir := filepath.Join(s.dir, metadata.ID)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return ResumableUpload{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, uploadDataFile), nil, 0o600); err != nil {
+		return ResumableUpload{}, err
+	}
+	if err := s.writeMetadata(metadata); err != nil {
+		return ResumableUpload{}, err
+	}
+	return s.load(user, metadata.ID)
+}
+
+// Get returns the upload of the user. Uploads of other users are not found.
+func (s *UploadStore) Get(user, id string) (ResumableUpload, error) {
+	defer s.lock(id)()
+	return s.load(user, id)
+}
+
+// Append writes the body to the upload if offset matches the bytes received so far. Bytes received
+// before the body fails are kept, so the client can resume from the returned offset. The format of the
+// recording is checked as soon as enough bytes were received.
+func (s *UploadStore) Append(user, id string, offset int64, body io.Reader) (ResumableUpload, error) {
+	defer s.lock(id)()
+	upload, err := s.load(user, id)
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrOffsetMismatch
+	}
+
+	file, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return upload, err
+	}
+	// Copy one byte more than missing to detect bodies exceeding the size of the upload.
+	_, copyErr := io.Copy(file, io.LimitReader(body, upload.Size-upload.Offset+1))
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	received, err := s.load(user, id)
+	if err != nil {
+		return upload, err
+	}
+	if received.Offset > received.Size {
+		if err := os.Truncate(s.dataPath(id), received.Size); err != nil {
+			return upload, err
+		}
+		received.Offset = received.Size
+		copyErr = ErrUploadTooLarge
+	}
+
+	if received.Format == "" && (received.Offset >= sniffBytes || received.Complete()) {
+		format, err := s.sniff(id)
+		if err != nil {
+			return received, err
+		}
+		if format == "" {
+			s.remove(id)
+			return received, ErrUnsupportedMediaType
+		}
+		metadata := uploadMetadata{ID: id, User: user, Filename: received.Filename, Size: received.Size, Format: format, CreatedAt: received.CreatedAt}
+		if err := s.writeMetadata(metadata); err != nil {
+			return received, err
+		}
+		received.Format = format
+	}
+	return received, copyErr
+}
+
+// Delete removes the upload of the user.
+func (s *UploadStore) Delete(user, id string) error {
+	defer s.lock(id)()
+	if _, err := s.load(user, id); err != nil {
+		return err
+	}
+	return s.remove(id)
+}
+
+// RemoveExpired removes uploads that have not received a part for resumableUploadTTL.
+func (s *UploadStore) RemoveExpired(now time.Time) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		// The data file is modified by every part, the directory only when the upload is created.
+		info, err := os.Stat(s.dataPath(entry.Name()))
+		if err != nil {
+			if info, err = entry.Info(); err != nil {
+				continue
+			}
+		}
+		if now.Sub(info.ModTime()) < resumableUploadTTL {
+			continue
+		}
+		unlock := s.lock(entry.Name())
+		err = s.remove(entry.Name())
+		unlock()
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Path returns the file of a complete upload of the user.
+func (s *UploadStore) Path(user, id string) (ResumableUpload, string, error) {
+	defer s.lock(id)()
+	upload, err := s.load(user, id)
+	if err != nil {
+		return ResumableUpload{}, "", err
+	}
+	if !upload.Complete() || upload.Format == "" {
+		return upload, "", ErrUploadIncomplete
+	}
+	return upload, s.dataPath(id), nil
+}
+
+// load reads the upload. The caller must hold the lock of the upload.
+func (s *UploadStore) load(user, id string) (ResumableUpload, error) {
+	if !validUploadID(id) {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+	content, err := os.ReadFile(filepath.Join(s.dir, id, uploadMetadataFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+	var metadata uploadMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return ResumableUpload{}, fmt.Errorf("parsing upload %s: %w", id, err)
+	}
+	if metadata.User != user {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+
+	info, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+	return ResumableUpload{
+		ID:        metadata.ID,
+		User:      metadata.User,
+		Filename:  metadata.Filename,
+		Size:      metadata.Size,
+		Offset:    info.Size(),
+		Format:    metadata.Format,
+		CreatedAt: metadata.CreatedAt,
+		ExpiresAt: info.ModTime().Add(resumableUploadTTL).UTC(),
+	}, nil
+}
+
+func (s *UploadStore) writeMetadata(metadata uploadMetadata) error {
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, metadata.ID, uploadMetadataFile)
+	if err := os.WriteFile(path+".tmp", content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// sniff detects the format of the upload from its first bytes. It returns an empty format if the upload
+// is not a known audio or video format.
+func (s *UploadStore) sniff(id string) (string, error) {
+	file, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	header := make([]byte, sniffBytes)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	format, _ := sniffMediaType(header[:n])
+	return format, nil
+}
+
+func (s *UploadStore) remove(id string) error {
+	s.mu.Lock()
+	delete(s.locks, id)
+	s.mu.Unlock()
+	return os.RemoveAll(filepath.Join(s.dir, id))
+}
+
+func (s *UploadStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id, uploadDataFile)
+}
+
+// validUploadID reports whether the ID has the form created by Create, so it is safe to use in paths.
+func validUploadID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == 16
+}
+
+// CreateUploadRequest is the JSON body of POST /api/uploads.
+type CreateUploadRequest struct {
+	// Size is the size of the recording in bytes.
+	Size     int64  `json:"size" binding:"required"`
+	Filename string `json:"filename"`
+}
+
+// CompleteUploadRequest is the JSON body of POST /api/uploads/:id/complete.
+type CompleteUploadRequest struct {
+	PromptVersion string `json:"prompt_version"`
+	Language      string `json:"language"`
+}
+
+// createUploadHandler starts a resumable upload.
+func createUploadHandler(uploads *UploadStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request CreateUploadRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: size is required"})
+			return
+		}
+
+		upload, err := uploads.Create(userID(c), request.Filename, request.Size)
+		if err != nil {
+			abortOnResumableUploadError(c, upload, err)
+			return
+		}
+		setJobID(c, upload.ID)
+		logEvent(c, slog.LevelInfo, "upload_created", gin.H{
+			"upload_id": upload.ID,
+			"user":      userID(c),
+			"size":      upload.Size,
+		})
+		c.Header("Location", "/api/uploads/"+upload.ID)
+		c.JSON(http.StatusCreated, upload)
+	}
+}
+
+// uploadStatusHandler returns the upload, so clients know the offset to resume from.
+func uploadStatusHandler(uploads *UploadStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		upload, err := uploads.Get(userID(c), c.Param("id"))
+		if err != nil {
+			abortOnResumableUploadError(c, upload, err)
+			return
+		}
+		setUploadHeaders(c, upload)
+		c.JSON(http.StatusOK, upload)
+	}
+}
+
+// appendUploadHandler appends the request body to the upload at the offset of the Upload-Offset header.
+func appendUploadHandler(uploads *UploadStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		offset, err := strconv.ParseInt(c.GetHeader(headerUploadOffset), 10, 64)
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or missing " + headerUploadOffset + " header"})
+			return
+		}
+		setJobID(c, c.Param("id"))
+
+		upload, err := uploads.Append(userID(c), c.Param("id"), offset, c.Request.Body)
+		if err != nil {
+			abortOnResumableUploadError(c, upload, err)
+			return
+		}
+		setUploadHeaders(c, upload)
+		c.JSON(http.StatusOK, upload)
+	}
+}
+
+// deleteUploadHandler aborts an upload.
+func deleteUploadHandler(uploads *UploadStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := uploads.Delete(userID(c), c.Param("id")); err != nil {
+			abortOnResumableUploadError(c, ResumableUpload{}, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// completeUploadHandler transcribes a complete upload like /api/transcribe. The upload is removed once
+// it was transcribed, and kept if the transcription fails, so it can be completed again.
+func completeUploadHandler(client OpenAIClient, uploads *UploadStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := requestClient(c, client)
+		defer client.save(c)
+		if abortOnQuotaError(c, client.checkQuota()) {
+			return
+		}
+
+		var request CompleteUploadRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+				return
+			}
+		}
+
+		id := c.Param("id")
+		setJobID(c, id)
+		upload, path, err := uploads.Path(userID(c), id)
+		if err != nil {
+			abortOnResumableUploadError(c, upload, err)
+			return
+		}
+
+		dir, err := newRequestTempDir()
+		if err != nil {
+			logEvent(c, slog.LevelError, "temp_dir_failed", gin.H{
+				"error": err.Error(),
+			})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing upload"})
+			return
+		}
+		defer removeRequestTempDir(dir)
+
+		// Whisper recognizes the format by the file extension.
+		recording := filepath.Join(dir, "upload."+upload.Format)
+		if err := os.Link(path, recording); err != nil {
+			if err := copyFile(path, recording); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing upload"})
+				return
+			}
+		}
+		observeUpload(uploadSourceResumable, upload.Size)
+		logEvent(c, slog.LevelInfo, "upload_completed", gin.H{
+			"upload_id": upload.ID,
+			"size":      upload.Size,
+			"format":    upload.Format,
+		})
+
+		if transcribeRecording(c, client, recording, dir, request.PromptVersion, request.Language) {
+			if err := uploads.Delete(userID(c), id); err != nil {
+				logEvent(c, slog.LevelWarn, "upload_cleanup_failed", gin.H{
+					"upload_id": id,
+					"error":     err.Error(),
+				})
+			}
+		}
+	}
+}
+
+// copyFile copies src to a new file dst.
+func copyFile(src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return saveFile(file, dst)
+}
+
+func setUploadHeaders(c *gin.Context, upload ResumableUpload) {
+	c.Header(headerUploadOffset, strconv.FormatInt(upload.Offset, 10))
+	c.Header(headerUploadLength, strconv.FormatInt(upload.Size, 10))
+}
+
+// abortOnResumableUploadError responds with the status matching the error. The current offset is sent
+// with errors after which the client can resume.
+func abortOnResumableUploadError(c *gin.Context, upload ResumableUpload, err error) {
+	if upload.ID != "" {
+		setUploadHeaders(c, upload)
+	}
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+	case errors.Is(err, ErrOffsetMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload offset mismatch, resume at offset %d", upload.Offset), "offset": upload.Offset})
+	case errors.Is(err, ErrUploadIncomplete):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload incomplete, %d of %d bytes received", upload.Offset, upload.Size), "offset": upload.Offset})
+	case errors.Is(err, ErrInvalidUploadSize):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload size"})
+	case errors.Is(err, ErrUploadTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File too large, the limit is %d MB", maxUploadBytes>>20)})
+	case errors.Is(err, ErrUnsupportedMediaType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported file type, upload an audio or video file"})
+	default:
+		logEvent(c, slog.LevelError, "resumable_upload_failed", gin.H{
+			"upload_id": upload.ID,
+			"error":     err.Error(),
+		})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing upload", "offset": upload.Offset})
+	}
+}
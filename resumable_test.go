@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingReader returns an error after the content was read, like a connection that drops.
+type failingReader struct {
+	content io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestUploadStore(t *testing.T) {
+	store, err := openUploadStore(t.TempDir())
+	require.NoError(t, err)
+	mp3, err := os.ReadFile("test/fixtures/short.mp3")
+	require.NoError(t, err)
+	size := int64(len(mp3))
+
+	_, err = store.Create("alice", "talk.mp3", 0)
+	assert.ErrorIs(t, err, ErrInvalidUploadSize)
+	_, err = store.Create("alice", "talk.mp3", maxUploadBytes+1)
+	assert.ErrorIs(t, err, ErrUploadTooLarge)
+
+	upload, err := store.Create("alice", "../talk.mp3", size)
+	require.NoError(t, err)
+	assert.Equal(t, "talk.mp3", upload.Filename)
+	assert.Zero(t, upload.Offset)
+	assert.False(t, upload.Complete())
+
+	_, err = store.Get("bob", upload.ID)
+	assert.ErrorIs(t, err, ErrUploadNotFound, "uploads of other users are not found")
+	_, err = store.Get("alice", "../../etc")
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+
+	// the connection drops after the first bytes, they are kept
+	upload, err = store.Append("alice", upload.ID, 0, &failingReader{bytes.NewReader(mp3[:1000])})
+	assert.Error(t, err)
+	assert.Equal(t, int64(1000), upload.Offset)
+	assert.Equal(t, "mp3", upload.Format)
+
+	_, err = store.Append("alice", upload.ID, 0, bytes.NewReader(mp3))
+	assert.ErrorIs(t, err, ErrOffsetMismatch)
+
+	_, _, err = store.Path("alice", upload.ID)
+	assert.ErrorIs(t, err, ErrUploadIncomplete)
+
+	// bytes beyond the announced size are dropped
+	upload, err = store.Append("alice", upload.ID, 1000, bytes.NewReader(append(mp3[1000:], "extra"...)))
+	assert.ErrorIs(t, err, ErrUploadTooLarge)
+	assert.True(t, upload.Complete())
+
+	upload, path, err := store.Path("alice", upload.ID)
+	require.NoError(t, err)
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, mp3, saved)
+
+	require.NoError(t, store.Delete("alice", upload.ID))
+	_, err = store.Get("alice", upload.ID)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+}
+
+func TestUploadStore_RejectsUnsupportedMediaType(t *testing.T) {
+	store, err := openUploadStore(t.TempDir())
+	require.NoError(t, err)
+
+	upload, err := store.Create("alice", "", 2*sniffBytes)
+	require.NoError(t, err)
+	_, err = store.Append("alice", upload.ID, 0, strings.NewReader(strings.Repeat("not audio ", sniffBytes/10+1)))
+	assert.ErrorIs(t, err, ErrUnsupportedMediaType)
+	_, err = store.Get("alice", upload.ID)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+}
+
+func TestUploadStore_RemoveExpired(t *testing.T) {
+	store, err := openUploadStore(t.TempDir())
+	require.NoError(t, err)
+	expired, err := store.Create("alice", "", 100)
+	require.NoError(t, err)
+	active, err := store.Create("alice", "", 100)
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * resumableUploadTTL)
+	require.NoError(t, os.Chtimes(store.dataPath(expired.ID), old, old))
+
+	removed, err := store.RemoveExpired(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	_, err = store.Get("alice", expired.ID)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	_, err = store.Get("alice", active.ID)
+	assert.NoError(t, err)
+}
+
+func TestResumableUploadHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previousTempRoot := tempRoot
+	tempRoot = t.TempDir()
+	defer func() { tempRoot = previousTempRoot }()
+	fakeMediaProbe(t, shortMP3, nil)
+
+	uploads, err := openUploadStore(t.TempDir())
+	require.NoError(t, err)
+	r := gin.New()
+	r.POST("/api/uploads", createUploadHandler(uploads))
+	r.GET("/api/uploads/:id", uploadStatusHandler(uploads))
+	r.PATCH("/api/uploads/:id", appendUploadHandler(uploads))
+	r.DELETE("/api/uploads/:id", deleteUploadHandler(uploads))
+	r.POST("/api/uploads/:id/complete", completeUploadHandler(&mockOpenAIClient{}, uploads))
+
+	serve := func(method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, body)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	mp3, err := os.ReadFile("test/fixtures/short.mp3")
+	require.NoError(t, err)
+
+	w := serve("POST", "/api/uploads", strings.NewReader(`{"size": `+strconv.Itoa(len(mp3))+`, "filename": "talk.mp3"}`), nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var upload ResumableUpload
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &upload))
+	location := w.Header().Get("Location")
+	assert.Equal(t, "/api/uploads/"+upload.ID, location)
+
+	half := len(mp3) / 2
+	w = serve("PATCH", location, bytes.NewReader(mp3[:half]), map[string]string{headerUploadOffset: "0"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(half), w.Header().Get(headerUploadOffset))
+
+	w = serve("POST", location+"/complete", nil, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// resuming at a wrong offset tells the client where to continue
+	w = serve("PATCH", location, bytes.NewReader(mp3), map[string]string{headerUploadOffset: "0"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, strconv.Itoa(half), w.Header().Get(headerUploadOffset))
+
+	w = serve("GET", location, nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(half), w.Header().Get(headerUploadOffset))
+	assert.Equal(t, strconv.Itoa(len(mp3)), w.Header().Get(headerUploadLength))
+
+	w = serve("PATCH", location, bytes.NewReader(mp3[half:]), map[string]string{headerUploadOffset: strconv.Itoa(half)})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serve("POST", location+"/complete", strings.NewReader(`{"language": "en"}`), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Transcription string `json:"transcription"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "mock corrected transcription", strings.TrimSpace(response.Transcription))
+
+	// the upload is removed once it was transcribed
+	assert.Equal(t, http.StatusNotFound, serve("GET", location, nil, nil).Code)
+	entries, err := os.ReadDir(tempRoot)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "request temp dirs are removed")
+
+	w = serve("POST", "/api/uploads", strings.NewReader(`{"size": 10}`), nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &upload))
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/api/uploads/"+upload.ID, nil, nil).Code)
+	assert.NoDirExists(t, filepath.Join(uploads.dir, upload.ID))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultShutdownTimeout = 5 * time.Minute
+
+	// cancelGracePeriod is how long requests cancelled at the end of the shutdown timeout get to clean up.
+	cancelGracePeriod = 5 * time.Second
+)
+
+// loadListenAddr returns the address to listen on, :PORT or :8080 like gin's Run.
+func loadListenAddr(getenv func(string) string) string {
+	if port := getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// loadShutdownTimeout reads how long requests in flight may take to finish after a shutdown signal from
+// SHUTDOWN_TIMEOUT, a duration such as 90s or 10m.
+func loadShutdownTimeout(getenv func(string) string) (time.Duration, error) {
+	value := getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return defaultShutdownTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("SHUTDOWN_TIMEOUT must be a non-negative duration such as 90s or 10m: %q", value)
+	}
+	return timeout, nil
+}
+
+// Server serves HTTP requests and shuts down gracefully: once draining, it refuses new requests and waits
+// for the requests in flight, including their transcription pipelines, until the shutdown timeout. Requests
+// still running then are cancelled.
+type Server struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	draining bool
+	active   int
+	idle     chan struct{}
+}
+
+func newServer(timeout time.Duration) *Server {
+	return &Server{timeout: timeout, idle: make(chan struct{})}
+}
+
+// middleware counts the requests in flight and responds with 503 Service Unavailable to requests arriving
+// on open connections while the server is draining.
+func (s *Server) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.start() {
+			c.Header("Connection", "close")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+			return
+		}
+		defer s.finish()
+		c.Next()
+	}
+}
+
+func (s *Server) start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.active++
+	return true
+}
+
+func (s *Server) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.draining && s.active == 0 {
+		close(s.idle)
+	}
+}
+
+// drain stops accepting requests and returns the number of requests in flight.
+func (s *Server) drain() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.draining {
+		s.draining = true
+		if s.active == 0 {
+			close(s.idle)
+		}
+	}
+	return s.active
+}
+
+// Serve handles requests on the listener until ctx is done, e.g. by SIGTERM, and then shuts down. It
+// returns once all requests are done or have been cancelled.
+func (s *Server) Serve(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	// The contexts of all requests are derived from requestsCtx, so cancelling it cancels their pipelines.
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server := &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return requestsCtx },
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	logEvent(ctx, slog.LevelInfo, "server_started", gin.H{
+		"addr": listener.Addr().String(),
+	})
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	logEvent(ctx, slog.LevelInfo, "shutdown_started", gin.H{
+		"in_flight": s.drain(),
+		"timeout":   s.timeout.String(),
+	})
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logEvent(ctx, slog.LevelWarn, "shutdown_cancelling_requests", gin.H{
+			"in_flight": s.drain(),
+		})
+		cancelRequests()
+		select {
+		case <-s.idle:
+		case <-time.After(cancelGracePeriod):
+		}
+		return server.Close()
+	}
+	return err
+}
+
+// waitFor runs wait and returns true once it returns, or false if ctx is done first.
+func waitFor(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
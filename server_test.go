@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadShutdownTimeout(t *testing.T) {
+	env := func(value string) func(string) string {
+		return func(string) string { return value }
+	}
+
+	timeout, err := loadShutdownTimeout(env(""))
+	require.NoError(t, err)
+	assert.Equal(t, defaultShutdownTimeout, timeout)
+
+	timeout, err = loadShutdownTimeout(env("90s"))
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, timeout)
+
+	_, err = loadShutdownTimeout(env("90"))
+	assert.Error(t, err)
+	_, err = loadShutdownTimeout(env("-1s"))
+	assert.Error(t, err)
+
+	assert.Equal(t, ":8080", loadListenAddr(env("")))
+	assert.Equal(t, ":3000", loadListenAddr(env("3000")))
+}
+
+// startServer serves the router with the server until the returned cancel function is called. The error
+// of Serve is sent to the returned channel.
+func startServer(t *testing.T, server *Server, r *gin.Engine) (string, context.CancelFunc, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener, r)
+	}()
+	return "http://" + listener.Addr().String(), cancel, served
+}
+
+func TestServer_DrainsRequestsInFlight(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := newServer(time.Minute)
+	started, release := make(chan struct{}), make(chan struct{})
+	r := gin.New()
+	r.Use(server.middleware())
+	r.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+	url, shutdown, served := startServer(t, server, r)
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if assert.NoError(t, err) {
+			responses <- resp
+		}
+	}()
+	<-started
+	shutdown()
+
+	// New requests are refused while the request in flight finishes.
+	require.Eventually(t, func() bool {
+		_, err := http.Get(url + "/slow")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-served:
+		t.Fatal("Serve returned before the request in flight was done")
+	default:
+	}
+
+	close(release)
+	resp := <-responses
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, <-served)
+}
+
+func TestServer_CancelsRequestsAfterTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := newServer(50 * time.Millisecond)
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	r := gin.New()
+	r.Use(server.middleware())
+	r.GET("/pipeline", func(c *gin.Context) {
+		close(started)
+		<-c.Request.Context().Done()
+		close(cancelled)
+	})
+	url, shutdown, served := startServer(t, server, r)
+
+	go http.Get(url + "/pipeline")
+	<-started
+	shutdown()
+
+	select {
+	case <-served:
+	case <-time.After(cancelGracePeriod):
+		t.Fatal("Serve did not return after the timeout")
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("the request was not cancelled")
+	}
+}
+
+func TestServer_RefusesRequestsWhileDraining(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := newServer(time.Minute)
+	r := gin.New()
+	r.Use(server.middleware())
+	r.GET("/ok", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ok", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, 0, server.drain())
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ok", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+}
+
+func TestRemoveRequestTempDirs(t *testing.T) {
+	finished, err := newRequestTempDir()
+	require.NoError(t, err)
+	removeRequestTempDir(finished)
+
+	cancelled, err := newRequestTempDir()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removeRequestTempDirs())
+	assert.NoDirExists(t, cancelled)
+	_, err = os.Stat(finished)
+	assert.True(t, os.IsNotExist(err))
+}
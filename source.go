@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	downloadRetries = 3
+	downloadTimeout = 30 * time.Minute
+
+	// emptyPayloadHash is the SHA-256 hash of an empty body, signed with every S3 GET request.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	ErrUnsupportedSource = errors.New("unsupported source")
+	ErrSourceNotAllowed  = errors.New("source not allowed")
+	ErrSourceUnavailable = errors.New("source unavailable")
+)
+
+// downloadRetryWaitMin is the minimum wait between download retries, the wait doubles with every retry.
+var downloadRetryWaitMin = time.Second
+
+// SourceConfig configures the sources recordings can be downloaded from.
+type SourceConfig struct {
+	// AllowedHosts are the hosts of http and https sources. "*" allows all hosts. URL sources are disabled
+	// if empty, so the server cannot be used to reach arbitrary internal hosts.
+	AllowedHosts []string
+	// S3Endpoint is the URL of an S3-compatible service such as MinIO. Objects are addressed path-style,
+	// as in https://endpoint/bucket/key. It defaults to AWS S3 in S3Region.
+	S3Endpoint        string
+	S3Region          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	// S3AllowedBuckets are the buckets of s3 sources. "*" allows all buckets the credentials can read.
+	// S3 sources are disabled if empty.
+	S3AllowedBuckets []string
+}
+
+// sources is used by /api/transcribe. It is set in main from the environment.
+var sources SourceConfig
+
+// loadSourceConfig reads the configuration from the environment.
+func loadSourceConfig(getenv func(string) string) SourceConfig {
+	config := SourceConfig{
+		AllowedHosts:      splitList(getenv("SOURCE_ALLOWED_HOSTS")),
+		S3Endpoint:        strings.TrimSuffix(getenv("S3_ENDPOINT"), "/"),
+		S3Region:          getenv("S3_REGION"),
+		S3AccessKeyID:     getenv("S3_ACCESS_KEY_ID"),
+		S3SecretAccessKey: getenv("S3_SECRET_ACCESS_KEY"),
+		S3AllowedBuckets:  splitList(getenv("S3_ALLOWED_BUCKETS")),
+	}
+	if config.S3Region == "" {
+		config.S3Region = "us-east-1"
+	}
+	if config.S3Endpoint == "" {
+		config.S3Endpoint = "https://s3." + config.S3Region + ".amazonaws.com"
+	}
+	return config
+}
+
+// hostAllowed reports whether http and https sources of the host may be downloaded.
+func (config SourceConfig) hostAllowed(u *url.URL) bool {
+	return hostAllowed(config.AllowedHosts, u)
+}
+
+// bucketAllowed reports whether s3 sources of the bucket may be downloaded.
+func (config SourceConfig) bucketAllowed(bucket string) bool {
+	for _, allowed := range config.S3AllowedBuckets {
+		if allowed == "*" || allowed == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAllowed reports whether the host of the URL is in the list. Entries match the host with or without
+// port, "*" matches all hosts.
+func hostAllowed(hosts []string, u *url.URL) bool {
+	for _, host := range hosts {
+		if host == "*" || strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// TranscribeSourceRequest is the JSON body of POST /api/transcribe for recordings that are downloaded
+// instead of uploaded.
+type TranscribeSourceRequest struct {
+	// Source is an http or https URL, or an S3 object as s3://bucket/key.
+	Source        string `json:"source" binding:"required"`
+	PromptVersion string `json:"prompt_version"`
+	Language      string `json:"language"`
+}
+
+// downloadSource downloads the recording of the source to a file in dir, named after the format detected
+// from its content. Like uploads, it is limited to maxBytes.
+func downloadSource(ctx context.Context, config SourceConfig, source, dir string, maxBytes int64) (string, int64, error) {
+	request, err := sourceRequest(ctx, config, source)
+	if err != nil {
+		return "", 0, err
+	}
+
+	client := retryablehttp.NewClient()
+	client.RetryMax = downloadRetries
+	client.RetryWaitMin = downloadRetryWaitMin
+	client.Logger = nil
+	client.RequestLogHook = func(_ retryablehttp.Logger, r *http.Request, attempt int) {
+		if attempt > 0 {
+			logEvent(ctx, slog.LevelWarn, "download_retry", gin.H{
+				"host":        r.URL.Host,
+				"retry":       attempt,
+				"max_retries": downloadRetries,
+			})
+		}
+	}
+	// Redirects must not lead to hosts that are not allowed.
+	client.HTTPClient.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
+		}
+		if r.URL.Host != via[0].URL.Host && !config.hostAllowed(r.URL) {
+			return fmt.Errorf("%w: redirect to %s", ErrSourceNotAllowed, r.URL.Host)
+		}
+		return nil
+	}
+	// Return the response of the last attempt when the retries are exhausted, so its status is reported.
+	client.ErrorHandler = retryablehttp.PassthroughErrorHandler
+
+	response, err := client.Do(request)
+	if err != nil {
+		if errors.Is(err, ErrSourceNotAllowed) {
+			return "", 0, ErrSourceNotAllowed
+		}
+		return "", 0, fmt.Errorf("%w: %v", ErrSourceUnavailable, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("%w: %s", ErrSourceUnavailable, response.Status)
+	}
+	if response.ContentLength > maxBytes {
+		return "", 0, ErrUploadTooLarge
+	}
+
+	return saveUploadedFile(response.Body, dir, maxBytes)
+}
+
+// sourceRequest creates the request downloading the source.
+func sourceRequest(ctx context.Context, config SourceConfig, source string) (*retryablehttp.Request, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedSource, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if !config.hostAllowed(u) {
+			return nil, ErrSourceNotAllowed
+		}
+		return retryablehttp.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	case "s3":
+		if config.S3AccessKeyID == "" || config.S3SecretAccessKey == "" {
+			return nil, fmt.Errorf("%w: S3 is not configured", ErrSourceNotAllowed)
+		}
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("%w: expected s3://bucket/key", ErrUnsupportedSource)
+		}
+		if !config.bucketAllowed(u.Host) {
+			return nil, fmt.Errorf("%w: bucket %q", ErrSourceNotAllowed, u.Host)
+		}
+		request, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, config.S3Endpoint+"/"+awsURIEscape(u.Host+"/"+key), nil)
+		if err != nil {
+			return nil, err
+		}
+		// The signature is valid for 15 minutes, which covers the retries of the request.
+		signS3Request(request.Request, config.S3AccessKeyID, config.S3SecretAccessKey, config.S3Region, time.Now())
+		return request, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedSource, u.Scheme)
+}
+
+// signS3Request signs the request with AWS Signature Version 4. The host header, the range header and
+// all x-amz-* headers are signed.
+func signS3Request(r *http.Request, accessKeyID, secretAccessKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	headers := map[string]string{"host": r.URL.Host}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEscape escapes an S3 object path as required by Signature Version 4: everything except
+// unreserved characters and slashes is percent-encoded.
+func awsURIEscape(path string) string {
+	var sb strings.Builder
+	for _, b := range []byte(path) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || strings.IndexByte("-._~/", b) >= 0 {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// receiveSource downloads the recording of a JSON transcription request to dir.
+func receiveSource(c *gin.Context, dir string) (TranscribeSourceRequest, string, error) {
+	var request TranscribeSourceRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		return request, "", fmt.Errorf("%w: source is required", ErrUnsupportedSource)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), downloadTimeout)
+	defer cancel()
+	path, size, err := downloadSource(ctx, sources, request.Source, dir, maxUploadBytes)
+	if err != nil {
+		return request, "", err
+	}
+	observeUpload(uploadSourceDownload, size)
+	logEvent(c, slog.LevelInfo, "source_downloaded", gin.H{
+		"scheme": strings.SplitN(request.Source, ":", 2)[0],
+		"size":   size,
+		"format": strings.TrimPrefix(filepath.Ext(path), "."),
+	})
+	return request, path, nil
+}
+
+// abortOnSourceError responds with the status matching the download error.
+func abortOnSourceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrUnsupportedSource):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid source: " + err.Error()})
+	case errors.Is(err, ErrSourceNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Source not allowed"})
+	case errors.Is(err, ErrSourceUnavailable):
+		logEvent(c, slog.LevelWarn, "download_failed", gin.H{
+			"error": err.Error(),
+		})
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Error downloading source"})
+	default:
+		abortOnUploadError(c, err, maxUploadBytes)
+	}
+}
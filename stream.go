@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	sseEventDelta = "delta"
+	sseEventDone  = "done"
+	sseEventError = "error"
+
+	// streamBufferSize is the number of deltas buffered per part while an earlier part is still streaming.
+	// If the buffer is full, reading the part's completion pauses until it is its turn.
+	streamBufferSize = 1024
+
+	// streamFormatInstruction asks for Markdown, because streamed completions cannot use structured outputs
+	// in a way that can be shown to the user while it is generated.
+	streamFormatInstruction = "Format your answer as Markdown. Use headings for sections and nested lists starting with \"-\" for points and their details."
+)
+
+// StreamProcessor streams the completion for a single part and calls emit with every received piece of text.
+type StreamProcessor func(ctx context.Context, part string, emit func(delta string)) error
+
+// streamMarkdown renders the prompt for every part, streams the completions of all parts in parallel and
+// forwards them as server-sent events. Every "delta" event carries the index of its part and a piece of
+// its content, and all deltas of a part are sent before the deltas of the next part. Once all parts are
+// complete, a "done" event with the body returned by done for the joined Markdown is sent. Failures are
+// reported with an "error" event.
+func streamMarkdown(c *gin.Context, client OpenAIClient, task string, parts []string, joinSep string, maxTokens int, render TextProcessor, done func(response string) gin.H) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	results := make([]strings.Builder, len(parts))
+	err := streamPartsInParallel(c.Request.Context(), parts, func(ctx context.Context, part string, emit func(delta string)) error {
+		prompt, err := render(ctx, part)
+		if err != nil {
+			return err
+		}
+		return streamCompletion(ctx, client, task, prompt, maxTokens, emit)
+	}, func(part int, delta string) {
+		results[part].WriteString(delta)
+		c.SSEvent(sseEventDelta, gin.H{"part": part, "content": delta})
+		c.Writer.Flush()
+	})
+	if err != nil {
+		logEvent(c, slog.LevelError, "completion_failed", gin.H{
+			"error": err.Error(),
+		})
+		body := gin.H{"error": "Error creating response"}
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			body = quotaErrorBody(quotaErr)
+		}
+		c.Set(contextKeyStreamError, body)
+		c.SSEvent(sseEventError, body)
+		c.Writer.Flush()
+		return
+	}
+
+	joined := make([]string, len(results))
+	for i := range results {
+		joined[i] = strings.TrimSpace(results[i].String())
+	}
+	body := done(strings.Join(joined, joinSep))
+	c.Set(contextKeyStreamResult, body)
+	c.SSEvent(sseEventDone, body)
+	c.Writer.Flush()
+}
+
+// streamPartsInParallel runs the processor on every part concurrently and calls emit with the deltas of
+// the parts in the order of the parts: the deltas of the first unfinished part are forwarded as they
+// arrive, the deltas of later parts are buffered until all parts before them are complete. If any part
+// fails, all remaining parts are cancelled and its error is returned.
+func streamPartsInParallel(ctx context.Context, parts []string, processor StreamProcessor, emit func(part int, delta string)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	deltas := make([]chan string, len(parts))
+	errs := make([]error, len(parts))
+	for i, part := range parts {
+		deltas[i] = make(chan string, streamBufferSize)
+		go func(i int, part string) {
+			defer close(deltas[i])
+			partCtx, span := startSpan(ctx, "process_part",
+				attribute.Int("part.index", i),
+				attribute.Int("part.count", len(parts)),
+			)
+			errs[i] = processor(partCtx, part, func(delta string) {
+				select {
+				case deltas[i] <- delta:
+				case <-ctx.Done():
+				}
+			})
+			endSpan(span, errs[i])
+		}(i, part)
+	}
+
+	for i := range parts {
+		for delta := range deltas[i] {
+			emit(i, delta)
+		}
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamCompletion sends a single user prompt to the chat model as a streaming request and calls emit with
+// every piece of the answer. The task labels the metrics of the request. Answers are cached by the request;
+// a cached answer is emitted at once.
+func streamCompletion(ctx context.Context, client OpenAIClient, task string, prompt string, maxTokens int, emit func(delta string)) error {
+	request := openai.ChatCompletionRequest{
+		Model:     openai.GPT4oLatest,
+		MaxTokens: maxTokens,
+		Stream:    true,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: streamFormatInstruction,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: prompt,
+			},
+		},
+	}
+	streamed := false
+	answer, err := cached(ctx, cacheKindChat, chatCacheKey(request), func() (string, error) {
+		streamed = true
+		var answer strings.Builder
+		err := streamChatCompletion(ctx, client, task, request, func(delta string) {
+			answer.WriteString(delta)
+			emit(delta)
+		})
+		return answer.String(), err
+	})
+	if err == nil && !streamed && answer != "" {
+		emit(answer)
+	}
+	return err
+}
+
+// streamChatCompletion sends the streaming request and calls emit with every piece of the answer.
+func streamChatCompletion(ctx context.Context, client OpenAIClient, task string, request openai.ChatCompletionRequest, emit func(delta string)) (err error) {
+	ctx, done := startLLMCall(ctx, task, request.Model)
+	var usage *openai.Usage
+	defer func() {
+		done(usage, err)
+	}()
+
+	stream, err := client.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if response.Usage != nil {
+			usage = response.Usage
+			if recorder, ok := client.(usageRecorder); ok {
+				recorder.recordCompletion(request.Model, *response.Usage)
+			}
+		}
+		if len(response.Choices) > 0 && response.Choices[0].Delta.Content != "" {
+			emit(response.Choices[0].Delta.Content)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamPartsInParallel_PreservesOrder(t *testing.T) {
+	secondDone := make(chan struct{})
+	processor := func(ctx context.Context, part string, emit func(delta string)) error {
+		if part == "first" {
+			// the first part only finishes after the second one, its deltas must still come first
+			<-secondDone
+		}
+		emit(part + " a")
+		emit(part + " b")
+		if part == "second" {
+			close(secondDone)
+		}
+		return nil
+	}
+
+	var emitted []string
+	err := streamPartsInParallel(context.Background(), []string{"first", "second"}, processor, func(part int, delta string) {
+		emitted = append(emitted, delta)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first a", "first b", "second a", "second b"}, emitted)
+}
+
+func TestStreamPartsInParallel_Error(t *testing.T) {
+	errPart := errors.New("part failed")
+	processor := func(ctx context.Context, part string, emit func(delta string)) error {
+		if part == "second" {
+			return errPart
+		}
+		emit(part)
+		return nil
+	}
+
+	var emitted []string
+	err := streamPartsInParallel(context.Background(), []string{"first", "second", "third"}, processor, func(part int, delta string) {
+		emitted = append(emitted, delta)
+	})
+	assert.ErrorIs(t, err, errPart)
+	assert.Equal(t, []string{"first"}, emitted)
+}
+
+func TestBulletpointsStreamHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	client := &chatFuncClient{complete: func(prompt string) string { return "## Topic\n- First point\n  - Detail" }}
+	r := gin.New()
+	r.POST("/api/bulletpoints/stream", bulletpointsStreamHandler(client))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/bulletpoints/stream", strings.NewReader(`{"text": "Some text.", "language": "en"}`))
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "event:delta\ndata:{\"content\":\"## \",\"part\":0}")
+	assert.Contains(t, body, `"bulletpoints":[{"text":"Topic","heading":true,"children":[{"text":"First point","children":[{"text":"Detail"}]}]}]`)
+	assert.True(t, strings.Index(body, "event:done") > strings.LastIndex(body, "event:delta"))
+
+	require.Len(t, client.requests, 1)
+	assert.True(t, client.requests[0].Stream)
+	assert.Equal(t, openai.ChatMessageRoleSystem, client.requests[0].Messages[0].Role)
+}
+
+func TestOutlineStreamHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	client := &chatFuncClient{complete: func(prompt string) string { return "## Intro\n- Greeting" }}
+	r := gin.New()
+	r.POST("/api/outline/stream", outlineStreamHandler(client))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/outline/stream", strings.NewReader(`{"text": "Hello everyone.", "language": "en", "mode": "map_reduce"}`))
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "event:done\ndata:{\"language\":")
+	assert.Contains(t, w.Body.String(), `"response":"## Intro\n- Greeting"`)
+	require.Len(t, client.prompts, 1)
+	assert.Contains(t, client.prompts[0], "START SCRIPT PART")
+}
+
+func TestOutlineStreamHandler_InvalidMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/outline/stream", outlineStreamHandler(&chatFuncClient{}))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/outline/stream", strings.NewReader(`{"text": "Hello everyone.", "language": "en", "mode": "fast"}`))
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// structuredOutputModel is used for all requests with a JSON schema response format.
+// chatgpt-4o-latest does not support structured outputs.
+const structuredOutputModel = openai.GPT4o
+
+var ErrInvalidStructuredOutput = errors.New("model did not return valid structured output")
+
+// validator is implemented by structured outputs that have constraints beyond their JSON schema.
+type validator interface {
+	validate() error
+}
+
+// StructuredOutline is the structured form of a speaker outline.
+type StructuredOutline struct {
+	Title    string           `json:"title" description:"Title of the talk"`
+	Sections []OutlineSection `json:"sections" description:"Sections of the talk in the order they are presented"`
+}
+
+type OutlineSection struct {
+	Heading string         `json:"heading"`
+	Points  []OutlinePoint `json:"points"`
+}
+
+type OutlinePoint struct {
+	Text    string   `json:"text"`
+	Details []string `json:"details" description:"Supporting details, examples or phrases for the point"`
+}
+
+// StructuredBulletpoints is the structured form of a bulletpoint list grouped under headings.
+type StructuredBulletpoints struct {
+	Sections []BulletpointSection `json:"sections"`
+}
+
+type BulletpointSection struct {
+	Heading      string        `json:"heading" description:"Short heading of the topic, may be empty"`
+	Bulletpoints []Bulletpoint `json:"bulletpoints"`
+}
+
+type Bulletpoint struct {
+	Text    string   `json:"text"`
+	Details []string `json:"details" description:"Nested bulletpoints with details"`
+}
+
+// LanguageDetection is the structured answer of the language detection prompt.
+type LanguageDetection struct {
+	Code       string  `json:"code" description:"BCP-47 language code of the text, e.g. en, de or pt-BR"`
+	Confidence float64 `json:"confidence" description:"Confidence between 0 and 1"`
+}
+
+// StructuredTranslation is the structured answer of the translation prompt.
+type StructuredTranslation struct {
+	Segments []TranslatedSegment `json:"segments" description:"One translation for every segment of the input, in the same order"`
+}
+
+type TranslatedSegment struct {
+	ID   string `json:"id" description:"ID of the translated segment"`
+	Text string `json:"text" description:"Translation of the segment"`
+}
+
+func (o *StructuredOutline) validate() error {
+	if len(o.Sections) == 0 {
+		return errors.New("outline has no sections")
+	}
+	for i, section := range o.Sections {
+		if strings.TrimSpace(section.Heading) == "" {
+			return fmt.Errorf("section %d has no heading", i+1)
+		}
+		if len(section.Points) == 0 {
+			return fmt.Errorf("section %d has no points", i+1)
+		}
+		for _, point := range section.Points {
+			if strings.TrimSpace(point.Text) == "" {
+				return fmt.Errorf("section %d has an empty point", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *StructuredBulletpoints) validate() error {
+	if len(b.Sections) == 0 {
+		return errors.New("bulletpoints have no sections")
+	}
+	for i, section := range b.Sections {
+		if len(section.Bulletpoints) == 0 {
+			return fmt.Errorf("section %d has no bulletpoints", i+1)
+		}
+		for _, bulletpoint := range section.Bulletpoints {
+			if strings.TrimSpace(bulletpoint.Text) == "" {
+				return fmt.Errorf("section %d has an empty bulletpoint", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *LanguageDetection) validate() error {
+	if _, err := normalizeLanguageCode(l.Code); err != nil {
+		return err
+	}
+	if l.Confidence < 0 || l.Confidence > 1 {
+		return fmt.Errorf("confidence %v is not between 0 and 1", l.Confidence)
+	}
+	return nil
+}
+
+// Markdown renders the outline with the title as first-level heading and one second-level heading per section.
+func (o *StructuredOutline) Markdown() string {
+	var sb strings.Builder
+	if o.Title != "" {
+		sb.WriteString("# " + o.Title + "\n\n")
+	}
+	for _, section := range o.Sections {
+		sb.WriteString("## " + section.Heading + "\n")
+		for _, point := range section.Points {
+			writeListItem(&sb, point.Text, point.Details)
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// Markdown renders the bulletpoints as a nested list with one second-level heading per section.
+func (b *StructuredBulletpoints) Markdown() string {
+	var sb strings.Builder
+	for _, section := range b.Sections {
+		if section.Heading != "" {
+			sb.WriteString("## " + section.Heading + "\n")
+		}
+		for _, bulletpoint := range section.Bulletpoints {
+			writeListItem(&sb, bulletpoint.Text, bulletpoint.Details)
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func writeListItem(sb *strings.Builder, text string, details []string) {
+	sb.WriteString("- " + text + "\n")
+	for _, detail := range details {
+		sb.WriteString("  - " + detail + "\n")
+	}
+}
+
+// completeStructured sends the prompt with a strict JSON schema response format generated from T, and
+// decodes and validates the answer. Answers that do not match the schema or fail validation are
+// requested again up to maxRetries times.
+func completeStructured[T any](ctx context.Context, client OpenAIClient, model string, name string, prompt string, maxTokens int) (*T, error) {
+	return completeStructuredChecked[T](ctx, client, model, name, prompt, maxTokens, nil)
+}
+
+// completeStructuredChecked is completeStructured with an additional check for constraints that depend on
+// the request, e.g. the number of expected items. Answers failing the check are requested again as well.
+func completeStructuredChecked[T any](ctx context.Context, client OpenAIClient, model string, name string, prompt string, maxTokens int, check func(*T) error) (*T, error) {
+	result := new(T)
+	schema, err := jsonschema.GenerateSchemaForType(*result)
+	if err != nil {
+		return nil, err
+	}
+
+	request := openai.ChatCompletionRequest{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: prompt,
+			},
+		},
+		ResponseFormat: &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   name,
+				Schema: schema,
+				Strict: true,
+			},
+		},
+	}
+	// Only valid answers are cached.
+	return cached(ctx, cacheKindChat, chatCacheKey(request), func() (*T, error) {
+		var lastErr error
+		for attempt := 1; attempt <= maxRetries; attempt++ {
+			callCtx, done := startLLMCall(ctx, name, model)
+			resp, err := client.CreateChatCompletion(callCtx, request)
+			done(&resp.Usage, err)
+			if err != nil {
+				return nil, err
+			}
+			if len(resp.Choices) == 0 {
+				return nil, ErrNoChoices
+			}
+
+			result := new(T)
+			lastErr = schema.Unmarshal(resp.Choices[0].Message.Content, result)
+			if lastErr == nil {
+				if v, ok := any(result).(validator); ok {
+					lastErr = v.validate()
+				}
+			}
+			if lastErr == nil && check != nil {
+				lastErr = check(result)
+			}
+			if lastErr == nil {
+				return result, nil
+			}
+
+			logEvent(ctx, slog.LevelWarn, "structured_output_invalid", gin.H{
+				"name":        name,
+				"attempt":     attempt,
+				"max_retries": maxRetries,
+				"error":       lastErr.Error(),
+			})
+		}
+
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidStructuredOutput, name, lastErr)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompleteStructured(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string { return `{"code": "de", "confidence": 0.9}` }}
+
+	detection, err := completeStructured[LanguageDetection](context.Background(), client, openai.GPT4oMini, "language", "prompt", 0)
+	require.NoError(t, err)
+	assert.Equal(t, &LanguageDetection{Code: "de", Confidence: 0.9}, detection)
+
+	require.Len(t, client.requests, 1)
+	format := client.requests[0].ResponseFormat
+	require.NotNil(t, format)
+	assert.Equal(t, openai.ChatCompletionResponseFormatTypeJSONSchema, format.Type)
+	assert.Equal(t, "language", format.JSONSchema.Name)
+	assert.True(t, format.JSONSchema.Strict)
+
+	schema, err := json.Marshal(format.JSONSchema.Schema)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "object",
+		"properties": {
+			"code": {"type": "string", "description": "BCP-47 language code of the text, e.g. en, de or pt-BR"},
+			"confidence": {"type": "number", "description": "Confidence between 0 and 1"}
+		},
+		"required": ["code", "confidence"],
+		"additionalProperties": false
+	}`, string(schema))
+}
+
+func TestCompleteStructured_RetriesMalformedOutput(t *testing.T) {
+	answers := []string{
+		`not json`,
+		`{"sections": []}`,
+		testOutlineJSON("Intro"),
+	}
+	client := &chatFuncClient{}
+	client.complete = func(prompt string) string { return answers[len(client.prompts)-1] }
+
+	outline, err := completeStructured[StructuredOutline](context.Background(), client, structuredOutputModel, "outline", "prompt", 0)
+	require.NoError(t, err)
+	assert.Equal(t, testOutline("Intro"), outline)
+	assert.Len(t, client.prompts, 3)
+}
+
+func TestCompleteStructured_GivesUp(t *testing.T) {
+	testCases := []struct {
+		name   string
+		answer string
+	}{
+		{name: "invalid json", answer: `{"code": `},
+		{name: "schema mismatch", answer: `{"code": 42, "confidence": 1}`},
+		{name: "missing field", answer: `{"code": "en"}`},
+		{name: "invalid language code", answer: `{"code": "not a language", "confidence": 1}`},
+		{name: "confidence out of range", answer: `{"code": "en", "confidence": 1.5}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &chatFuncClient{complete: func(prompt string) string { return tc.answer }}
+
+			_, err := completeStructured[LanguageDetection](context.Background(), client, openai.GPT4oMini, "language", "prompt", 0)
+			assert.ErrorIs(t, err, ErrInvalidStructuredOutput)
+			assert.Len(t, client.prompts, maxRetries)
+		})
+	}
+}
+
+func TestStructuredOutline_Markdown(t *testing.T) {
+	outline := &StructuredOutline{
+		Title: "My Talk",
+		Sections: []OutlineSection{
+			{Heading: "Intro", Points: []OutlinePoint{
+				{Text: "Greeting", Details: []string{"Thank the organizers"}},
+				{Text: "Agenda"},
+			}},
+			{Heading: "Main", Points: []OutlinePoint{{Text: "Point"}}},
+		},
+	}
+
+	assert.Equal(t, "# My Talk\n\n## Intro\n- Greeting\n  - Thank the organizers\n- Agenda\n\n## Main\n- Point", outline.Markdown())
+}
+
+func TestStructuredOutline_Validate(t *testing.T) {
+	// errors are logged, so they identify sections by their position instead of quoting the content
+	outline := &StructuredOutline{Sections: []OutlineSection{
+		{Heading: "Intro", Points: []OutlinePoint{{Text: "Greeting"}}},
+		{Heading: "Salary of Jane Doe"},
+	}}
+	assert.EqualError(t, outline.validate(), "section 2 has no points")
+
+	outline.Sections[1].Points = []OutlinePoint{{Text: " "}}
+	assert.EqualError(t, outline.validate(), "section 2 has an empty point")
+}
+
+func TestStructuredBulletpoints_MarkdownRoundTrip(t *testing.T) {
+	bulletpoints := &StructuredBulletpoints{
+		Sections: []BulletpointSection{
+			{Heading: "", Bulletpoints: []Bulletpoint{{Text: "Loose point"}}},
+			{Heading: "Topic", Bulletpoints: []Bulletpoint{
+				{Text: "Point", Details: []string{"Detail 1", "Detail 2"}},
+			}},
+		},
+	}
+
+	markdown := bulletpoints.Markdown()
+	assert.Equal(t, "- Loose point\n\n## Topic\n- Point\n  - Detail 1\n  - Detail 2", markdown)
+	assert.Equal(t, []*BulletNode{
+		{Text: "Loose point"},
+		{Text: "Topic", Heading: true, Children: []*BulletNode{
+			{Text: "Point", Children: []*BulletNode{{Text: "Detail 1"}, {Text: "Detail 2"}}},
+		}},
+	}, parseBulletTree(markdown))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	subtitleFormatSRT = "srt"
+	subtitleFormatVTT = "vtt"
+)
+
+// TranscriptSegment is a part of a transcription with its position in the recording in seconds.
+type TranscriptSegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// collectSegments returns the segments of all chunk transcriptions with timings relative to the start of
+// the whole recording. Every chunk starts where the previous one ended, so the timings of a chunk are
+// shifted by the total duration of the chunks before it.
+func collectSegments(responses []openai.AudioResponse) []TranscriptSegment {
+	segments := []TranscriptSegment{}
+	offset := 0.0
+	for _, response := range responses {
+		for _, segment := range response.Segments {
+			text := strings.TrimSpace(segment.Text)
+			if text == "" {
+				continue
+			}
+			segments = append(segments, TranscriptSegment{
+				Start: offset + segment.Start,
+				End:   offset + segment.End,
+				Text:  text,
+			})
+		}
+		offset += response.Duration
+	}
+	return segments
+}
+
+func isSubtitleFormat(format string) bool {
+	return format == subtitleFormatSRT || format == subtitleFormatVTT
+}
+
+// formatSubtitles renders the segments as SRT or WebVTT subtitles.
+func formatSubtitles(segments []TranscriptSegment, format string) string {
+	var sb strings.Builder
+	separator := ","
+	if format == subtitleFormatVTT {
+		sb.WriteString("WEBVTT\n\n")
+		separator = "."
+	}
+
+	for i, segment := range segments {
+		if format == subtitleFormatSRT {
+			fmt.Fprintf(&sb, "%d\n", i+1)
+		}
+		fmt.Fprintf(&sb, "%s --> %s\n%s\n\n",
+			formatSubtitleTimestamp(segment.Start, separator),
+			formatSubtitleTimestamp(segment.End, separator),
+			segment.Text)
+	}
+
+	return sb.String()
+}
+
+// formatSubtitleTimestamp formats seconds like "00:01:02,345", using separator before the milliseconds.
+func formatSubtitleTimestamp(seconds float64, separator string) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d",
+		int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, separator, d.Milliseconds()%1000)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectSegments(t *testing.T) {
+	var responses []openai.AudioResponse
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"duration": 10, "segments": [{"start": 0, "end": 4.5, "text": " Hello."}, {"start": 4.5, "end": 10, "text": " World."}]},
+		{"duration": 5, "segments": [{"start": 0, "end": 2, "text": " "}, {"start": 2, "end": 5, "text": " Bye."}]}
+	]`), &responses))
+
+	assert.Equal(t, []TranscriptSegment{
+		{Start: 0, End: 4.5, Text: "Hello."},
+		{Start: 4.5, End: 10, Text: "World."},
+		{Start: 12, End: 15, Text: "Bye."},
+	}, collectSegments(responses))
+}
+
+func TestFormatSubtitles(t *testing.T) {
+	segments := []TranscriptSegment{
+		{Start: 0, End: 2.5, Text: "Hallo."},
+		{Start: 3661.0005, End: 3662.25, Text: "Welt."},
+	}
+
+	assert.Equal(t, "1\n00:00:00,000 --> 00:00:02,500\nHallo.\n\n2\n01:01:01,001 --> 01:01:02,250\nWelt.\n\n",
+		formatSubtitles(segments, subtitleFormatSRT))
+	assert.Equal(t, "WEBVTT\n\n00:00:00.000 --> 00:00:02.500\nHallo.\n\n01:01:01.001 --> 01:01:02.250\nWelt.\n\n",
+		formatSubtitles(segments, subtitleFormatVTT))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"strings"
+	"sync"
 
 	gptTokenizer "github.com/wbrown/gpt_bpe"
 )
@@ -10,9 +11,21 @@ const (
 	ParagraphSeparator = "\n\n"
 )
 
+// gpt2Encoder is loaded once, as loading the vocabulary takes several hundred milliseconds. The encoder
+// counts its cache hits without synchronization, so encoderMu serializes its use.
+var (
+	gpt2Encoder = sync.OnceValue(func() *gptTokenizer.GPTEncoder {
+		encoder := gptTokenizer.NewGPT2Encoder()
+		return &encoder
+	})
+	encoderMu sync.Mutex
+)
+
 func getNumTokens(sentence string) int {
-	tokenizer := gptTokenizer.NewGPT2Encoder()
-	return len(*tokenizer.Encode(&sentence))
+	encoder := gpt2Encoder()
+	encoderMu.Lock()
+	defer encoderMu.Unlock()
+	return len(*encoder.Encode(&sentence))
 }
 
 // splitParagraphs takes an input text and splits it into paragraphs when it sees two newlines.
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName  = "github.com/icereed/talk-tailor"
+	serviceName = "talk-tailor"
+)
+
+// tracer creates the spans of requests and the pipeline. It does nothing unless main replaces it with the
+// tracer of an exporting provider.
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// tracePropagator reads the trace context of clients from the traceparent and tracestate headers.
+var tracePropagator = propagation.TraceContext{}
+
+// loadTracerProvider creates a provider exporting spans via OTLP over HTTP if OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The exporter, the sampler and the resource are configured by
+// the standard OTEL_* variables. Without an endpoint, nil is returned and tracing stays disabled.
+func loadTracerProvider(ctx context.Context, getenv func(string) string) (*sdktrace.TracerProvider, error) {
+	if getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newTracerProvider(sdktrace.NewBatchSpanProcessor(exporter))
+}
+
+// newTracerProvider creates a provider passing the spans of the service to the processor. OTEL_SERVICE_NAME
+// and OTEL_RESOURCE_ATTRIBUTES override the service name.
+func newTracerProvider(processor sdktrace.SpanProcessor) (*sdktrace.TracerProvider, error) {
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(processor), sdktrace.WithResource(res)), nil
+}
+
+// tracingMiddleware starts a server span for every request, continuing the trace of the client if it sent a
+// traceparent header. The span is stored in the context of the request, so the spans of the pipeline
+// become its children.
+func tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := tracePropagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// startSpan starts a span of the pipeline as a child of the span in ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan marks the span as failed if err is not nil and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		// The error may contain text of the recording, so it is recorded like the logs.
+		span.RecordError(errors.New(scrubPII(err.Error())))
+		span.SetStatus(codes.Error, scrubPII(err.Error()))
+	}
+	span.End()
+}
+
+// startLLMCall starts the span of a chat completion. The returned function ends the span and records the
+// metrics of the call.
+func startLLMCall(ctx context.Context, task, model string) (context.Context, func(usage *openai.Usage, err error)) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "llm.chat_completion",
+		attribute.String("llm.task", task),
+		attribute.String("llm.model", model),
+	)
+	return ctx, func(usage *openai.Usage, err error) {
+		observeLLMCall(task, model, start, usage, err)
+		if usage != nil {
+			span.SetAttributes(
+				attribute.Int("llm.usage.prompt_tokens", usage.PromptTokens),
+				attribute.Int("llm.usage.completion_tokens", usage.CompletionTokens),
+			)
+		}
+		endSpan(span, err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// captureSpans replaces the tracer with one recording all spans in the returned exporter for the duration
+// of the test.
+func captureSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := newTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter))
+	require.NoError(t, err)
+	previous := tracer
+	tracer = provider.Tracer(tracerName)
+	t.Cleanup(func() { tracer = previous })
+	return exporter
+}
+
+// spansNamed returns the recorded spans with the given name.
+func spansNamed(exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStubs {
+	var spans tracetest.SpanStubs
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestLoadTracerProvider(t *testing.T) {
+	provider, err := loadTracerProvider(context.Background(), func(string) string { return "" })
+	require.NoError(t, err)
+	assert.Nil(t, provider)
+
+	provider, err = loadTracerProvider(context.Background(), func(key string) string {
+		if key == "OTEL_EXPORTER_OTLP_ENDPOINT" {
+			return "http://localhost:4318"
+		}
+		return ""
+	})
+	require.NoError(t, err)
+	require.NotNil(t, provider)
+	assert.NoError(t, provider.Shutdown(context.Background()))
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	spans := captureSpans(t)
+	logs := captureLogs(t, slog.LevelInfo)
+
+	r := gin.New()
+	r.Use(tracingMiddleware(), requestLogMiddleware())
+	r.GET("/api/items/:id", func(c *gin.Context) {
+		_, span := startSpan(c.Request.Context(), "work")
+		endSpan(span, nil)
+		c.Status(http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/items/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	server := spansNamed(spans, "GET /api/items/:id")
+	require.Len(t, server, 1)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server[0].SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server[0].Parent.SpanID().String())
+	assert.Equal(t, int64(http.StatusInternalServerError), spanAttribute(server[0], "http.response.status_code").AsInt64())
+	assert.Equal(t, codes.Error, server[0].Status.Code)
+	assert.NotEmpty(t, spanAttribute(server[0], "request.id").AsString())
+
+	work := spansNamed(spans, "work")
+	require.Len(t, work, 1)
+	assert.Equal(t, server[0].SpanContext.SpanID(), work[0].Parent.SpanID())
+
+	events := logs.events(t)
+	require.Len(t, events, 1)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", events[0]["trace_id"])
+}
+
+func TestTracing_Pipeline(t *testing.T) {
+	spans := captureSpans(t)
+
+	ctx, root := startSpan(context.Background(), "root")
+	_, err := transcribeChunks(ctx, &mockOpenAIClient{}, []string{"chunk1.mp3", "chunk2.mp3"}, "", nil)
+	require.NoError(t, err)
+
+	client := &chatFuncClient{complete: func(prompt string) string { return "answer" }}
+	_, err = processTextInParallel(ctx, TextProcessingOptions{
+		Text:      "This is a test. This is only a test.",
+		MaxTokens: 5,
+		JoinSep:   " ",
+		Processor: func(ctx context.Context, part string) (string, error) {
+			return createCompletion(ctx, client, "summary", part, 100)
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = processTextInParallel(ctx, TextProcessingOptions{
+		Text:      "Fail.",
+		MaxTokens: 5,
+		Processor: func(ctx context.Context, part string) (string, error) {
+			return "", errors.New("failed for bob@example.org")
+		},
+	})
+	require.Error(t, err)
+	root.End()
+
+	transcriptions := spansNamed(spans, "transcribe_chunk")
+	require.Len(t, transcriptions, 2)
+	for _, span := range transcriptions {
+		assert.Equal(t, root.SpanContext().SpanID(), span.Parent.SpanID())
+		assert.Equal(t, int64(1), spanAttribute(span, "whisper.attempt").AsInt64())
+	}
+
+	parts := spansNamed(spans, "process_part")
+	calls := spansNamed(spans, "llm.chat_completion")
+	require.Greater(t, len(calls), 1)
+	require.Len(t, parts, len(calls)+1)
+	partIDs := map[string]bool{}
+	for _, span := range parts {
+		partIDs[span.SpanContext.SpanID().String()] = true
+	}
+	for _, span := range calls {
+		assert.True(t, partIDs[span.Parent.SpanID().String()], "completions are children of their part")
+		assert.Equal(t, "summary", spanAttribute(span, "llm.task").AsString())
+	}
+	failed := parts[len(parts)-1]
+	assert.Equal(t, codes.Error, failed.Status.Code)
+	assert.Equal(t, "failed for [email]", failed.Status.Description)
+	require.Len(t, failed.Events, 1)
+	assert.Equal(t, semconv.ExceptionEventName, failed.Events[0].Name)
+	exception := attribute.NewSet(failed.Events[0].Attributes...)
+	message, ok := exception.Value(semconv.ExceptionMessageKey)
+	require.True(t, ok)
+	assert.Equal(t, "failed for [email]", message.AsString(), "errors are scrubbed like the logs")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// transformModeParallel runs the operation on every part of the text and joins the results.
+	transformModeParallel = "parallel"
+	// transformModeMapReduce runs the operation on every part of the text and then merges the partial
+	// results into a single output for the whole document.
+	transformModeMapReduce = "map_reduce"
+
+	// reducePromptSuffix is appended to an operation name to find the template that merges partial results.
+	// Operations without such a template are applied to the joined partial results again.
+	reducePromptSuffix = "_reduce"
+)
+
+// transformOperations maps the built-in operations of /api/transform to their default mode. Templates in
+// the custom directory of a prompt version are offered as custom/<name> operations; other templates, like
+// those of the correction or the language detection, cannot be used as operations.
+var transformOperations = map[string]string{
+	"summary":      transformModeMapReduce,
+	"titles":       transformModeMapReduce,
+	"faq":          transformModeMapReduce,
+	"tweet_thread": transformModeMapReduce,
+	"blog_post":    transformModeMapReduce,
+	"key_quotes":   transformModeParallel,
+	"action_items": transformModeParallel,
+}
+
+var (
+	ErrNoReduceProgress = errors.New("reducing partial results did not shorten the text")
+	ErrNoChoices        = errors.New("completion returned no choices")
+)
+
+// TransformRequest is the JSON body of POST /api/transform.
+type TransformRequest struct {
+	Text          string `json:"text" binding:"required"`
+	Operation     string `json:"operation" binding:"required"`
+	Mode          string `json:"mode"`
+	PromptVersion string `json:"prompt_version"`
+	Language      string `json:"language"`
+}
+
+func transformHandler(client OpenAIClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := requestClient(c, client)
+		defer client.save(c)
+		if abortOnQuotaError(c, client.checkQuota()) {
+			return
+		}
+
+		var request TransformRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logEvent(c, slog.LevelInfo, "invalid_json", gin.H{
+				"error": err.Error(),
+			})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: text and operation are required"})
+			return
+		}
+
+		prompt := PromptSelection{
+			Version:  request.PromptVersion,
+			Language: request.Language,
+		}
+		if !promptStore.HasVersion(prompt.Version) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt version"})
+			return
+		}
+
+		// The request is validated before the language is resolved, which may call OpenAI to detect it.
+		if prompt.Language != "" {
+			if _, err := normalizeLanguageCode(prompt.Language); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid language"})
+				return
+			}
+		}
+		if !isTransformOperation(request.Operation) || !promptStore.HasTaskInAnyLanguage(request.Operation, prompt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown operation %q", request.Operation)})
+			return
+		}
+
+		mode := request.Mode
+		if mode == "" {
+			mode = transformOperations[request.Operation]
+		}
+		if mode == "" {
+			mode = transformModeParallel
+		}
+		if mode != transformModeParallel && mode != transformModeMapReduce {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown mode %q", mode)})
+			return
+		}
+
+		language, err := resolveLanguage(c.Request.Context(), client, request.Text, &prompt, nil)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid language"})
+			return
+		}
+		// Templates of custom operations may exist only for some languages.
+		if !promptStore.HasTask(request.Operation, prompt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown operation %q for language %q", request.Operation, prompt.Language)})
+			return
+		}
+
+		response, err := transformText(c.Request.Context(), client, request.Text, request.Operation, mode, tokensForCompletion, prompt)
+		if abortOnQuotaError(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating response"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"response":  response,
+			"operation": request.Operation,
+			"mode":      mode,
+			"language":  language,
+			"usage":     client.Usage(),
+		})
+	}
+}
+
+// isTransformOperation reports whether the operation is a built-in or a custom operation.
+func isTransformOperation(operation string) bool {
+	if _, ok := transformOperations[operation]; ok {
+		return true
+	}
+	return strings.HasPrefix(operation, customPromptPrefix) && !strings.HasSuffix(operation, reducePromptSuffix)
+}
+
+// transformText applies the prompt template named by operation to the text. Long texts are split into
+// parts of at most maxTokens tokens, which are processed in parallel. In map-reduce mode the partial
+// results are merged into a single result afterwards.
+func transformText(ctx context.Context, client OpenAIClient, text string, operation string, mode string, maxTokens int, selection PromptSelection) (string, error) {
+	options := TextProcessingOptions{
+		Client:    client,
+		Text:      text,
+		MaxTokens: maxTokens,
+		JoinSep:   ParagraphSeparator,
+		Processor: func(ctx context.Context, part string) (string, error) {
+			logEvent(ctx, slog.LevelDebug, "transforming_text", gin.H{
+				"operation": operation,
+				"part":      redact(part),
+			})
+			prompt, err := promptStore.Render(operation, selection, selection.data(part))
+			if err != nil {
+				return "", err
+			}
+			return createCompletion(ctx, client, operation, prompt, maxTokens)
+		},
+	}
+
+	if mode != transformModeMapReduce {
+		return processTextInParallel(ctx, options)
+	}
+
+	reduceTask := operation + reducePromptSuffix
+	if !promptStore.HasTask(reduceTask, selection) {
+		reduceTask = operation
+	}
+	reduce := func(ctx context.Context, partials string) (string, error) {
+		logEvent(ctx, slog.LevelDebug, "reducing_text", gin.H{
+			"operation": operation,
+			"partials":  redact(partials),
+		})
+		prompt, err := promptStore.Render(reduceTask, selection, selection.data(partials))
+		if err != nil {
+			return "", err
+		}
+		return createCompletion(ctx, client, reduceTask, prompt, maxTokens)
+	}
+
+	return mapReduceText(ctx, options, reduce)
+}
+
+// mapReduceText processes all parts of options.Text with options.Processor and merges the results with reduce.
+// As long as the joined partial results are longer than options.MaxTokens they are split and reduced in
+// parallel again, so the final reduce call always fits into the token budget.
+func mapReduceText(ctx context.Context, options TextProcessingOptions, reduce TextProcessor) (string, error) {
+	if len(splitLongString(options.Text, options.MaxTokens)) <= 1 {
+		return processTextInParallel(ctx, options)
+	}
+
+	partials, err := processTextInParallel(ctx, options)
+	if err != nil {
+		return "", err
+	}
+
+	for numTokens := getNumTokens(partials); numTokens > options.MaxTokens; {
+		options.Text = partials
+		options.Processor = reduce
+		partials, err = processTextInParallel(ctx, options)
+		if err != nil {
+			return "", err
+		}
+
+		reducedTokens := getNumTokens(partials)
+		if reducedTokens >= numTokens {
+			return "", ErrNoReduceProgress
+		}
+		numTokens = reducedTokens
+	}
+
+	return reduce(ctx, partials)
+}
+
+// createCompletion sends a single user prompt to the chat model and returns the trimmed answer. The task,
+// i.e. the name of the prompt template, labels the metrics of the request. Answers are cached by the
+// request.
+func createCompletion(ctx context.Context, client OpenAIClient, task string, prompt string, maxTokens int) (string, error) {
+	request := openai.ChatCompletionRequest{
+		Model:     openai.GPT4oLatest,
+		MaxTokens: 16384 - maxTokens,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: prompt,
+			},
+		},
+	}
+	return cached(ctx, cacheKindChat, chatCacheKey(request), func() (string, error) {
+		ctx, done := startLLMCall(ctx, task, request.Model)
+		resp, err := client.CreateChatCompletion(ctx, request)
+		done(&resp.Usage, err)
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Choices) == 0 {
+			return "", ErrNoChoices
+		}
+		return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+	})
+}
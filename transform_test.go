@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chatFuncClient is an OpenAIClient that answers chat completions with the given function
+// and records every request and prompt it receives.
+type chatFuncClient struct {
+	mu       sync.Mutex
+	requests []openai.ChatCompletionRequest
+	prompts  []string
+	complete func(prompt string) string
+}
+
+func (m *chatFuncClient) CreateTranscription(ctx context.Context, request openai.AudioRequest) (openai.AudioResponse, error) {
+	return openai.AudioResponse{Text: "mock transcription"}, nil
+}
+
+func (m *chatFuncClient) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	prompt := request.Messages[len(request.Messages)-1].Content
+	m.mu.Lock()
+	m.requests = append(m.requests, request)
+	m.prompts = append(m.prompts, prompt)
+	m.mu.Unlock()
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{
+			{Message: openai.ChatCompletionMessage{Content: m.complete(prompt)}},
+		},
+	}, nil
+}
+
+// CreateChatCompletionStream streams the answer of the complete function word by word from streamServer.
+func (m *chatFuncClient) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error) {
+	prompt := request.Messages[len(request.Messages)-1].Content
+	m.mu.Lock()
+	m.requests = append(m.requests, request)
+	m.prompts = append(m.prompts, prompt)
+	m.mu.Unlock()
+
+	config := openai.DefaultConfig("test")
+	config.BaseURL = streamServer().URL
+	request.Messages = []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: m.complete(prompt)}}
+	return openai.NewClientWithConfig(config).CreateChatCompletionStream(ctx, request)
+}
+
+// streamServer answers streaming chat completions with the content of the first message, which
+// chatFuncClient sets to the answer of its complete function.
+var streamServer = sync.OnceValue(func() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, word := range strings.SplitAfter(request.Messages[0].Content, " ") {
+			chunk, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+				Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: word}}},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		if request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+			chunk, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+				Choices: []openai.ChatCompletionStreamChoice{},
+				Usage:   &openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+})
+
+func TestTransformText_Parallel(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string { return "- [ ] item" }}
+
+	result, err := transformText(context.Background(), client, "First part.\n\nSecond part.", "action_items", transformModeParallel, 5, PromptSelection{})
+	require.NoError(t, err)
+	assert.Equal(t, "- [ ] item\n\n- [ ] item", result)
+	assert.Len(t, client.prompts, 2)
+}
+
+func TestTransformText_MapReduce(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string {
+		if strings.HasPrefix(prompt, "The following Markdown drafts") {
+			return "merged post"
+		}
+		return "draft"
+	}}
+
+	result, err := transformText(context.Background(), client, "First part.\n\nSecond part.", "blog_post", transformModeMapReduce, 5, PromptSelection{})
+	require.NoError(t, err)
+	assert.Equal(t, "merged post", result)
+	// two map calls and one reduce call
+	require.Len(t, client.prompts, 3)
+	assert.Contains(t, client.prompts[2], "draft\n\ndraft")
+}
+
+func TestTransformText_MapReduceWithoutReduceTemplate(t *testing.T) {
+	client := &chatFuncClient{complete: func(prompt string) string { return "short" }}
+
+	result, err := transformText(context.Background(), client, "First part.\n\nSecond part.", "summary", transformModeMapReduce, 5, PromptSelection{})
+	require.NoError(t, err)
+	assert.Equal(t, "short", result)
+	require.Len(t, client.prompts, 3)
+	assert.True(t, strings.HasPrefix(client.prompts[2], "Summarize the following text"))
+}
+
+func TestMapReduceText_NoProgress(t *testing.T) {
+	options := TextProcessingOptions{
+		Text:      "First part.\n\nSecond part.",
+		MaxTokens: 5,
+		JoinSep:   ParagraphSeparator,
+		Processor: func(ctx context.Context, part string) (string, error) {
+			return "this result is always much longer than the token limit", nil
+		},
+	}
+	_, err := mapReduceText(context.Background(), options, options.Processor)
+	assert.ErrorIs(t, err, ErrNoReduceProgress)
+}
+
+func TestTransformHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	writePromptFile(t, dir, "v1/custom/poem.tmpl", "Write a poem about: {{.Text}}")
+	writePromptFile(t, dir, "v1/custom/poem_reduce.tmpl", "Merge the poems: {{.Text}}")
+	writePromptFile(t, dir, "v1/custom/gedicht.de.tmpl", "Schreibe ein Gedicht über: {{.Text}}")
+	previousPromptStore := promptStore
+	promptStore = mustLoadPromptStore("", dir)
+	defer func() { promptStore = previousPromptStore }()
+
+	client := &chatFuncClient{complete: func(prompt string) string { return "result" }}
+	r := gin.New()
+	r.POST("/api/transform", transformHandler(client))
+
+	testCases := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedMode string
+	}{
+		{name: "built-in operation", body: `{"text": "Hello.", "operation": "summary"}`, expectedCode: http.StatusOK, expectedMode: transformModeMapReduce},
+		{name: "explicit mode", body: `{"text": "Hello.", "operation": "summary", "mode": "parallel"}`, expectedCode: http.StatusOK, expectedMode: transformModeParallel},
+		{name: "custom operation", body: `{"text": "Hello.", "operation": "custom/poem"}`, expectedCode: http.StatusOK, expectedMode: transformModeParallel},
+		{name: "internal prompt", body: `{"text": "Hello.", "operation": "bulletpoints"}`, expectedCode: http.StatusBadRequest},
+		{name: "internal merge prompt", body: `{"text": "Hello.", "operation": "outline_merge"}`, expectedCode: http.StatusBadRequest},
+		{name: "reduce prompt of a custom operation", body: `{"text": "Hello.", "operation": "custom/poem_reduce"}`, expectedCode: http.StatusBadRequest},
+		{name: "missing operation", body: `{"text": "Hello."}`, expectedCode: http.StatusBadRequest},
+		{name: "missing text", body: `{"operation": "summary"}`, expectedCode: http.StatusBadRequest},
+		{name: "unknown operation", body: `{"text": "Hello.", "operation": "poem"}`, expectedCode: http.StatusBadRequest},
+		{name: "unknown mode", body: `{"text": "Hello.", "operation": "summary", "mode": "magic"}`, expectedCode: http.StatusBadRequest},
+		{name: "unknown prompt version", body: `{"text": "Hello.", "operation": "summary", "prompt_version": "v42"}`, expectedCode: http.StatusBadRequest},
+		{name: "operation for another language", body: `{"text": "Hello.", "operation": "custom/gedicht", "language": "en"}`, expectedCode: http.StatusBadRequest},
+		{name: "invalid language", body: `{"text": "Hello.", "operation": "summary", "language": "klingon!"}`, expectedCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := len(client.prompts)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/transform", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			if tc.expectedCode != http.StatusOK {
+				// Invalid requests are rejected before the language is detected.
+				assert.Len(t, client.prompts, calls)
+			}
+			if tc.expectedCode == http.StatusOK {
+				var response struct {
+					Response string           `json:"response"`
+					Mode     string           `json:"mode"`
+					Language DetectedLanguage `json:"language"`
+				}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, "result", response.Response)
+				assert.Equal(t, tc.expectedMode, response.Mode)
+				assert.NotEmpty(t, response.Language.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	promptTranslate = "translate"
+
+	// translationSegmentTokens is the number of tokens reserved for the tag around every segment when
+	// segments are batched into translation requests.
+	translationSegmentTokens = 12
+)
+
+var ErrTranslationMisaligned = errors.New("translation does not match the segments")
+
+// TranslateRequest is the JSON body of POST /api/translate. At least one of Text, Segments, Outline
+// and Bulletpoints has to be given.
+type TranslateRequest struct {
+	// TargetLanguage is the BCP-47 code of the language to translate into.
+	TargetLanguage string `json:"target_language" binding:"required"`
+	// Text is a transcription, its paragraphs are translated one by one.
+	Text string `json:"text"`
+	// Segments are the timed segments returned by /api/transcribe. Every segment keeps its timing.
+	Segments []TranscriptSegment `json:"segments"`
+	// Outline is the structured outline returned by /api/outline.
+	Outline *StructuredOutline `json:"outline"`
+	// Bulletpoints is the Markdown returned by /api/bulletpoints.
+	Bulletpoints string `json:"bulletpoints"`
+	// SubtitleFormat renders the translated segments as "srt" or "vtt" subtitles.
+	SubtitleFormat string `json:"subtitle_format"`
+	PromptVersion  string `json:"prompt_version"`
+	// Language is the language of the input. It is detected if empty.
+	Language string `json:"language"`
+}
+
+// translationSegment is a piece of text that is translated on its own.
+type translationSegment struct {
+	ID   string
+	Text string
+	// owner is the index of the text the segment belongs to.
+	owner  int
+	tokens int
+}
+
+func translateHandler(client OpenAIClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := requestClient(c, client)
+		defer client.save(c)
+		if abortOnQuotaError(c, client.checkQuota()) {
+			return
+		}
+
+		var request TranslateRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logEvent(c, slog.LevelInfo, "invalid_json", gin.H{
+				"error": err.Error(),
+			})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: target_language is required"})
+			return
+		}
+
+		sample := translationSample(request)
+		if sample == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No text provided"})
+			return
+		}
+		if request.SubtitleFormat != "" {
+			if !isSubtitleFormat(request.SubtitleFormat) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown subtitle format %q", request.SubtitleFormat)})
+				return
+			}
+			if len(request.Segments) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Subtitles require segments"})
+				return
+			}
+		}
+
+		targetLanguage, err := normalizeLanguageCode(request.TargetLanguage)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target language"})
+			return
+		}
+
+		prompt := PromptSelection{
+			Version:  request.PromptVersion,
+			Language: request.Language,
+		}
+		if !promptStore.HasVersion(prompt.Version) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown prompt version"})
+			return
+		}
+
+		language, err := resolveLanguage(c.Request.Context(), client, sample, &prompt, nil)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid language"})
+			return
+		}
+
+		// Collect every text of the request, so all of them are translated in as few requests as possible.
+		var texts []*string
+		var paragraphs []string
+		if request.Text != "" {
+			paragraphs = splitParagraphs(request.Text)
+		}
+		for i := range paragraphs {
+			texts = append(texts, &paragraphs[i])
+		}
+		for i := range request.Segments {
+			texts = append(texts, &request.Segments[i].Text)
+		}
+		if request.Outline != nil {
+			texts = append(texts, outlineTexts(request.Outline)...)
+		}
+		var bulletPrefixes, bulletTexts []string
+		if request.Bulletpoints != "" {
+			for _, line := range strings.Split(request.Bulletpoints, "\n") {
+				prefix, text := splitMarkdownLine(line)
+				bulletPrefixes = append(bulletPrefixes, prefix)
+				bulletTexts = append(bulletTexts, text)
+			}
+		}
+		for i := range bulletTexts {
+			texts = append(texts, &bulletTexts[i])
+		}
+
+		err = translateTexts(c.Request.Context(), client, texts, targetLanguage, tokensForCompletion, prompt)
+		if abortOnQuotaError(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating response"})
+			return
+		}
+
+		response := gin.H{
+			"language":        language,
+			"target_language": targetLanguage,
+		}
+		if request.Text != "" {
+			response["text"] = strings.Join(paragraphs, ParagraphSeparator)
+		}
+		if len(request.Segments) > 0 {
+			response["segments"] = request.Segments
+		}
+		if request.SubtitleFormat != "" {
+			response["subtitles"] = formatSubtitles(request.Segments, request.SubtitleFormat)
+		}
+		if request.Outline != nil {
+			response["outline"] = request.Outline
+			response["outline_markdown"] = request.Outline.Markdown()
+		}
+		if request.Bulletpoints != "" {
+			lines := make([]string, len(bulletTexts))
+			for i, text := range bulletTexts {
+				lines[i] = bulletPrefixes[i] + text
+			}
+			bulletpoints := strings.Join(lines, "\n")
+			response["bulletpoints"] = bulletpoints
+			response["bulletpoint_tree"] = parseBulletTree(bulletpoints)
+		}
+
+		response["usage"] = client.Usage()
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// translationSample returns the first non-empty input of the request for language detection.
+func translationSample(request TranslateRequest) string {
+	if strings.TrimSpace(request.Text) != "" {
+		return request.Text
+	}
+	var segments []string
+	for _, segment := range request.Segments {
+		segments = append(segments, segment.Text)
+	}
+	if sample := strings.TrimSpace(strings.Join(segments, " ")); sample != "" {
+		return sample
+	}
+	if request.Outline != nil {
+		return request.Outline.Markdown()
+	}
+	return strings.TrimSpace(request.Bulletpoints)
+}
+
+// outlineTexts returns pointers to the title, headings, points and details of the outline.
+func outlineTexts(outline *StructuredOutline) []*string {
+	texts := []*string{&outline.Title}
+	for i := range outline.Sections {
+		section := &outline.Sections[i]
+		texts = append(texts, &section.Heading)
+		for j := range section.Points {
+			point := &section.Points[j]
+			texts = append(texts, &point.Text)
+			for k := range point.Details {
+				texts = append(texts, &point.Details[k])
+			}
+		}
+	}
+	return texts
+}
+
+// splitMarkdownLine splits a Markdown line into its structure, i.e. indentation and heading or list
+// marker, and its text.
+func splitMarkdownLine(line string) (string, string) {
+	trimmed := strings.TrimSpace(line)
+	indent := line[:strings.Index(line, trimmed)]
+	text := trimmed
+	if level := headingLevel(trimmed); level > 0 {
+		text = strings.TrimSpace(trimmed[level:])
+	} else if item, ok := listItemText(trimmed); ok {
+		text = item
+	}
+	return indent + trimmed[:len(trimmed)-len(text)], text
+}
+
+// translateTexts translates the texts in place into the target language. Every text is translated on its
+// own, so paragraphs, timed segments and the entries of outlines keep their position. The texts are
+// batched into requests of at most maxTokens tokens, texts longer than that are split with
+// splitLongString and their translated parts are joined again.
+func translateTexts(ctx context.Context, client OpenAIClient, texts []*string, targetLanguage string, maxTokens int, selection PromptSelection) error {
+	var segments []translationSegment
+	for i, text := range texts {
+		trimmed := strings.TrimSpace(*text)
+		if trimmed == "" {
+			continue
+		}
+
+		tokens := getNumTokens(trimmed) + translationSegmentTokens
+		if tokens <= maxTokens {
+			segments = append(segments, translationSegment{
+				ID:     strconv.Itoa(len(segments) + 1),
+				Text:   trimmed,
+				owner:  i,
+				tokens: tokens,
+			})
+			continue
+		}
+		for _, part := range splitLongString(trimmed, maxTokens-translationSegmentTokens) {
+			segments = append(segments, translationSegment{
+				ID:     strconv.Itoa(len(segments) + 1),
+				Text:   part,
+				owner:  i,
+				tokens: getNumTokens(part) + translationSegmentTokens,
+			})
+		}
+	}
+
+	var batches [][]translationSegment
+	var batch []translationSegment
+	batchTokens := 0
+	for _, segment := range segments {
+		if len(batch) > 0 && batchTokens+segment.tokens > maxTokens {
+			batches = append(batches, batch)
+			batch, batchTokens = nil, 0
+		}
+		batch = append(batch, segment)
+		batchTokens += segment.tokens
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	translations, err := processPartsInParallel(ctx, batches, func(ctx context.Context, batch []translationSegment) ([]string, error) {
+		return translateSegments(ctx, client, batch, targetLanguage, maxTokens, selection)
+	})
+	if err != nil {
+		return err
+	}
+
+	translated := map[int][]string{}
+	for i, batch := range batches {
+		for j, segment := range batch {
+			translated[segment.owner] = append(translated[segment.owner], translations[i][j])
+		}
+	}
+	for owner, parts := range translated {
+		*texts[owner] = strings.Join(parts, " ")
+	}
+	return nil
+}
+
+// translateSegments translates a batch of segments with a single request and returns the translations
+// in the order of the segments.
+func translateSegments(ctx context.Context, client OpenAIClient, segments []translationSegment, targetLanguage string, maxTokens int, selection PromptSelection) ([]string, error) {
+	var sb strings.Builder
+	for _, segment := range segments {
+		fmt.Fprintf(&sb, "<segment id=%q>%s</segment>\n", segment.ID, segment.Text)
+	}
+	logEvent(ctx, slog.LevelDebug, "translating_text", gin.H{
+		"target_language": targetLanguage,
+		"segments":        len(segments),
+	})
+
+	data := selection.data(sb.String())
+	data.TargetLanguage = targetLanguage
+	data.TargetLanguageName = languageName(targetLanguage)
+	prompt, err := promptStore.Render(promptTranslate, selection, data)
+	if err != nil {
+		return nil, err
+	}
+
+	translation, err := completeStructuredChecked(ctx, client, structuredOutputModel, "translation", prompt, 16384-maxTokens,
+		func(translation *StructuredTranslation) error {
+			return checkTranslation(translation, segments)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	texts := make([]string, len(segments))
+	for i, segment := range translation.Segments {
+		texts[i] = strings.TrimSpace(segment.Text)
+	}
+	return texts, nil
+}
+
+// checkTranslation makes sure the translation contains exactly the given segments in the same order.
+func checkTranslation(translation *StructuredTranslation, segments []translationSegment) error {
+	if len(translation.Segments) != len(segments) {
+		return fmt.Errorf("%w: expected %d segments, got %d", ErrTranslationMisaligned, len(segments), len(translation.Segments))
+	}
+	for i, segment := range segments {
+		if translation.Segments[i].ID != segment.ID {
+			return fmt.Errorf("%w: expected segment %s at position %d, got %s", ErrTranslationMisaligned, segment.ID, i+1, translation.Segments[i].ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var segmentPattern = regexp.MustCompile(`<segment id="(\d+)">(.*)</segment>`)
+
+// translatingClient answers translation prompts by prefixing every segment with "DE: ".
+func translatingClient() *chatFuncClient {
+	return &chatFuncClient{complete: func(prompt string) string {
+		translation := StructuredTranslation{Segments: []TranslatedSegment{}}
+		for _, match := range segmentPattern.FindAllStringSubmatch(prompt, -1) {
+			translation.Segments = append(translation.Segments, TranslatedSegment{ID: match[1], Text: "DE: " + match[2]})
+		}
+		result, _ := json.Marshal(translation)
+		return string(result)
+	}}
+}
+
+func TestTranslateTexts_Batches(t *testing.T) {
+	client := translatingClient()
+	first, second, empty, third := "First paragraph.", "Second paragraph.", " ", "Third paragraph."
+
+	err := translateTexts(context.Background(), client, []*string{&first, &second, &empty, &third}, "de", 30, PromptSelection{Language: "en"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "DE: First paragraph.", first)
+	assert.Equal(t, "DE: Second paragraph.", second)
+	assert.Equal(t, " ", empty)
+	assert.Equal(t, "DE: Third paragraph.", third)
+	// every segment needs 3 tokens plus 12 for its tag, so two of them fit into a batch
+	require.Len(t, client.prompts, 2)
+	assert.Contains(t, client.prompts[0], "from English into German")
+}
+
+func TestTranslateTexts_SplitsLongTexts(t *testing.T) {
+	client := translatingClient()
+	text := "This is the first sentence. This is the second sentence"
+
+	err := translateTexts(context.Background(), client, []*string{&text}, "de", 20, PromptSelection{Language: "en"})
+	require.NoError(t, err)
+	assert.Equal(t, "DE: This is the first sentence. DE: This is the second sentence.", text)
+}
+
+func TestTranslateTexts_RetriesMisalignedTranslation(t *testing.T) {
+	calls := 0
+	client := &chatFuncClient{complete: func(prompt string) string {
+		calls++
+		if calls == 1 {
+			return `{"segments":[{"id":"1","text":"Erster und zweiter Absatz."}]}`
+		}
+		return `{"segments":[{"id":"1","text":"Erster."},{"id":"2","text":"Zweiter."}]}`
+	}}
+	first, second := "First.", "Second."
+
+	err := translateTexts(context.Background(), client, []*string{&first, &second}, "de", tokensForCompletion, PromptSelection{Language: "en"})
+	require.NoError(t, err)
+	assert.Equal(t, "Erster.", first)
+	assert.Equal(t, "Zweiter.", second)
+	assert.Equal(t, 2, calls)
+}
+
+func TestCheckTranslation(t *testing.T) {
+	segments := []translationSegment{{ID: "1"}, {ID: "2"}}
+
+	assert.NoError(t, checkTranslation(&StructuredTranslation{Segments: []TranslatedSegment{{ID: "1"}, {ID: "2"}}}, segments))
+	assert.ErrorIs(t, checkTranslation(&StructuredTranslation{Segments: []TranslatedSegment{{ID: "1"}}}, segments), ErrTranslationMisaligned)
+	assert.ErrorIs(t, checkTranslation(&StructuredTranslation{Segments: []TranslatedSegment{{ID: "2"}, {ID: "1"}}}, segments), ErrTranslationMisaligned)
+}
+
+func TestSplitMarkdownLine(t *testing.T) {
+	tests := []struct {
+		line, prefix, text string
+	}{
+		{"## Heading", "## ", "Heading"},
+		{"- Item", "- ", "Item"},
+		{"  - Nested item", "  - ", "Nested item"},
+		{"1. First", "1. ", "First"},
+		{"continued text", "", "continued text"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		prefix, text := splitMarkdownLine(test.line)
+		assert.Equal(t, test.prefix, prefix, test.line)
+		assert.Equal(t, test.text, text, test.line)
+	}
+}
+
+func TestTranslateHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/translate", translateHandler(translatingClient()))
+
+	body := `{
+		"target_language": "de",
+		"language": "en",
+		"text": "Hello.\n\nWorld.",
+		"segments": [{"start": 0, "end": 1.5, "text": "Hello."}, {"start": 1.5, "end": 3, "text": "World."}],
+		"outline": {"title": "Talk", "sections": [{"heading": "Intro", "points": [{"text": "Greeting", "details": ["Wave"]}]}]},
+		"bulletpoints": "## Topic\n- Point\n  - Detail",
+		"subtitle_format": "srt"
+	}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/translate", strings.NewReader(body))
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Text         string              `json:"text"`
+		Segments     []TranscriptSegment `json:"segments"`
+		Subtitles    string              `json:"subtitles"`
+		Outline      StructuredOutline   `json:"outline"`
+		Bulletpoints string              `json:"bulletpoints"`
+		Tree         []*BulletNode       `json:"bulletpoint_tree"`
+		Target       string              `json:"target_language"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	assert.Equal(t, "DE: Hello.\n\nDE: World.", response.Text)
+	assert.Equal(t, []TranscriptSegment{{Start: 0, End: 1.5, Text: "DE: Hello."}, {Start: 1.5, End: 3, Text: "DE: World."}}, response.Segments)
+	assert.Contains(t, response.Subtitles, "2\n00:00:01,500 --> 00:00:03,000\nDE: World.")
+	assert.Equal(t, "DE: Talk", response.Outline.Title)
+	assert.Equal(t, "DE: Wave", response.Outline.Sections[0].Points[0].Details[0])
+	assert.Equal(t, "## DE: Topic\n- DE: Point\n  - DE: Detail", response.Bulletpoints)
+	require.Len(t, response.Tree, 1)
+	assert.Equal(t, "DE: Topic", response.Tree[0].Text)
+	assert.Equal(t, "de", response.Target)
+}
+
+func TestTranslateHandler_InvalidRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/translate", translateHandler(translatingClient()))
+
+	for _, body := range []string{
+		`{"text": "Hello."}`,
+		`{"target_language": "de"}`,
+		`{"target_language": "not a language", "text": "Hello."}`,
+		`{"target_language": "de", "text": "Hello.", "subtitle_format": "srt"}`,
+		`{"target_language": "de", "segments": [{"text": "Hello."}], "subtitle_format": "ass"}`,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/translate", strings.NewReader(body))
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, fmt.Sprint(body))
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultMaxUploadMB is the default size limit of uploaded recordings in megabytes.
+	defaultMaxUploadMB = 500
+	// maxFormFieldBytes is the size limit of the form fields sent with an upload.
+	maxFormFieldBytes = 4096
+	// multipartOverheadBytes is allowed on top of the upload size for the boundaries and fields of the form.
+	multipartOverheadBytes = 1 << 20
+	// sniffBytes is the number of bytes inspected to detect the type of an upload.
+	sniffBytes = 512
+
+	// orphanedTempFileAge is the age after which files in the temp directory are considered orphaned by
+	// a crashed or killed server.
+	orphanedTempFileAge = time.Hour
+)
+
+var (
+	ErrNoFile               = errors.New("no file provided")
+	ErrUploadTooLarge       = errors.New("upload too large")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+)
+
+// maxUploadBytes is the size limit of uploaded recordings. It is set in main from MAX_UPLOAD_MB.
+var maxUploadBytes int64 = defaultMaxUploadMB << 20
+
+// tempRoot is the directory holding the temp directories of all requests.
+var tempRoot = filepath.Join(os.TempDir(), "talk-tailor")
+
+// loadMaxUploadBytes reads the size limit from MAX_UPLOAD_MB.
+func loadMaxUploadBytes(getenv func(string) string) (int64, error) {
+	value := getenv("MAX_UPLOAD_MB")
+	if value == "" {
+		return defaultMaxUploadMB << 20, nil
+	}
+	megabytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || megabytes <= 0 {
+		return 0, fmt.Errorf("MAX_UPLOAD_MB must be a positive integer: %q", value)
+	}
+	return megabytes << 20, nil
+}
+
+// requestTempDirs holds the temp directories of the requests in flight, so those of requests cancelled at
+// shutdown can be removed.
+var requestTempDirs sync.Map
+
+// newRequestTempDir creates a temp directory for the files of a single request. The caller removes it
+// with removeRequestTempDir when the request is done.
+func newRequestTempDir() (string, error) {
+	if err := os.MkdirAll(tempRoot, 0o700); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(tempRoot, "request-")
+	if err != nil {
+		return "", err
+	}
+	requestTempDirs.Store(dir, struct{}{})
+	return dir, nil
+}
+
+// removeRequestTempDir removes the temp directory of a request with all its files.
+func removeRequestTempDir(dir string) {
+	requestTempDirs.Delete(dir)
+	os.RemoveAll(dir)
+}
+
+// removeRequestTempDirs removes the temp directories of all requests in flight and returns their number.
+// It is run at shutdown, when the remaining requests have been cancelled.
+func removeRequestTempDirs() int {
+	removed := 0
+	requestTempDirs.Range(func(dir, _ any) bool {
+		removeRequestTempDir(dir.(string))
+		removed++
+		return true
+	})
+	return removed
+}
+
+// cleanTempDir removes files and directories in dir that have not been modified for maxAge. They are
+// left over by requests of a server that crashed or was killed.
+func cleanTempDir(dir string, maxAge time.Duration, now time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// cleanOrphanedTempFiles is run at startup and removes the temp directories of requests that never
+// finished, as well as the uploads and chunks earlier versions left in the system temp directory.
+func cleanOrphanedTempFiles() {
+	now := time.Now()
+	removed, err := cleanTempDir(tempRoot, orphanedTempFileAge, now)
+	if err != nil {
+		logEvent(context.Background(), slog.LevelWarn, "temp_cleanup_failed", gin.H{
+			"dir":   tempRoot,
+			"error": err.Error(),
+		})
+	}
+
+	for _, pattern := range []string{"uploaded_audio_*.mp3", "chunk-*.mp3"} {
+		matches, _ := filepath.Glob(filepath.Join(os.TempDir(), pattern))
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && now.Sub(info.ModTime()) >= orphanedTempFileAge {
+				if os.Remove(match) == nil {
+					removed++
+				}
+			}
+		}
+	}
+
+	if removed > 0 {
+		logEvent(context.Background(), slog.LevelInfo, "temp_files_removed", gin.H{
+			"dir":     tempRoot,
+			"removed": removed,
+		})
+	}
+}
+
+// Upload is a recording uploaded as multipart/form-data.
+type Upload struct {
+	// Path is the file the recording was saved to.
+	Path   string
+	Size   int64
+	Fields map[string]string
+}
+
+// receiveUpload streams the file of the form field to a file in dir, without keeping it in memory, and
+// collects the other fields of the form. It returns ErrUploadTooLarge if the file is larger than maxBytes
+// and ErrUnsupportedMediaType if its content is not a known audio or video format.
+func receiveUpload(c *gin.Context, field, dir string, maxBytes int64) (Upload, error) {
+	if c.Request.ContentLength > maxBytes+multipartOverheadBytes {
+		return Upload{}, ErrUploadTooLarge
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+multipartOverheadBytes)
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return Upload{}, ErrNoFile
+	}
+
+	upload := Upload{Fields: map[string]string{}}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Upload{}, uploadError(err)
+		}
+
+		if part.FormName() != field {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldBytes))
+			if err != nil {
+				return Upload{}, uploadError(err)
+			}
+			upload.Fields[part.FormName()] = string(value)
+			continue
+		}
+		if upload.Path != "" {
+			return Upload{}, fmt.Errorf("%w: more than one file", ErrUnsupportedMediaType)
+		}
+
+		upload.Path, upload.Size, err = saveUploadedFile(part, dir, maxBytes)
+		if err != nil {
+			return Upload{}, err
+		}
+	}
+
+	if upload.Path == "" {
+		return Upload{}, ErrNoFile
+	}
+	return upload, nil
+}
+
+// saveUploadedFile checks the type of the file by its first bytes and copies it to a file in dir named
+// after the type, so Whisper recognizes the format.
+func saveUploadedFile(src io.Reader, dir string, maxBytes int64) (string, int64, error) {
+	header := make([]byte, sniffBytes)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", 0, uploadError(err)
+	}
+	header = header[:n]
+	extension, ok := sniffMediaType(header)
+	if !ok {
+		return "", 0, ErrUnsupportedMediaType
+	}
+
+	path := filepath.Join(dir, "upload."+extension)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	// Copy one byte more than allowed to detect files that are too large.
+	size, err := io.Copy(file, io.LimitReader(io.MultiReader(bytes.NewReader(header), src), maxBytes+1))
+	if err != nil {
+		return "", 0, uploadError(err)
+	}
+	if size > maxBytes {
+		return "", 0, ErrUploadTooLarge
+	}
+	return path, size, file.Close()
+}
+
+// uploadError maps exceeding the body size limit to ErrUploadTooLarge.
+func uploadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return ErrUploadTooLarge
+	}
+	return err
+}
+
+// sniffMediaType detects the audio and video formats accepted by Whisper from the first bytes of a file
+// and returns the file extension for the format.
+func sniffMediaType(header []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return "mp3", true
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0 && header[1]&0x06 != 0:
+		// MPEG audio frame sync without an ID3 tag. A layer of 0 is raw AAC, which Whisper does not accept.
+		return "mp3", true
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		brand := string(header[8:12])
+		if strings.HasPrefix(brand, "M4A") || strings.HasPrefix(brand, "M4B") {
+			return "m4a", true
+		}
+		return "mp4", true
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return "wav", true
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return "ogg", true
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return "flac", true
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "webm", true
+	}
+	return "", false
+}
+
+// abortOnUploadError responds with the status matching the upload error.
+func abortOnUploadError(c *gin.Context, err error, maxBytes int64) {
+	switch {
+	case errors.Is(err, ErrNoFile):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+	case errors.Is(err, ErrUploadTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File too large, the limit is %d MB", maxBytes>>20)})
+	case errors.Is(err, ErrUnsupportedMediaType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported file type, upload an audio or video file"})
+	default:
+		logEvent(c, slog.LevelWarn, "upload_failed", gin.H{
+			"error": err.Error(),
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error reading upload"})
+	}
+}
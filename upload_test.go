@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffMediaType(t *testing.T) {
+	testCases := []struct {
+		name      string
+		header    []byte
+		extension string
+	}{
+		{"mp3 with ID3 tag", []byte("ID3\x04\x00\x00"), "mp3"},
+		{"mp3 frame", []byte{0xFF, 0xFB, 0x90, 0x64}, "mp3"},
+		{"m4a", []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"), "m4a"},
+		{"mp4", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), "mp4"},
+		{"wav", []byte("RIFF\x24\x08\x00\x00WAVEfmt "), "wav"},
+		{"ogg", []byte("OggS\x00\x02"), "ogg"},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), "flac"},
+		{"webm", []byte{0x1A, 0x45, 0xDF, 0xA3, 0x9F}, "webm"},
+		{"raw aac", []byte{0xFF, 0xF1, 0x50, 0x80}, ""},
+		{"text", []byte("hello world"), ""},
+		{"png", []byte("\x89PNG\r\n\x1a\n"), ""},
+		{"empty", nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			extension, ok := sniffMediaType(tc.header)
+			assert.Equal(t, tc.extension != "", ok)
+			assert.Equal(t, tc.extension, extension)
+		})
+	}
+}
+
+func TestReceiveUpload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mp3, err := os.ReadFile("test/fixtures/short.mp3")
+	require.NoError(t, err)
+
+	type result struct {
+		upload Upload
+		err    error
+	}
+	receive := func(maxBytes int64, build func(w *multipart.Writer)) (result, string) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		build(form)
+		require.NoError(t, form.Close())
+
+		dir := t.TempDir()
+		var got result
+		r := gin.New()
+		r.POST("/api/transcribe", func(c *gin.Context) {
+			got.upload, got.err = receiveUpload(c, "audio", dir, maxBytes)
+		})
+		req, _ := http.NewRequest("POST", "/api/transcribe", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		return got, dir
+	}
+	file := func(content []byte) func(w *multipart.Writer) {
+		return func(w *multipart.Writer) {
+			part, _ := w.CreateFormFile("audio", "recording.bin")
+			part.Write(content)
+			w.WriteField("language", "de")
+		}
+	}
+
+	got, dir := receive(int64(len(mp3)), file(mp3))
+	require.NoError(t, got.err)
+	assert.Equal(t, filepath.Join(dir, "upload.mp3"), got.upload.Path)
+	assert.Equal(t, int64(len(mp3)), got.upload.Size)
+	assert.Equal(t, "de", got.upload.Fields["language"], "fields after the file are read")
+	saved, err := os.ReadFile(got.upload.Path)
+	require.NoError(t, err)
+	assert.Equal(t, mp3, saved)
+
+	got, _ = receive(int64(len(mp3))-1, file(mp3))
+	assert.ErrorIs(t, got.err, ErrUploadTooLarge)
+
+	got, _ = receive(1<<20, file([]byte("#!/bin/sh\necho not audio")))
+	assert.ErrorIs(t, got.err, ErrUnsupportedMediaType)
+
+	got, _ = receive(1<<20, func(w *multipart.Writer) { w.WriteField("language", "de") })
+	assert.ErrorIs(t, got.err, ErrNoFile)
+}
+
+func TestCleanTempDir(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := filepath.Join(dir, "request-old")
+	require.NoError(t, os.MkdirAll(old, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(old, "upload.mp3"), []byte("ID3"), 0o600))
+	require.NoError(t, os.Chtimes(old, now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+	current := filepath.Join(dir, "request-current")
+	require.NoError(t, os.MkdirAll(current, 0o700))
+
+	removed, err := cleanTempDir(dir, time.Hour, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.NoDirExists(t, old)
+	assert.DirExists(t, current)
+
+	removed, err = cleanTempDir(filepath.Join(dir, "missing"), time.Hour, now)
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+}
+
+func TestLoadMaxUploadBytes(t *testing.T) {
+	limit, err := loadMaxUploadBytes(func(string) string { return "" })
+	require.NoError(t, err)
+	assert.Equal(t, int64(defaultMaxUploadMB<<20), limit)
+
+	limit, err = loadMaxUploadBytes(func(string) string { return "25" })
+	require.NoError(t, err)
+	assert.Equal(t, int64(25<<20), limit)
+
+	_, err = loadMaxUploadBytes(func(string) string { return "-1" })
+	assert.Error(t, err)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const usageLogFile = "usage.jsonl"
+
+// ModelPrice is the price of a model in US dollars.
+type ModelPrice struct {
+	PromptPerMillionTokens     float64 `json:"prompt_per_million_tokens"`
+	CompletionPerMillionTokens float64 `json:"completion_per_million_tokens"`
+	AudioPerMinute             float64 `json:"audio_per_minute"`
+}
+
+// PriceTable maps model names as used in requests to their prices.
+type PriceTable map[string]ModelPrice
+
+// defaultPrices are OpenAI's list prices for the models used by the server.
+var defaultPrices = PriceTable{
+	openai.Whisper1:    {AudioPerMinute: 0.006},
+	openai.GPT4o:       {PromptPerMillionTokens: 2.5, CompletionPerMillionTokens: 10},
+	openai.GPT4oLatest: {PromptPerMillionTokens: 5, CompletionPerMillionTokens: 15},
+	openai.GPT4oMini:   {PromptPerMillionTokens: 0.15, CompletionPerMillionTokens: 0.6},
+}
+
+// prices is used to estimate the cost of requests. It is replaced in main when PRICES_FILE is set.
+var prices = defaultPrices
+
+// usageLog persists the usage of every request. It is nil if usage is not persisted.
+var usageLog *UsageLog
+
+// loadPriceTable reads a JSON price table and returns the default prices with the prices of the file
+// added or replaced.
+func loadPriceTable(path string) (PriceTable, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides PriceTable
+	if err := json.Unmarshal(content, &overrides); err != nil {
+		return nil, fmt.Errorf("parsing price table %s: %w", path, err)
+	}
+
+	table := PriceTable{}
+	for model, price := range defaultPrices {
+		table[model] = price
+	}
+	for model, price := range overrides {
+		table[model] = price
+	}
+	return table, nil
+}
+
+// ModelUsage is the usage of a single model.
+type ModelUsage struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens,omitempty"`
+	CompletionTokens int     `json:"completion_tokens,omitempty"`
+	AudioSeconds     float64 `json:"audio_seconds,omitempty"`
+	// Cost is the estimated cost in US dollars, zero if the model is not in the price table.
+	Cost float64 `json:"estimated_cost_usd"`
+}
+
+// Usage is the usage of all OpenAI requests of a pipeline run.
+type Usage struct {
+	AudioSeconds     float64                `json:"audio_seconds"`
+	PromptTokens     int                    `json:"prompt_tokens"`
+	CompletionTokens int                    `json:"completion_tokens"`
+	Cost             float64                `json:"estimated_cost_usd"`
+	Models           map[string]*ModelUsage `json:"models"`
+}
+
+// estimateCost sets the cost of every model and the total cost from the price table.
+func (u *Usage) estimateCost(table PriceTable) {
+	u.Cost = 0
+	for model, usage := range u.Models {
+		price := table[model]
+		usage.Cost = float64(usage.PromptTokens)*price.PromptPerMillionTokens/1e6 +
+			float64(usage.CompletionTokens)*price.CompletionPerMillionTokens/1e6 +
+			usage.AudioSeconds/60*price.AudioPerMinute
+		u.Cost += usage.Cost
+	}
+}
+
+// usageRecorder is implemented by clients that account the usage of requests. Streamed completions only
+// report their usage in the last chunk, so it has to be recorded by the code reading the stream.
+type usageRecorder interface {
+	recordCompletion(model string, usage openai.Usage)
+}
+
+// usageClient is an OpenAIClient that accumulates the usage of all requests sent through it on behalf of a
+// user. Before every request it checks that the user has not reached a quota, taking the usage of the
+// running pipeline into account. Quotas only apply to requests using the server's OpenAI key.
+type usageClient struct {
+	OpenAIClient
+	user string
+	// keySource is keySourceUser if the requests use an OpenAI key supplied by the user.
+	keySource string
+
+	mu    sync.Mutex
+	usage Usage
+}
+
+func newUsageClient(client OpenAIClient, user string) *usageClient {
+	return &usageClient{
+		OpenAIClient: client,
+		user:         user,
+		keySource:    keySourceServer,
+		usage:        Usage{Models: map[string]*ModelUsage{}},
+	}
+}
+
+// checkQuota returns a *QuotaError if the user has reached a quota.
+func (u *usageClient) checkQuota() error {
+	if u.keySource == keySourceUser {
+		return nil
+	}
+	return quotaTracker.Check(u.user, time.Now(), quotaLimits, u.Usage())
+}
+
+// checkRecordingQuota returns a *QuotaError if transcribing a recording of the given duration would
+// exceed an audio quota of the user.
+func (u *usageClient) checkRecordingQuota(duration time.Duration) error {
+	if u.keySource == keySourceUser {
+		return nil
+	}
+	return quotaTracker.CheckRecording(u.user, time.Now(), quotaLimits, u.Usage(), duration)
+}
+
+func (u *usageClient) CreateTranscription(ctx context.Context, request openai.AudioRequest) (openai.AudioResponse, error) {
+	if err := u.checkQuota(); err != nil {
+		return openai.AudioResponse{}, err
+	}
+	response, err := u.OpenAIClient.CreateTranscription(ctx, request)
+	if err == nil {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		model := u.model(request.Model)
+		model.Requests++
+		model.AudioSeconds += response.Duration
+		u.usage.AudioSeconds += response.Duration
+	}
+	return response, err
+}
+
+func (u *usageClient) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if err := u.checkQuota(); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	response, err := u.OpenAIClient.CreateChatCompletion(ctx, request)
+	if err == nil {
+		u.recordCompletion(request.Model, response.Usage)
+	}
+	return response, err
+}
+
+// CreateChatCompletionStream requests the usage to be sent with the last chunk of the stream.
+func (u *usageClient) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error) {
+	if err := u.checkQuota(); err != nil {
+		return nil, err
+	}
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	return u.OpenAIClient.CreateChatCompletionStream(ctx, request)
+}
+
+func (u *usageClient) recordCompletion(model string, usage openai.Usage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	modelUsage := u.model(model)
+	modelUsage.Requests++
+	modelUsage.PromptTokens += usage.PromptTokens
+	modelUsage.CompletionTokens += usage.CompletionTokens
+	u.usage.PromptTokens += usage.PromptTokens
+	u.usage.CompletionTokens += usage.CompletionTokens
+}
+
+// model returns the usage of the given model. The caller must hold u.mu.
+func (u *usageClient) model(name string) *ModelUsage {
+	usage, ok := u.usage.Models[name]
+	if !ok {
+		usage = &ModelUsage{}
+		u.usage.Models[name] = usage
+	}
+	return usage
+}
+
+// Usage returns a copy of the accumulated usage with estimated costs.
+func (u *usageClient) Usage() Usage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage := u.usage
+	usage.Models = make(map[string]*ModelUsage, len(u.usage.Models))
+	for name, model := range u.usage.Models {
+		copied := *model
+		usage.Models[name] = &copied
+	}
+	usage.estimateCost(prices)
+	return usage
+}
+
+// save logs the usage of the request, adds it to the quota of the user and appends it to the usage log.
+// It is meant to be deferred by handlers, so the usage of failed requests is recorded as well.
+func (u *usageClient) save(c *gin.Context) {
+	record := UsageRecord{
+		Time:      time.Now().UTC(),
+		User:      u.user,
+		Endpoint:  c.FullPath(),
+		Status:    c.Writer.Status(),
+		KeySource: u.keySource,
+		Usage:     u.Usage(),
+	}
+	if record.KeySource != keySourceUser {
+		quotaTracker.Add(record.User, record.Time, record.Usage)
+	}
+
+	logEvent(c, slog.LevelInfo, "usage_recorded", gin.H{
+		"user":               record.User,
+		"endpoint":           record.Endpoint,
+		"status":             record.Status,
+		"key_source":         record.KeySource,
+		"audio_seconds":      record.Usage.AudioSeconds,
+		"prompt_tokens":      record.Usage.PromptTokens,
+		"completion_tokens":  record.Usage.CompletionTokens,
+		"estimated_cost_usd": record.Usage.Cost,
+	})
+
+	if err := usageLog.Append(record); err != nil {
+		logEvent(c, slog.LevelError, "usage_log_failed", gin.H{
+			"error": err.Error(),
+		})
+	}
+}
+
+// UsageRecord is an entry of the usage log.
+type UsageRecord struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	Endpoint string    `json:"endpoint"`
+	Status   int       `json:"status"`
+	// KeySource tells whether the server's or the user's OpenAI key was used.
+	KeySource string `json:"key_source,omitempty"`
+	Usage     Usage  `json:"usage"`
+}
+
+// UsageLog appends usage records as JSON lines to a file.
+type UsageLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+// openUsageLog creates the data directory if needed and returns a log writing to usage.jsonl in it.
+func openUsageLog(dataDir string) (*UsageLog, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &UsageLog{path: filepath.Join(dataDir, usageLogFile)}, nil
+}
+
+// Append writes the record to the log. Appending to a nil log does nothing.
+func (l *UsageLog) Append(record UsageRecord) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return appendJSONLine(l.path, record)
+}
+
+// Records reads all records of the log. A nil log or a log that has not been written yet has no records.
+func (l *UsageLog) Records() ([]UsageRecord, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var records []UsageRecord
+	err := readJSONLines(l.path, func(line []byte) error {
+		var record UsageRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// appendJSONLine appends the record as a line of JSON to the file at path. Callers serialize writes.
+func appendJSONLine(path string, record any) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readJSONLines calls parse with every non-empty line of the file at path. A missing file has no lines.
+func readJSONLines(path string, parse func(line []byte) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if err := parse(scanner.Bytes()); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
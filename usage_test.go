@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// usageMockClient reports fixed usage for every request.
+type usageMockClient struct {
+	chatFuncClient
+}
+
+func (m *usageMockClient) CreateTranscription(ctx context.Context, request openai.AudioRequest) (openai.AudioResponse, error) {
+	return openai.AudioResponse{Text: "mock transcription", Duration: 90}, nil
+}
+
+func (m *usageMockClient) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	response, err := m.chatFuncClient.CreateChatCompletion(ctx, request)
+	response.Usage = openai.Usage{PromptTokens: 1000, CompletionTokens: 200, TotalTokens: 1200}
+	return response, err
+}
+
+func TestUsageClient(t *testing.T) {
+	client := newUsageClient(&usageMockClient{chatFuncClient{complete: func(prompt string) string { return "answer" }}}, "test-user")
+
+	_, err := client.CreateTranscription(context.Background(), openai.AudioRequest{Model: openai.Whisper1})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
+			Model:    openai.GPT4o,
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "prompt"}},
+		})
+		require.NoError(t, err)
+	}
+	err = streamCompletion(context.Background(), client, "test", "prompt", 100, func(delta string) {})
+	require.NoError(t, err)
+
+	usage := client.Usage()
+	assert.Equal(t, 90.0, usage.AudioSeconds)
+	assert.Equal(t, 2010, usage.PromptTokens)
+	assert.Equal(t, 405, usage.CompletionTokens)
+
+	whisper := usage.Models[openai.Whisper1]
+	assert.Equal(t, 1, whisper.Requests)
+	assert.InDelta(t, 0.009, whisper.Cost, 1e-9)
+	gpt4o := usage.Models[openai.GPT4o]
+	assert.Equal(t, 2, gpt4o.Requests)
+	assert.Equal(t, 2000, gpt4o.PromptTokens)
+	assert.InDelta(t, 0.009, gpt4o.Cost, 1e-9)
+	streamed := usage.Models[openai.GPT4oLatest]
+	assert.Equal(t, 1, streamed.Requests)
+	assert.Equal(t, 5, streamed.CompletionTokens)
+	assert.InDelta(t, 0.000125, streamed.Cost, 1e-9)
+	assert.InDelta(t, 0.018125, usage.Cost, 1e-9)
+}
+
+func TestLoadPriceTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"gpt-4o": {"prompt_per_million_tokens": 1, "completion_per_million_tokens": 2},
+		"my-model": {"prompt_per_million_tokens": 3}
+	}`), 0o644))
+
+	table, err := loadPriceTable(path)
+	require.NoError(t, err)
+	assert.Equal(t, ModelPrice{PromptPerMillionTokens: 1, CompletionPerMillionTokens: 2}, table[openai.GPT4o])
+	assert.Equal(t, ModelPrice{PromptPerMillionTokens: 3}, table["my-model"])
+	assert.Equal(t, defaultPrices[openai.Whisper1], table[openai.Whisper1])
+
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0o644))
+	_, err = loadPriceTable(path)
+	assert.Error(t, err)
+}
+
+func TestUsageLog(t *testing.T) {
+	var nilLog *UsageLog
+	assert.NoError(t, nilLog.Append(UsageRecord{}))
+
+	dir := filepath.Join(t.TempDir(), "data")
+	log, err := openUsageLog(dir)
+	require.NoError(t, err)
+	require.NoError(t, log.Append(UsageRecord{Endpoint: "/api/outline", Status: 200}))
+	require.NoError(t, log.Append(UsageRecord{Endpoint: "/api/transform", Status: 500}))
+
+	content, err := os.ReadFile(filepath.Join(dir, usageLogFile))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+	var record UsageRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, "/api/transform", record.Endpoint)
+	assert.Equal(t, 500, record.Status)
+
+	records, err := log.Records()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "/api/outline", records[0].Endpoint)
+
+	empty, err := openUsageLog(t.TempDir())
+	require.NoError(t, err)
+	records, err = empty.Records()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestTransformHandler_RecordsUsage(t *testing.T) {
+	previous := usageLog
+	defer func() { usageLog = previous }()
+	var err error
+	usageLog, err = openUsageLog(t.TempDir())
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/transform", transformHandler(&usageMockClient{chatFuncClient{complete: func(prompt string) string { return "summary" }}}))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/transform", strings.NewReader(`{"text": "Some text.", "operation": "summary", "language": "en"}`))
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Usage Usage `json:"usage"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 1000, response.Usage.PromptTokens)
+	assert.Equal(t, 1, response.Usage.Models[openai.GPT4oLatest].Requests)
+
+	content, err := os.ReadFile(usageLog.path)
+	require.NoError(t, err)
+	var record UsageRecord
+	require.NoError(t, json.Unmarshal(content, &record))
+	assert.Equal(t, "/api/transform", record.Endpoint)
+	assert.Equal(t, http.StatusOK, record.Status)
+	assert.Equal(t, response.Usage.PromptTokens, record.Usage.PromptTokens)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	webhookDeliveriesFile = "webhook_deliveries.jsonl"
+
+	headerWebhookURL       = "X-Webhook-URL"
+	headerWebhookID        = "X-Webhook-Id"
+	headerWebhookEvent     = "X-Webhook-Event"
+	headerWebhookTimestamp = "X-Webhook-Timestamp"
+	headerWebhookSignature = "X-Webhook-Signature"
+
+	webhookRetries = 5
+	webhookTimeout = 30 * time.Second
+
+	// contextKeyStreamResult and contextKeyStreamError hold the body of the final event of a streaming
+	// response, so webhooks can report it.
+	contextKeyStreamResult = "stream_result"
+	contextKeyStreamError  = "stream_error"
+)
+
+// webhookRetryWaitMin is the wait before the first retry of a delivery, the wait doubles with every retry.
+var webhookRetryWaitMin = 2 * time.Second
+
+// WebhookConfig configures webhooks. It is read from the environment in main.
+type WebhookConfig struct {
+	// URLs receive the events of all requests.
+	URLs []string
+	// Secret signs the payloads with HMAC-SHA256. Payloads are not signed if it is empty.
+	Secret string
+	// AllowedHosts are the hosts the X-Webhook-URL header of a request may point to. "*" allows all hosts.
+	// Webhooks per request are disabled if empty.
+	AllowedHosts []string
+}
+
+// loadWebhookConfig reads the configuration from the environment.
+func loadWebhookConfig(getenv func(string) string) (WebhookConfig, error) {
+	config := WebhookConfig{
+		URLs:         splitList(getenv("WEBHOOK_URLS")),
+		Secret:       getenv("WEBHOOK_SECRET"),
+		AllowedHosts: splitList(getenv("WEBHOOK_ALLOWED_HOSTS")),
+	}
+	for _, webhookURL := range config.URLs {
+		if _, err := parseWebhookURL(webhookURL); err != nil {
+			return WebhookConfig{}, fmt.Errorf("WEBHOOK_URLS: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// parseWebhookURL checks that the URL is an absolute http or https URL.
+func parseWebhookURL(webhookURL string) (*url.URL, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", webhookURL)
+	}
+	return u, nil
+}
+
+// WebhookEvent is the JSON payload sent to webhooks.
+type WebhookEvent struct {
+	ID string `json:"id"`
+	// Type is the kind of result and whether it completed or failed, e.g. "transcription.completed".
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	Endpoint string    `json:"endpoint"`
+	Status   int       `json:"status"`
+	// Result is the response of the request if it completed.
+	Result json.RawMessage `json:"result,omitempty"`
+	// Error is the error message of the response if the request failed.
+	Error string `json:"error,omitempty"`
+}
+
+// WebhookDelivery is an entry of the delivery log.
+type WebhookDelivery struct {
+	Time      time.Time `json:"time"`
+	EventID   string    `json:"event_id"`
+	EventType string    `json:"event_type"`
+	User      string    `json:"user"`
+	URL       string    `json:"url"`
+	Attempts  int       `json:"attempts"`
+	Delivered bool      `json:"delivered"`
+	// Status is the status code of the last response, zero if no response was received.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Webhooks delivers events to the configured webhooks and the webhooks of requests.
+type Webhooks struct {
+	config WebhookConfig
+	client *retryablehttp.Client
+
+	// logMu serializes writes to the delivery log at logPath. logPath is empty if deliveries are not logged.
+	logMu   sync.Mutex
+	logPath string
+
+	// jobsDir stores the jobs of requests with a webhook until they are done. It is empty if jobs are only
+	// kept in temp directories and not resumed after a restart.
+	jobsDir string
+
+	// pending tracks jobs and deliveries in flight.
+	pending sync.WaitGroup
+}
+
+// newWebhooks returns webhooks logging their deliveries and storing their jobs in the data directory. An
+// empty data directory disables the delivery log and resuming jobs.
+func newWebhooks(config WebhookConfig, dataDir string) *Webhooks {
+	client := retryablehttp.NewClient()
+	client.RetryMax = webhookRetries
+	client.RetryWaitMin = webhookRetryWaitMin
+	client.RetryWaitMax = time.Minute
+	client.HTTPClient.Timeout = webhookTimeout
+	client.Logger = nil
+	client.ErrorHandler = retryablehttp.PassthroughErrorHandler
+	client.RequestLogHook = func(_ retryablehttp.Logger, r *http.Request, attempt int) {
+		if attempts, ok := r.Context().Value(attemptsKey{}).(*int); ok {
+			*attempts = attempt + 1
+		}
+	}
+	// Redirects are not followed, so per-request webhooks cannot be redirected to other hosts.
+	client.HTTPClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	webhooks := &Webhooks{config: config, client: client}
+	if dataDir != "" {
+		webhooks.logPath = filepath.Join(dataDir, webhookDeliveriesFile)
+		webhooks.jobsDir = filepath.Join(dataDir, webhookJobsDir)
+	}
+	return webhooks
+}
+
+// handler handles requests with handle and sends an event of the kind, e.g. "transcription", to the
+// webhooks once the request is handled. Requests can add a webhook with the X-Webhook-URL header. They are
+// answered at once with 202 Accepted and the ID of the job, which is the ID of the event, and handled in
+// the background, so they are not cancelled when the client disconnects.
+func (w *Webhooks) handler(kind string, handle gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if job, ok := resumedJob(c.Request.Context()); ok {
+			writer := newJobWriter()
+			c.Writer = writer
+			w.runJob(c, writer, job, handle)
+			return
+		}
+
+		urls := w.config.URLs
+		requested := strings.TrimSpace(c.GetHeader(headerWebhookURL))
+		if requested != "" {
+			u, err := parseWebhookURL(requested)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid " + headerWebhookURL + " header"})
+				return
+			}
+			if !hostAllowed(w.config.AllowedHosts, u) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Webhook URL not allowed"})
+				return
+			}
+			urls = append(urls[:len(urls):len(urls)], requested)
+		}
+		if len(urls) == 0 {
+			handle(c)
+			return
+		}
+
+		if requested != "" {
+			w.startJob(c, kind, urls, handle)
+			return
+		}
+		writer := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		handle(c)
+		w.Send(c.Request.Context(), newWebhookEvent(c, kind, newEventID(), writer.Status(), writer.body.Bytes()), urls)
+	}
+}
+
+// newWebhookEvent returns the event of the handled request with the status and body of its response.
+func newWebhookEvent(c *gin.Context, kind, id string, status int, body []byte) WebhookEvent {
+	event := WebhookEvent{
+		ID:       id,
+		Time:     time.Now().UTC(),
+		User:     userID(c),
+		Endpoint: c.FullPath(),
+		Status:   status,
+	}
+	if result, ok := c.Get(contextKeyStreamResult); ok {
+		body, _ = json.Marshal(result)
+	} else if streamErr, ok := c.Get(contextKeyStreamError); ok {
+		body, _ = json.Marshal(streamErr)
+		event.Status = http.StatusInternalServerError
+	}
+
+	if event.Status < http.StatusBadRequest {
+		event.Type = kind + ".completed"
+		if json.Valid(body) {
+			event.Result = json.RawMessage(body)
+		}
+	} else {
+		event.Type = kind + ".failed"
+		var response struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &response)
+		event.Error = response.Error
+	}
+	return event
+}
+
+// Send delivers the event to the URLs in the background. The deliveries are logged with the request ID of
+// ctx and the event ID as job ID, and are not cancelled with the request.
+func (w *Webhooks) Send(ctx context.Context, event WebhookEvent, urls []string) {
+	ctx = withJobID(context.WithoutCancel(ctx), event.ID)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logEvent(ctx, slog.LevelError, "webhook_failed", gin.H{
+			"event_id": event.ID,
+			"error":    err.Error(),
+		})
+		return
+	}
+	for _, webhookURL := range urls {
+		w.pending.Add(1)
+		done := trackJob(jobKindWebhookDelivery)
+		go func(webhookURL string) {
+			defer w.pending.Done()
+			defer done()
+			w.deliver(ctx, event, webhookURL, payload)
+		}(webhookURL)
+	}
+}
+
+// Wait blocks until all deliveries in flight are done.
+func (w *Webhooks) Wait() {
+	w.pending.Wait()
+}
+
+// deliver posts the payload to the URL, retrying failed attempts, and logs the delivery.
+func (w *Webhooks) deliver(ctx context.Context, event WebhookEvent, webhookURL string, payload []byte) {
+	delivery := WebhookDelivery{
+		EventID:   event.ID,
+		EventType: event.Type,
+		User:      event.User,
+		URL:       webhookURL,
+	}
+
+	request, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, webhookURL, payload)
+	if err == nil {
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set(headerWebhookID, event.ID)
+		request.Header.Set(headerWebhookEvent, event.Type)
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(headerWebhookTimestamp, timestamp)
+		if w.config.Secret != "" {
+			request.Header.Set(headerWebhookSignature, signWebhookPayload(w.config.Secret, timestamp, payload))
+		}
+
+		var response *http.Response
+		response, err = w.client.Do(request.WithContext(withAttemptCounter(request.Context(), &delivery.Attempts)))
+		if response != nil {
+			response.Body.Close()
+			delivery.Status = response.StatusCode
+			if response.StatusCode >= 300 {
+				err = fmt.Errorf("webhook responded with %s", response.Status)
+			}
+		}
+	}
+
+	delivery.Time = time.Now().UTC()
+	delivery.Delivered = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+		logEvent(ctx, slog.LevelWarn, "webhook_failed", gin.H{
+			"event_id": event.ID,
+			"url":      webhookURL,
+			"attempts": delivery.Attempts,
+			"error":    delivery.Error,
+		})
+	} else {
+		logEvent(ctx, slog.LevelInfo, "webhook_delivered", gin.H{
+			"event_id": event.ID,
+			"url":      webhookURL,
+			"attempts": delivery.Attempts,
+		})
+	}
+
+	if w.logPath != "" {
+		w.logMu.Lock()
+		defer w.logMu.Unlock()
+		if err := appendJSONLine(w.logPath, delivery); err != nil {
+			logEvent(ctx, slog.LevelError, "webhook_log_failed", gin.H{
+				"error": err.Error(),
+			})
+		}
+	}
+}
+
+// Deliveries returns the logged deliveries of the user, the most recent first.
+func (w *Webhooks) Deliveries(user string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	if w.logPath == "" {
+		return deliveries, nil
+	}
+
+	w.logMu.Lock()
+	defer w.logMu.Unlock()
+	err := readJSONLines(w.logPath, func(line []byte) error {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(line, &delivery); err != nil {
+			return err
+		}
+		if delivery.User == user {
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+		deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+	}
+	return deliveries, nil
+}
+
+// signWebhookPayload returns the signature of the payload sent at the Unix timestamp. Receivers compute
+// the HMAC-SHA256 of "<timestamp>.<payload>" with the shared secret and compare it to the signature.
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliveriesHandler returns the webhook deliveries of the requesting user.
+func webhookDeliveriesHandler(webhooks *Webhooks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deliveries, err := webhooks.Deliveries(userID(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading webhook deliveries"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	}
+}
+
+// capturingWriter keeps a copy of the response body.
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// attemptsKey is the context key of the counter of delivery attempts.
+type attemptsKey struct{}
+
+func withAttemptCounter(ctx context.Context, attempts *int) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, attempts)
+}
+
+func newEventID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records the requests of webhooks and responds with the given status codes in order,
+// and with 200 OK once they are used up.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	statuses []int
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		if len(receiver.statuses) > 0 {
+			w.WriteHeader(receiver.statuses[0])
+			receiver.statuses = receiver.statuses[1:]
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (r *webhookReceiver) event(t *testing.T, i int) WebhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	require.Greater(t, len(r.bodies), i)
+	var event WebhookEvent
+	require.NoError(t, json.Unmarshal(r.bodies[i], &event))
+	return event
+}
+
+func newTestWebhooks(t *testing.T, config WebhookConfig) *Webhooks {
+	previous := webhookRetryWaitMin
+	webhookRetryWaitMin = time.Millisecond
+	t.Cleanup(func() { webhookRetryWaitMin = previous })
+	return newWebhooks(config, t.TempDir())
+}
+
+func newWebhookRouter(webhooks *Webhooks) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/outline", webhooks.handler("outline", func(c *gin.Context) {
+		if c.Query("fail") != "" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating response"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"response": "# Outline"})
+	}))
+	r.POST("/api/outline/stream", webhooks.handler("outline", func(c *gin.Context) {
+		body := gin.H{"response": "# Streamed"}
+		c.Set(contextKeyStreamResult, body)
+		c.SSEvent(sseEventDelta, gin.H{"part": 0, "content": "# Streamed"})
+		c.SSEvent(sseEventDone, body)
+	}))
+	return r
+}
+
+func postWebhookRequest(r *gin.Engine, path, webhookURL string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, nil)
+	if webhookURL != "" {
+		req.Header.Set(headerWebhookURL, webhookURL)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestWebhooks_SignedEvents(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	webhooks := newTestWebhooks(t, WebhookConfig{URLs: []string{receiver.URL}, Secret: "shared-secret"})
+	r := newWebhookRouter(webhooks)
+
+	w := postWebhookRequest(r, "/api/outline", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	postWebhookRequest(r, "/api/outline?fail=1", "")
+	postWebhookRequest(r, "/api/outline/stream", "")
+	webhooks.Wait()
+
+	receiver.mu.Lock()
+	require.Len(t, receiver.requests, 3)
+	request, body := receiver.requests[0], receiver.bodies[0]
+	receiver.mu.Unlock()
+
+	mac := hmac.New(sha256.New, []byte("shared-secret"))
+	mac.Write([]byte(request.Header.Get(headerWebhookTimestamp) + "."))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), request.Header.Get(headerWebhookSignature))
+	assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+
+	events := map[string]WebhookEvent{}
+	for i := 0; i < 3; i++ {
+		event := receiver.event(t, i)
+		events[event.Type+" "+event.Endpoint] = event
+	}
+	completed := events["outline.completed /api/outline"]
+	assert.JSONEq(t, `{"response": "# Outline"}`, string(completed.Result))
+	assert.Equal(t, http.StatusOK, completed.Status)
+	failed := events["outline.failed /api/outline"]
+	assert.Equal(t, "Error creating response", failed.Error)
+	assert.Empty(t, failed.Result)
+	streamed := events["outline.completed /api/outline/stream"]
+	assert.JSONEq(t, `{"response": "# Streamed"}`, string(streamed.Result))
+}
+
+func TestWebhooks_RetriesAndDeliveryLog(t *testing.T) {
+	flaky := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	rejecting := newWebhookReceiver(t, http.StatusBadRequest)
+	webhooks := newTestWebhooks(t, WebhookConfig{URLs: []string{flaky.URL, rejecting.URL}})
+	r := newWebhookRouter(webhooks)
+
+	postWebhookRequest(r, "/api/outline", "")
+	webhooks.Wait()
+
+	deliveries, err := webhooks.Deliveries("ip:")
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	byURL := map[string]WebhookDelivery{}
+	for _, delivery := range deliveries {
+		byURL[delivery.URL] = delivery
+	}
+
+	assert.True(t, byURL[flaky.URL].Delivered)
+	assert.Equal(t, 3, byURL[flaky.URL].Attempts)
+	assert.Equal(t, http.StatusOK, byURL[flaky.URL].Status)
+
+	assert.False(t, byURL[rejecting.URL].Delivered)
+	assert.Equal(t, 1, byURL[rejecting.URL].Attempts, "client errors are not retried")
+	assert.Equal(t, http.StatusBadRequest, byURL[rejecting.URL].Status)
+	assert.Equal(t, "outline.completed", byURL[rejecting.URL].EventType)
+
+	other, err := webhooks.Deliveries("someone-else")
+	require.NoError(t, err)
+	assert.Empty(t, other)
+}
+
+func TestWebhooks_PerRequestURL(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	u, err := url.Parse(receiver.URL)
+	require.NoError(t, err)
+
+	webhooks := newTestWebhooks(t, WebhookConfig{AllowedHosts: []string{u.Hostname()}})
+	r := newWebhookRouter(webhooks)
+
+	assert.Equal(t, http.StatusForbidden, postWebhookRequest(r, "/api/outline", "http://intranet.example.com/hook").Code)
+	assert.Equal(t, http.StatusBadRequest, postWebhookRequest(r, "/api/outline", "file:///etc/passwd").Code)
+
+	w := postWebhookRequest(r, "/api/outline", receiver.URL+"/hook")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var job struct {
+		JobID string `json:"job_id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	webhooks.Wait()
+	event := receiver.event(t, 0)
+	assert.Equal(t, "outline.completed", event.Type)
+	assert.Equal(t, job.JobID, event.ID)
+	assert.JSONEq(t, `{"response": "# Outline"}`, string(event.Result))
+	receiver.mu.Lock()
+	assert.Equal(t, "/hook", receiver.requests[0].URL.Path)
+	assert.Empty(t, receiver.requests[0].Header.Get(headerWebhookSignature), "payloads are not signed without a secret")
+	receiver.mu.Unlock()
+
+	// without webhooks, responses are not captured
+	gin.SetMode(gin.TestMode)
+	plain := gin.New()
+	plain.POST("/api/outline", webhooks.handler("outline", func(c *gin.Context) {
+		_, captured := c.Writer.(*capturingWriter)
+		c.JSON(http.StatusOK, gin.H{"captured": captured})
+	}))
+	w = postWebhookRequest(plain, "/api/outline", "")
+	assert.JSONEq(t, `{"captured": false}`, w.Body.String())
+}
+
+func TestWebhooks_JobOutlivesRequest(t *testing.T) {
+	previousTempRoot := tempRoot
+	tempRoot = t.TempDir()
+	defer func() { tempRoot = previousTempRoot }()
+	receiver := newWebhookReceiver(t)
+	webhooks := newTestWebhooks(t, WebhookConfig{AllowedHosts: []string{"*"}})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	started, release := make(chan struct{}), make(chan struct{})
+	r.POST("/api/outline", webhooks.handler("outline", func(c *gin.Context) {
+		close(started)
+		<-release
+		// the body is read after the request was answered and the client disconnected
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil || c.Request.Context().Err() != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Request cancelled"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"response": string(body)})
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "POST", "/api/outline", strings.NewReader("# Outline"))
+	req.Header.Set(headerWebhookURL, receiver.URL)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	<-started
+	cancel()
+	close(release)
+	webhooks.Wait()
+
+	event := receiver.event(t, 0)
+	assert.Equal(t, "outline.completed", event.Type)
+	assert.JSONEq(t, `{"response": "# Outline"}`, string(event.Result))
+	entries, err := os.ReadDir(webhooks.jobsDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "the job is removed once it is done")
+}
+
+func TestWebhooks_ResumesJobs(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	webhooks := newTestWebhooks(t, WebhookConfig{AllowedHosts: []string{"*"}})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/outline", authMiddleware([]Authenticator{newAPIKeyAuthenticator([]string{"alice:secret"})}),
+		webhooks.handler("outline", func(c *gin.Context) {
+			body, _ := io.ReadAll(c.Request.Body)
+			c.JSON(http.StatusOK, gin.H{"response": string(body), "user": userID(c)})
+		}))
+
+	// jobs left over by a previous run of the server
+	storeJob := func(id string, attempts int, openAIKeyHeader bool) {
+		_, body, err := webhooks.storeJob(webhookJob{
+			ID:                id,
+			Kind:              "outline",
+			Method:            http.MethodPost,
+			URL:               "/api/outline",
+			Endpoint:          "/api/outline",
+			Header:            http.Header{"Content-Type": {"text/plain"}},
+			User:              "alice",
+			AuthenticatedUser: "alice",
+			OpenAIKeyHeader:   openAIKeyHeader,
+			URLs:              []string{receiver.URL},
+			Attempts:          attempts,
+		}, strings.NewReader("# Outline"))
+		require.NoError(t, err)
+		require.NoError(t, body.Close())
+	}
+	storeJob("interrupted", 1, false)
+	storeJob("own-key", 1, true)
+	storeJob("crashing", maxJobAttempts, false)
+
+	assert.Equal(t, 1, webhooks.Resume(r))
+	webhooks.Wait()
+
+	events := map[string]WebhookEvent{}
+	for i := 0; i < 3; i++ {
+		event := receiver.event(t, i)
+		events[event.ID] = event
+	}
+	assert.Equal(t, "outline.completed", events["interrupted"].Type)
+	assert.JSONEq(t, `{"response": "# Outline", "user": "alice"}`, string(events["interrupted"].Result), "resumed jobs run as their user")
+	assert.Equal(t, "outline.failed", events["own-key"].Type)
+	assert.Equal(t, "outline.failed", events["crashing"].Type)
+	assert.Equal(t, "alice", events["crashing"].User)
+	entries, err := os.ReadDir(webhooks.jobsDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// requests of clients cannot claim to be resumed jobs
+	assert.Equal(t, http.StatusUnauthorized, postWebhookRequest(r, "/api/outline", receiver.URL).Code)
+}
+
+func TestLoadWebhookConfig(t *testing.T) {
+	env := map[string]string{
+		"WEBHOOK_URLS":          "https://hooks.example.com/a, https://hooks.example.com/b",
+		"WEBHOOK_SECRET":        "secret",
+		"WEBHOOK_ALLOWED_HOSTS": "*",
+	}
+	config, err := loadWebhookConfig(func(name string) string { return env[name] })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://hooks.example.com/a", "https://hooks.example.com/b"}, config.URLs)
+	assert.Equal(t, []string{"*"}, config.AllowedHosts)
+
+	env["WEBHOOK_URLS"] = "hooks.example.com"
+	_, err = loadWebhookConfig(func(name string) string { return env[name] })
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "WEBHOOK_URLS"))
+}